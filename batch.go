@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// Batcher 收集发往同一目标的邮件，凑满 --batch-max-items 封、--batch-max-bytes 字节
+// 或等待 --batch-max-wait 后作为 JSON 数组一次 POST；每封邮件的调用方阻塞到所在批次有结果为止
+type Batcher struct {
+	maxItems int
+	maxBytes int64
+	maxWait  time.Duration
+
+	mu      sync.Mutex
+	pending map[string]*batch // 按目标配置分组，正在收集的批次
+}
+
+// batch 一个正在收集或发送中的批次
+type batch struct {
+	target *WebhookTarget
+	items  []*batchItem
+	size   int64
+	timer  *time.Timer
+}
+
+type batchItem struct {
+	msg  *EmailMessage
+	done chan error
+}
+
+// batchResponse webhook 可以按请求中的顺序逐条给出结论，每条与单封投递的响应体格式相同
+type batchResponse struct {
+	Results []json.RawMessage `json:"results"`
+}
+
+// NewBatcher 创建批量投递器
+func NewBatcher(maxItems int, maxBytes int64, maxWait time.Duration) *Batcher {
+	return &Batcher{
+		maxItems: maxItems,
+		maxBytes: maxBytes,
+		maxWait:  maxWait,
+		pending:  make(map[string]*batch),
+	}
+}
+
+// Deliver 将邮件加入目标的当前批次，返回这封邮件自己的投递结果
+func (b *Batcher) Deliver(target *WebhookTarget, msg *EmailMessage) error {
+	counter := &countingWriter{}
+	if err := writeMessageJSON(counter, msg); err != nil {
+		return &DeliveryError{Code: "E1", Permanent: true, Err: fmt.Errorf("cannot encode message: %v", err)}
+	}
+
+	key, err := batchKey(target)
+	if err != nil {
+		return &DeliveryError{Code: "E1", Permanent: true, Err: err}
+	}
+
+	item := &batchItem{msg: msg, done: make(chan error, 1)}
+
+	b.mu.Lock()
+	bt := b.pending[key]
+
+	// 加入后会超出字节上限时先发出当前批次，单封超过上限的邮件单独成批
+	if bt != nil && bt.size+counter.n > b.maxBytes {
+		b.detach(key, bt)
+		go b.send(bt)
+		bt = nil
+	}
+
+	if bt == nil {
+		t := *target
+		bt = &batch{target: &t}
+		b.pending[key] = bt
+		bt.timer = time.AfterFunc(b.maxWait, func() {
+			b.expire(key, bt)
+		})
+	}
+
+	bt.items = append(bt.items, item)
+	bt.size += counter.n
+
+	if len(bt.items) >= b.maxItems || bt.size >= b.maxBytes {
+		b.detach(key, bt)
+		go b.send(bt)
+	}
+	b.mu.Unlock()
+
+	return <-item.done
+}
+
+// detach 将批次移出收集状态，调用方持有锁
+func (b *Batcher) detach(key string, bt *batch) {
+	bt.timer.Stop()
+	if b.pending[key] == bt {
+		delete(b.pending, key)
+	}
+}
+
+// expire 等待超时，发出尚未凑满的批次
+func (b *Batcher) expire(key string, bt *batch) {
+	b.mu.Lock()
+	if b.pending[key] != bt {
+		b.mu.Unlock()
+		return
+	}
+	delete(b.pending, key)
+	b.mu.Unlock()
+
+	b.send(bt)
+}
+
+// send POST 整个批次，并把每封邮件的结果交给等待中的调用方
+func (b *Batcher) send(bt *batch) {
+	errs := b.post(bt)
+	for i, item := range bt.items {
+		item.done <- errs[i]
+	}
+}
+
+func (b *Batcher) post(bt *batch) []error {
+	n := len(bt.items)
+	errs := make([]error, n)
+	fail := func(err error) []error {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+
+	log.Printf("BATCH: Sending %d messages (%d bytes) to %s", n, bt.size, bt.target.URL)
+
+	payload := newPayload("application/json", func(w io.Writer) error {
+		if _, err := io.WriteString(w, "["); err != nil {
+			return err
+		}
+		for i, item := range bt.items {
+			if i > 0 {
+				if _, err := io.WriteString(w, ","); err != nil {
+					return err
+				}
+			}
+			if err := writeMessageJSON(w, item.msg); err != nil {
+				return err
+			}
+		}
+		_, err := io.WriteString(w, "]")
+		return err
+	})
+
+	resp, err := exchangeWebhook(bt.target, payload)
+	if err != nil {
+		return fail(err)
+	}
+
+	results := &batchResponse{}
+	if json.Unmarshal(resp.Body, results) != nil || results.Results == nil {
+		// 没有逐条结论时整个响应作用于批次中的每封邮件
+		verdict := parseVerdict(resp.StatusCode, resp.Body)
+		log.Printf("BATCH: Verdict for all %d messages: %s", n, verdict.describe())
+		return fail(verdictError(verdict, hasExplicitVerdict(resp.Body),
+			fmt.Sprintf("%s, Body: %s", resp.Status, string(resp.Body))))
+	}
+
+	// 条数对不上时无法知道哪些邮件已被接收，全部按临时失败重试，接收方可以用 idempotency_key 去重
+	if len(results.Results) != n {
+		log.Printf("BATCH: %s returned %d results for %d messages, retrying the whole batch", bt.target.URL, len(results.Results), n)
+		return fail(&DeliveryError{Code: "E2",
+			Err: fmt.Errorf("webhook returned %d results for a batch of %d - %s", len(results.Results), n, resp.Status)})
+	}
+
+	accepted := 0
+	for i, raw := range results.Results {
+		verdict := parseVerdict(resp.StatusCode, raw)
+		if verdict.Action == VerdictAccept {
+			accepted++
+		}
+		errs[i] = verdictError(verdict, hasExplicitVerdict(raw),
+			fmt.Sprintf("%s, Item %d/%d: %s", resp.Status, i+1, n, string(raw)))
+	}
+	log.Printf("BATCH: %s accepted %d of %d messages", bt.target.URL, accepted, n)
+
+	return errs
+}
+
+// batchKey 只有投递配置完全相同的目标才合并到同一批次，例如按域名使用不同签名密钥的目标分开发送
+func batchKey(target *WebhookTarget) (string, error) {
+	t := *target
+	t.Delivered = false
+	key, err := json.Marshal(&t)
+	if err != nil {
+		return "", fmt.Errorf("cannot encode batch key: %v", err)
+	}
+	return string(key), nil
+}
+
+// batchEnabled 是否有目标开启了批量投递
+func batchEnabled() bool {
+	for _, t := range flagWebhooks.targets {
+		if t.Batch {
+			return true
+		}
+	}
+	for _, r := range flagRoutes.routes {
+		for _, t := range r.Targets {
+			if t.Batch {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// 全局批量投递器，main 中按配置创建
+var batcher *Batcher
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// deliverBatch 并发投递 subjects 中的每封邮件，返回按主题索引的结果
+func deliverBatch(t *testing.T, url string, subjects ...string) map[string]error {
+	t.Helper()
+	b := NewBatcher(len(subjects), 1<<20, time.Minute)
+	target := &WebhookTarget{URL: url, Batch: true}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	results := make(map[string]error)
+	for _, subject := range subjects {
+		wg.Add(1)
+		go func(subject string) {
+			defer wg.Done()
+			err := b.Deliver(target, &EmailMessage{Subject: subject})
+			mu.Lock()
+			results[subject] = err
+			mu.Unlock()
+		}(subject)
+	}
+	wg.Wait()
+
+	return results
+}
+
+// batchServer 按请求中每封邮件的主题给出逐条结论
+func batchServer(t *testing.T, verdicts map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msgs []EmailMessage
+		if err := json.NewDecoder(r.Body).Decode(&msgs); err != nil {
+			t.Errorf("batch body is not a JSON array: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		results := []string{}
+		for _, m := range msgs {
+			results = append(results, verdicts[m.Subject])
+		}
+		fmt.Fprintf(w, `{"results":[%s]}`, strings.Join(results, ","))
+	}))
+}
+
+func TestBatchPerItemVerdicts(t *testing.T) {
+	srv := batchServer(t, map[string]string{
+		"accepted": `{"action":"accept"}`,
+		"rejected": `{"action":"reject","smtp_code":554,"message":"no such mailbox"}`,
+		"deferred": `{"action":"tempfail","message":"mailbox busy"}`,
+	})
+	defer srv.Close()
+
+	results := deliverBatch(t, srv.URL, "accepted", "rejected", "deferred")
+
+	if err := results["accepted"]; err != nil {
+		t.Errorf("accepted item: %v, want nil", err)
+	}
+
+	rejected, ok := results["rejected"].(*DeliveryError)
+	if !ok || !rejected.Permanent || rejected.Verdict == nil || rejected.Verdict.SMTPCode != 554 {
+		t.Errorf("rejected item: %#v, want a permanent 554", results["rejected"])
+	}
+
+	deferred, ok := results["deferred"].(*DeliveryError)
+	if !ok || deferred.Permanent || deferred.Verdict == nil || deferred.Verdict.Message != "mailbox busy" {
+		t.Errorf("deferred item: %#v, want a temporary failure with the webhook message", results["deferred"])
+	}
+}
+
+func TestBatchResultCountMismatch(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"results":[{"action":"accept"}]}`)
+	}))
+	defer srv.Close()
+
+	for subject, err := range deliverBatch(t, srv.URL, "one", "two") {
+		derr, ok := err.(*DeliveryError)
+		if !ok || derr.Permanent || derr.Code != "E2" {
+			t.Errorf("%s: %#v, want a temporary E2 failure", subject, err)
+		}
+	}
+}
+
+func TestBatchWholeResponseVerdict(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		body      string
+		wantErr   bool
+		permanent bool
+	}{
+		{"2xx without results", http.StatusOK, `ok`, false, false},
+		{"batch-wide reject", http.StatusOK, `{"action":"reject"}`, true, true},
+		{"server error", http.StatusInternalServerError, `oops`, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				fmt.Fprint(w, tt.body)
+			}))
+			defer srv.Close()
+
+			for subject, err := range deliverBatch(t, srv.URL, "one", "two") {
+				if (err != nil) != tt.wantErr {
+					t.Errorf("%s: err = %v, want error %v", subject, err, tt.wantErr)
+					continue
+				}
+				if derr, ok := err.(*DeliveryError); ok && derr.Permanent != tt.permanent {
+					t.Errorf("%s: permanent = %v, want %v", subject, derr.Permanent, tt.permanent)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BlobStore 附件外部存储，Put 返回接收方可下载的带签名、会过期的 URL
+type BlobStore interface {
+	Put(key string, data []byte, contentType string) (string, error)
+}
+
+// offloadFiles 将超过阈值的附件和内嵌文件写入外部存储，payload 中只保留 URL、大小和 sha256；
+// --raw-message=reference 时原始邮件也写入外部存储
+func offloadFiles(store BlobStore, msg *EmailMessage) error {
+	if msg.Raw != nil && *flagRawMessage == RawReference {
+		if err := offloadRaw(store, msg.Raw); err != nil {
+			return err
+		}
+	}
+
+	for _, a := range msg.Attachments {
+		if a.URL != "" || int64(a.File().Len()) < *flagBlobMinSize {
+			continue
+		}
+		content, err := a.File().Bytes()
+		if err != nil {
+			return fmt.Errorf("cannot offload attachment %s: %v", a.Filename, err)
+		}
+		url, sum, err := putBlob(store, a.Filename, content, a.ContentType)
+		if err != nil {
+			return fmt.Errorf("cannot offload attachment %s: %v", a.Filename, err)
+		}
+		a.URL, a.Size, a.SHA256 = url, len(content), sum
+		a.Data = ""
+	}
+
+	for _, e := range msg.EmbeddedFiles {
+		if e.URL != "" || int64(e.File().Len()) < *flagBlobMinSize {
+			continue
+		}
+		content, err := e.File().Bytes()
+		if err != nil {
+			return fmt.Errorf("cannot offload embedded file %s: %v", e.CID, err)
+		}
+		url, sum, err := putBlob(store, e.CID, content, e.ContentType)
+		if err != nil {
+			return fmt.Errorf("cannot offload embedded file %s: %v", e.CID, err)
+		}
+		e.URL, e.Size, e.SHA256 = url, len(content), sum
+		e.Data = ""
+	}
+
+	return nil
+}
+
+// putBlob 以内容哈希为前缀存储，相同内容只保存一份
+func putBlob(store BlobStore, filename string, data []byte, contentType string) (string, string, error) {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	url, err := store.Put(hash+"/"+blobFilename(filename), data, contentType)
+	if err != nil {
+		return "", "", err
+	}
+
+	log.Printf("BLOB: Stored %s (%d bytes, sha256 %s)", filename, len(data), hash[:12])
+	return url, hash, nil
+}
+
+var unsafeBlobChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// blobFilename 生成可安全用于路径和 URL 的文件名
+func blobFilename(name string) string {
+	name = unsafeBlobChars.ReplaceAllString(path.Base(name), "_")
+	name = strings.Trim(name, "._")
+	if name == "" {
+		return "file"
+	}
+	if len(name) > 100 {
+		name = name[len(name)-100:]
+	}
+	return name
+}
+
+// LocalBlobStore 本地目录存储，通过内置 HTTP 服务提供带签名的下载链接
+type LocalBlobStore struct {
+	dir     string
+	baseURL string
+	secret  []byte
+	ttl     time.Duration
+}
+
+// NewLocalBlobStore 创建本地目录存储
+func NewLocalBlobStore(dir, baseURL, secret string, ttl time.Duration) (*LocalBlobStore, error) {
+	if secret == "" {
+		return nil, fmt.Errorf("--blob-secret is required for the local blob store")
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("cannot create blob directory: %v", err)
+	}
+
+	return &LocalBlobStore{
+		dir:     dir,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		secret:  []byte(secret),
+		ttl:     ttl,
+	}, nil
+}
+
+// Put 写入文件并返回签名 URL
+func (s *LocalBlobStore) Put(key string, data []byte, contentType string) (string, error) {
+	p := filepath.Join(s.dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return "", err
+	}
+
+	// 内容寻址，已存在则无需重复写入
+	if _, err := os.Stat(p); os.IsNotExist(err) {
+		tmp := p + ".tmp"
+		if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+			os.Remove(tmp)
+			return "", err
+		}
+		if err := os.Rename(tmp, p); err != nil {
+			os.Remove(tmp)
+			return "", err
+		}
+	}
+
+	expires := strconv.FormatInt(time.Now().Add(s.ttl).Unix(), 10)
+	return fmt.Sprintf("%s/%s?expires=%s&sig=%s", s.baseURL, key, expires, s.sign(key, expires)), nil
+}
+
+func (s *LocalBlobStore) sign(key, expires string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(key + "\n" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ServeHTTP 校验签名和有效期后返回文件
+func (s *LocalBlobStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	key := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	expires := r.URL.Query().Get("expires")
+
+	exp, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		http.Error(w, "link expired", http.StatusForbidden)
+		return
+	}
+
+	if !hmac.Equal([]byte(s.sign(key, expires)), []byte(r.URL.Query().Get("sig"))) {
+		http.Error(w, "invalid signature", http.StatusForbidden)
+		return
+	}
+
+	f, err := os.Open(filepath.Join(s.dir, filepath.FromSlash(key)))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil || stat.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+
+	if ct := mime.TypeByExtension(path.Ext(key)); ct != "" {
+		w.Header().Set("Content-Type", ct)
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(key)}))
+	http.ServeContent(w, r, path.Base(key), stat.ModTime(), f)
+}
+
+// 全局附件存储，未配置 --blob-store 时为 nil
+var blobStore BlobStore
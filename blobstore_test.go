@@ -0,0 +1,140 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestLocalStore 创建本地存储并通过测试服务器提供下载
+func newTestLocalStore(t *testing.T, ttl time.Duration) (*LocalBlobStore, *httptest.Server) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "blobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	var store *LocalBlobStore
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		store.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	store, err = NewLocalBlobStore(dir, srv.URL+"/", "blob-secret", ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, srv
+}
+
+func TestLocalBlobStoreSignedURL(t *testing.T) {
+	store, srv := newTestLocalStore(t, time.Hour)
+	content := []byte("quarterly report")
+
+	link, sum, err := putBlob(store, "report Q1.txt", content, "text/plain")
+	if err != nil {
+		t.Fatalf("putBlob() = %v", err)
+	}
+	if !strings.HasPrefix(link, srv.URL+"/"+sum+"/report_Q1.txt?expires=") {
+		t.Errorf("link = %s", link)
+	}
+
+	resp, err := http.Get(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != string(content) {
+		t.Fatalf("GET signed link: %s %q", resp.Status, body)
+	}
+	if got := resp.Header.Get("Content-Disposition"); got != `attachment; filename=report_Q1.txt` {
+		t.Errorf("Content-Disposition = %s", got)
+	}
+
+	u, _ := url.Parse(link)
+	q := u.Query()
+	expires, _ := strconv.ParseInt(q.Get("expires"), 10, 64)
+	key := strings.TrimPrefix(u.Path, "/")
+
+	tests := []struct {
+		name string
+		link func() string
+		want int
+	}{
+		{"tampered signature", func() string {
+			sig := []byte(q.Get("sig"))
+			sig[0] ^= 1
+			return srv.URL + u.Path + "?expires=" + q.Get("expires") + "&sig=" + string(sig)
+		}, http.StatusForbidden},
+		{"extended expiry", func() string {
+			return srv.URL + u.Path + "?expires=" + strconv.FormatInt(expires+3600, 10) + "&sig=" + q.Get("sig")
+		}, http.StatusForbidden},
+		{"other file with this signature", func() string {
+			return srv.URL + "/" + sum + "/other.txt?" + u.RawQuery
+		}, http.StatusForbidden},
+		{"expired", func() string {
+			past := strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10)
+			return srv.URL + u.Path + "?expires=" + past + "&sig=" + store.sign(key, past)
+		}, http.StatusForbidden},
+		{"missing expiry", func() string {
+			return srv.URL + u.Path + "?sig=" + q.Get("sig")
+		}, http.StatusForbidden},
+		{"signed but missing file", func() string {
+			exp := q.Get("expires")
+			return srv.URL + "/" + sum + "/gone.txt?expires=" + exp + "&sig=" + store.sign(sum+"/gone.txt", exp)
+		}, http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := getStatus(t, tt.link()); got != tt.want {
+				t.Errorf("GET = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLocalBlobStoreRejectsPost(t *testing.T) {
+	store, _ := newTestLocalStore(t, time.Hour)
+
+	rec := httptest.NewRecorder()
+	store.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/x/y", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST = %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestNewLocalBlobStoreRequiresSecret(t *testing.T) {
+	if _, err := NewLocalBlobStore(os.TempDir(), "http://blobs.test", "", time.Hour); err == nil {
+		t.Error("NewLocalBlobStore() without a secret succeeded")
+	}
+}
+
+func TestBlobFilename(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"invoice.pdf", "invoice.pdf"},
+		{"../../etc/passwd", "passwd"},
+		{"Quarterly Report (final).xlsx", "Quarterly_Report_final_.xlsx"},
+		{"报告.pdf", "pdf"},
+		{"...", "file"},
+		{"", "file"},
+		{strings.Repeat("a", 120) + ".txt", strings.Repeat("a", 96) + ".txt"},
+	}
+
+	for _, tt := range tests {
+		if got := blobFilename(tt.name); got != tt.want {
+			t.Errorf("blobFilename(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
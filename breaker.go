@@ -0,0 +1,125 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// 熔断器状态
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+// CircuitBreaker 按 webhook 地址跟踪健康状况：连续失败达到阈值后熔断，
+// 冷却期过后放行一个探测请求，探测成功才恢复
+type CircuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	states    map[string]*breakerState
+}
+
+type breakerState struct {
+	state    string
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// NewCircuitBreaker 创建熔断器
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		states:    make(map[string]*breakerState),
+	}
+}
+
+func (cb *CircuitBreaker) get(key string) *breakerState {
+	st, exists := cb.states[key]
+	if !exists {
+		st = &breakerState{state: breakerClosed}
+		cb.states[key] = st
+	}
+	return st
+}
+
+// Allow 是否允许发送请求；冷却期结束后转为半开，只放行一个探测请求
+func (cb *CircuitBreaker) Allow(key string) bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	st := cb.get(key)
+	switch st.state {
+	case breakerOpen:
+		if time.Since(st.openedAt) < cb.cooldown {
+			return false
+		}
+		st.state = breakerHalfOpen
+		st.probing = true
+		log.Printf("BREAKER: %s half-open, sending probe", key)
+		return true
+	case breakerHalfOpen:
+		if st.probing {
+			return false
+		}
+		st.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+// Blocked 不消耗探测机会地判断请求是否会被拒绝
+func (cb *CircuitBreaker) Blocked(key string) bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	st := cb.get(key)
+	switch st.state {
+	case breakerOpen:
+		return time.Since(st.openedAt) < cb.cooldown
+	case breakerHalfOpen:
+		return st.probing
+	default:
+		return false
+	}
+}
+
+// Success 记录一次成功，恢复为闭合状态
+func (cb *CircuitBreaker) Success(key string) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	st := cb.get(key)
+	if st.state != breakerClosed {
+		log.Printf("BREAKER: %s closed, webhook recovered", key)
+	}
+	st.state = breakerClosed
+	st.failures = 0
+	st.probing = false
+}
+
+// Failure 记录一次失败，达到阈值或探测失败时熔断
+func (cb *CircuitBreaker) Failure(key string) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	st := cb.get(key)
+	st.failures++
+
+	if st.state == breakerHalfOpen || st.failures >= cb.threshold {
+		if st.state != breakerOpen {
+			log.Printf("BREAKER: %s open after %d consecutive failures, pausing for %s", key, st.failures, cb.cooldown)
+		}
+		st.state = breakerOpen
+		st.openedAt = time.Now()
+		st.probing = false
+	}
+}
+
+// 全局熔断器，--breaker-threshold 为 0 时为 nil
+var breaker *CircuitBreaker
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+const testBreakerKey = "http://hook.test/"
+
+// cool 让熔断器的冷却期立即结束，避免测试等待
+func cool(cb *CircuitBreaker, key string) {
+	cb.states[key].openedAt = time.Now().Add(-cb.cooldown)
+}
+
+func TestBreakerOpensAfterThreshold(t *testing.T) {
+	cb := NewCircuitBreaker(3, time.Minute)
+
+	for i := 0; i < 2; i++ {
+		cb.Failure(testBreakerKey)
+		if !cb.Allow(testBreakerKey) {
+			t.Fatalf("blocked after %d failures, threshold is 3", i+1)
+		}
+	}
+
+	cb.Failure(testBreakerKey)
+	if cb.states[testBreakerKey].state != breakerOpen {
+		t.Fatalf("state = %s, want %s", cb.states[testBreakerKey].state, breakerOpen)
+	}
+	if cb.Allow(testBreakerKey) || !cb.Blocked(testBreakerKey) {
+		t.Error("open breaker allowed a request during the cooldown")
+	}
+	if !cb.Allow("http://other.test/") {
+		t.Error("breaker for another URL should stay closed")
+	}
+}
+
+func TestBreakerSuccessResetsFailures(t *testing.T) {
+	cb := NewCircuitBreaker(2, time.Minute)
+
+	cb.Failure(testBreakerKey)
+	cb.Success(testBreakerKey)
+	cb.Failure(testBreakerKey)
+
+	if st := cb.states[testBreakerKey]; st.state != breakerClosed || st.failures != 1 {
+		t.Errorf("state = %s with %d failures, want closed with 1", st.state, st.failures)
+	}
+}
+
+func TestBreakerHalfOpen(t *testing.T) {
+	cb := NewCircuitBreaker(1, time.Minute)
+	cb.Failure(testBreakerKey)
+	cool(cb, testBreakerKey)
+
+	if cb.Blocked(testBreakerKey) {
+		t.Error("Blocked() = true after the cooldown")
+	}
+	if !cb.Allow(testBreakerKey) {
+		t.Fatal("no probe allowed after the cooldown")
+	}
+	if st := cb.states[testBreakerKey].state; st != breakerHalfOpen {
+		t.Fatalf("state = %s, want %s", st, breakerHalfOpen)
+	}
+	if cb.Allow(testBreakerKey) || !cb.Blocked(testBreakerKey) {
+		t.Error("half-open breaker allowed a second request while probing")
+	}
+}
+
+func TestBreakerProbeResult(t *testing.T) {
+	tests := []struct {
+		name    string
+		succeed bool
+		want    string
+		allow   bool
+	}{
+		{"probe succeeds", true, breakerClosed, true},
+		{"probe fails", false, breakerOpen, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cb := NewCircuitBreaker(3, time.Minute)
+			for i := 0; i < 3; i++ {
+				cb.Failure(testBreakerKey)
+			}
+			cool(cb, testBreakerKey)
+			cb.Allow(testBreakerKey)
+
+			if tt.succeed {
+				cb.Success(testBreakerKey)
+			} else {
+				cb.Failure(testBreakerKey)
+			}
+
+			if st := cb.states[testBreakerKey].state; st != tt.want {
+				t.Errorf("state = %s, want %s", st, tt.want)
+			}
+			if got := cb.Allow(testBreakerKey); got != tt.allow {
+				t.Errorf("Allow() = %v, want %v", got, tt.allow)
+			}
+		})
+	}
+}
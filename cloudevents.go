@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// CloudEvents 1.0 的 HTTP 绑定，事件的 data 为 json 格式的邮件
+const (
+	FormatCloudEvents       = "cloudevents"        // structured 模式：事件属性和 data 都在请求体中
+	FormatCloudEventsBinary = "cloudevents-binary" // binary 模式：事件属性在 ce-* 请求头中，请求体为邮件
+
+	// CloudEventType 收到邮件的事件类型，保持不变
+	CloudEventType = "smtp2http.message.received"
+)
+
+// cloudEvent 事件属性
+type cloudEvent struct {
+	SpecVersion     string `json:"specversion"`
+	ID              string `json:"id"`
+	Source          string `json:"source"`
+	Type            string `json:"type"`
+	Subject         string `json:"subject,omitempty"`
+	Time            string `json:"time,omitempty"`
+	DataContentType string `json:"datacontenttype"`
+	DataSchema      string `json:"dataschema"`
+}
+
+// newCloudEvent 生成邮件对应的事件属性。id 使用幂等键，重试和 SMTP 重发时不变，接收方可以按 source + id 去重
+func newCloudEvent(msg *EmailMessage) *cloudEvent {
+	event := &cloudEvent{
+		SpecVersion:     "1.0",
+		ID:              msg.IdempotencyKey,
+		Source:          cloudEventSource(),
+		Type:            CloudEventType,
+		Time:            time.Now().UTC().Format(time.RFC3339),
+		DataContentType: "application/json",
+		DataSchema:      PayloadSchemaID,
+	}
+
+	if event.ID == "" {
+		b := make([]byte, 16)
+		rand.Read(b)
+		event.ID = hex.EncodeToString(b)
+	}
+	if msg.Session != nil && msg.Session.ReceivedAt != "" {
+		event.Time = msg.Session.ReceivedAt
+	}
+	if msg.Addresses.To != nil {
+		event.Subject = msg.Addresses.To.Address
+	}
+
+	return event
+}
+
+// cloudEventSource --cloudevents-source，未设置时由 --name 生成
+func cloudEventSource() string {
+	if *flagCloudEventsSource != "" {
+		return *flagCloudEventsSource
+	}
+	return "urn:smtp2http:" + *flagServerName
+}
+
+// headers binary 模式的 ce-* 请求头，datacontenttype 对应 Content-Type
+func (e *cloudEvent) headers() map[string]string {
+	h := map[string]string{
+		"ce-specversion": e.SpecVersion,
+		"ce-id":          e.ID,
+		"ce-source":      e.Source,
+		"ce-type":        e.Type,
+		"ce-time":        e.Time,
+		"ce-dataschema":  e.DataSchema,
+	}
+	if e.Subject != "" {
+		h["ce-subject"] = e.Subject
+	}
+	return h
+}
+
+// writeCloudEvent 写出 structured 模式的事件，data 与 json 格式的请求体相同，同样流式编码
+func writeCloudEvent(w io.Writer, event *cloudEvent, msg *EmailMessage) error {
+	attrs, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.Write(attrs[:len(attrs)-1]); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, `,"data":`); err != nil {
+		return err
+	}
+	if err := writeMessageJSON(w, msg); err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "}")
+	return err
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func cloudEventMessage() *EmailMessage {
+	msg := streamTestMessage()
+	msg.IdempotencyKey = "idem-123"
+	msg.Session = &EmailSession{ReceivedAt: "2024-03-01T08:00:00Z"}
+	msg.Addresses.To = &EmailAddress{Address: "inbox@example.test"}
+	return msg
+}
+
+// sendCloudEvent 按 format 投递到测试服务器，返回收到的请求头和请求体
+func sendCloudEvent(t *testing.T, format string, msg *EmailMessage) (http.Header, []byte) {
+	t.Helper()
+	var header http.Header
+	var body []byte
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		body, _ = ioutil.ReadAll(r.Body)
+		w.Write([]byte(`{"action":"accept"}`))
+	}))
+	defer hook.Close()
+
+	if err := deliverTarget(&WebhookTarget{URL: hook.URL, Format: format}, msg); err != nil {
+		t.Fatalf("deliverTarget() = %v", err)
+	}
+	return header, body
+}
+
+func TestCloudEventsStructured(t *testing.T) {
+	setFlag(t, flagServerName, "mx1")
+	setFlag(t, flagCloudEventsSource, "")
+	msg := cloudEventMessage()
+
+	header, body := sendCloudEvent(t, FormatCloudEvents, msg)
+	if got := header.Get("Content-Type"); got != "application/cloudevents+json" {
+		t.Errorf("Content-Type = %q, want application/cloudevents+json", got)
+	}
+
+	var event map[string]interface{}
+	if err := json.Unmarshal(body, &event); err != nil {
+		t.Fatalf("event is not JSON: %v", err)
+	}
+
+	want := map[string]string{
+		"specversion":     "1.0",
+		"id":              "idem-123",
+		"source":          "urn:smtp2http:mx1",
+		"type":            CloudEventType,
+		"subject":         "inbox@example.test",
+		"time":            "2024-03-01T08:00:00Z",
+		"datacontenttype": "application/json",
+		"dataschema":      PayloadSchemaID,
+	}
+	for name, value := range want {
+		if event[name] != value {
+			t.Errorf("%s = %v, want %q", name, event[name], value)
+		}
+	}
+
+	var data, marshaled interface{}
+	raw, _ := json.Marshal(event["data"])
+	json.Unmarshal(raw, &data)
+	m, _ := json.Marshal(msg)
+	json.Unmarshal(m, &marshaled)
+	if !reflect.DeepEqual(data, marshaled) {
+		t.Error("data differs from the json payload")
+	}
+}
+
+func TestCloudEventsBinary(t *testing.T) {
+	setFlag(t, flagCloudEventsSource, "https://mail.example.test/smtp2http")
+	msg := cloudEventMessage()
+
+	header, body := sendCloudEvent(t, FormatCloudEventsBinary, msg)
+
+	want := map[string]string{
+		"Content-Type":   "application/json", // datacontenttype
+		"Ce-Specversion": "1.0",
+		"Ce-Id":          "idem-123",
+		"Ce-Source":      "https://mail.example.test/smtp2http",
+		"Ce-Type":        CloudEventType,
+		"Ce-Subject":     "inbox@example.test",
+		"Ce-Time":        "2024-03-01T08:00:00Z",
+		"Ce-Dataschema":  PayloadSchemaID,
+	}
+	for name, value := range want {
+		if got := header.Get(name); got != value {
+			t.Errorf("%s = %q, want %q", name, got, value)
+		}
+	}
+	if got := header.Get("Ce-Datacontenttype"); got != "" {
+		t.Errorf("binary mode sent ce-datacontenttype %q, it belongs in Content-Type", got)
+	}
+
+	var payload bytes.Buffer
+	writeMessageJSON(&payload, msg)
+	if !bytes.Equal(body, payload.Bytes()) {
+		t.Error("binary mode body differs from the json payload")
+	}
+}
+
+func TestNewCloudEventDefaults(t *testing.T) {
+	before := time.Now().UTC().Add(-time.Second)
+
+	first := newCloudEvent(&EmailMessage{})
+	second := newCloudEvent(&EmailMessage{})
+
+	if !regexp.MustCompile(`^[0-9a-f]{32}$`).MatchString(first.ID) || first.ID == second.ID {
+		t.Errorf("ids %q, %q, want distinct random ids without an idempotency key", first.ID, second.ID)
+	}
+	if ts, err := time.Parse(time.RFC3339, first.Time); err != nil || ts.Before(before.Truncate(time.Second)) {
+		t.Errorf("time = %q, want the current time", first.Time)
+	}
+	if first.Subject != "" {
+		t.Errorf("subject = %q without a recipient", first.Subject)
+	}
+	if _, ok := first.headers()["ce-subject"]; ok {
+		t.Error("ce-subject sent without a recipient")
+	}
+	for name, value := range map[string]string{"specversion": first.SpecVersion, "id": first.ID, "source": first.Source, "type": first.Type} {
+		if value == "" {
+			t.Errorf("required attribute %s is empty", name)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// webhook 请求体压缩方式，对应 Content-Encoding
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+// 压缩器在请求之间复用，zstd 窗口限制在 256 KiB 以控制每个请求的内存
+var (
+	gzipWriters = sync.Pool{New: func() interface{} {
+		return gzip.NewWriter(nil)
+	}}
+	zstdEncoders = sync.Pool{New: func() interface{} {
+		enc, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1), zstd.WithWindowSize(256*1024))
+		return enc
+	}}
+)
+
+// identityOnly 返回过 415 的 webhook，之后不再压缩
+var identityOnly sync.Map
+
+// requestEncoding 决定本次请求的压缩方式，为空表示不压缩
+func requestEncoding(target *WebhookTarget, size int64) string {
+	if target.Compression == "" || target.Compression == CompressionNone {
+		return ""
+	}
+	if size < *flagCompressionMinSize {
+		return ""
+	}
+	if _, refused := identityOnly.Load(target.URL); refused {
+		return ""
+	}
+	return target.Compression
+}
+
+// compressWriter 返回按 Content-Encoding 压缩后写入 w 的 writer，Close 时写出压缩尾部，
+// 压缩器在 Close 后归还；encoding 为空时原样写入
+func compressWriter(encoding string, w io.Writer) (io.WriteCloser, error) {
+	switch encoding {
+	case "":
+		return nopWriteCloser{w}, nil
+	case CompressionGzip:
+		gw := gzipWriters.Get().(*gzip.Writer)
+		gw.Reset(w)
+		return &pooledWriter{WriteCloser: gw, pool: &gzipWriters}, nil
+	case CompressionZstd:
+		enc := zstdEncoders.Get().(*zstd.Encoder)
+		enc.Reset(w)
+		return &pooledWriter{WriteCloser: enc, pool: &zstdEncoders}, nil
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", encoding)
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// pooledWriter Close 后将压缩器放回池中
+type pooledWriter struct {
+	io.WriteCloser
+	pool *sync.Pool
+}
+
+func (p *pooledWriter) Close() error {
+	err := p.WriteCloser.Close()
+	p.pool.Put(p.WriteCloser)
+	return err
+}
+
+// validCompression 检查参数值
+func validCompression(value string) bool {
+	switch value {
+	case CompressionNone, CompressionGzip, CompressionZstd:
+		return true
+	}
+	return false
+}
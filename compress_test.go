@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// setMinSize 在测试期间修改 --webhook-compression-min-size
+func setMinSize(t *testing.T, size int64) {
+	t.Helper()
+	old := *flagCompressionMinSize
+	*flagCompressionMinSize = size
+	t.Cleanup(func() { *flagCompressionMinSize = old })
+}
+
+func TestRequestEncoding(t *testing.T) {
+	setMinSize(t, 1024)
+	identityOnly.Store("https://plain.test/in", true)
+	t.Cleanup(func() { identityOnly.Delete("https://plain.test/in") })
+
+	tests := []struct {
+		compression string
+		url         string
+		size        int64
+		want        string
+	}{
+		{"", "https://hook.test/in", 4096, ""},
+		{CompressionNone, "https://hook.test/in", 4096, ""},
+		{CompressionGzip, "https://hook.test/in", 4096, CompressionGzip},
+		{CompressionZstd, "https://hook.test/in", 1024, CompressionZstd},
+		{CompressionGzip, "https://hook.test/in", 1023, ""},
+		{CompressionZstd, "https://plain.test/in", 4096, ""},
+	}
+
+	for _, tt := range tests {
+		target := &WebhookTarget{URL: tt.url, Compression: tt.compression}
+		if got := requestEncoding(target, tt.size); got != tt.want {
+			t.Errorf("requestEncoding(%s, %s, %d) = %q, want %q", tt.compression, tt.url, tt.size, got, tt.want)
+		}
+	}
+}
+
+func TestCompressWriter(t *testing.T) {
+	data := bytes.Repeat([]byte(`{"subject":"压缩测试","body":"hello"}`), 2000)
+
+	for _, encoding := range []string{"", CompressionGzip, CompressionZstd} {
+		t.Run("encoding="+encoding, func(t *testing.T) {
+			// 压缩器来自池，连续两次的输出必须相同，发送前的空跑依赖这一点
+			outputs := [2]bytes.Buffer{}
+			for i := range outputs {
+				w, err := compressWriter(encoding, &outputs[i])
+				if err != nil {
+					t.Fatal(err)
+				}
+				w.Write(data[:100])
+				w.Write(data[100:])
+				if err := w.Close(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !bytes.Equal(outputs[0].Bytes(), outputs[1].Bytes()) {
+				t.Error("two compressions of the same data differ")
+			}
+			if encoding != "" && outputs[0].Len() >= len(data)/10 {
+				t.Errorf("compressed %d bytes to %d", len(data), outputs[0].Len())
+			}
+
+			got, err := decompress(encoding, outputs[0].Bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Error("decompressed body differs from the input")
+			}
+		})
+	}
+
+	if _, err := compressWriter("br", ioutil.Discard); err == nil {
+		t.Error("compressWriter(br) succeeded")
+	}
+}
+
+func TestExchangeWebhookUncompressedFallback(t *testing.T) {
+	setMinSize(t, 0)
+
+	var mu sync.Mutex
+	encodings := []string{}
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding := r.Header.Get("Content-Encoding")
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		encodings = append(encodings, encoding)
+		mu.Unlock()
+
+		if encoding != "" {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		if !strings.HasPrefix(string(body), `{"schema_version"`) {
+			http.Error(w, "unexpected body", http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, `{"action":"accept"}`)
+	}))
+	defer hook.Close()
+	t.Cleanup(func() { identityOnly.Delete(hook.URL) })
+
+	target := &WebhookTarget{URL: hook.URL, Format: FormatJSON, Compression: CompressionZstd}
+	payload, _ := encodePayload(target, &EmailMessage{SchemaVersion: PayloadSchemaVersion, Subject: "fallback"})
+
+	for _, want := range []string{"zstd,", ""} {
+		mu.Lock()
+		encodings = encodings[:0]
+		mu.Unlock()
+
+		resp, err := exchangeWebhook(target, payload)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("exchangeWebhook() = %+v, %v, want 200", resp, err)
+		}
+		if got := strings.Join(encodings, ","); got != want {
+			t.Errorf("Content-Encoding of the requests = %q, want %q", got, want)
+		}
+	}
+
+	if _, ok := identityOnly.Load(hook.URL); !ok {
+		t.Error("webhook answering 415 was not remembered")
+	}
+}
+
+func TestExchangeWebhookCompressed(t *testing.T) {
+	setMinSize(t, 0)
+
+	for _, encoding := range []string{CompressionGzip, CompressionZstd} {
+		t.Run(encoding, func(t *testing.T) {
+			var received []byte
+			hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := ioutil.ReadAll(r.Body)
+				received, _ = decompress(r.Header.Get("Content-Encoding"), body)
+				fmt.Fprint(w, `{"action":"accept"}`)
+			}))
+			defer hook.Close()
+
+			target := &WebhookTarget{URL: hook.URL, Format: FormatJSON, Compression: encoding}
+			msg := streamTestMessage()
+			payload, _ := encodePayload(target, msg)
+			if _, err := exchangeWebhook(target, payload); err != nil {
+				t.Fatal(err)
+			}
+
+			var want bytes.Buffer
+			writeMessageJSON(&want, msg)
+			if !bytes.Equal(received, want.Bytes()) {
+				t.Errorf("webhook decoded %d bytes, want the %d byte message", len(received), want.Len())
+			}
+		})
+	}
+}
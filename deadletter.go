@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 邮件进入死信的原因
+const (
+	DeadReasonRejected = "rejected" // webhook 永久拒绝
+	DeadReasonExpired  = "expired"  // 超过 --spool-max-age 仍未投递成功
+)
+
+// DeadLetter 无法投递的邮件及其失败历史
+type DeadLetter struct {
+	SpoolEntry
+	Reason string    `json:"reason"`
+	DeadAt time.Time `json:"dead_at"`
+}
+
+// Recipients 死信的收件人：多收件人分组的收件人在 Recipients 中，旧的死信只有 Addresses.To
+func (d *DeadLetter) Recipients() []string {
+	if d.Message == nil {
+		return nil
+	}
+	if len(d.Message.Recipients) > 0 {
+		return d.Message.Recipients
+	}
+	if d.Message.Addresses.To != nil {
+		return []string{d.Message.Addresses.To.Address}
+	}
+	return nil
+}
+
+// Domains 收件人域名，用于筛选
+func (d *DeadLetter) Domains() []string {
+	domains := []string{}
+	for _, rcpt := range d.Recipients() {
+		if domain := strings.ToLower(strings.TrimSpace(rcptDomain(rcpt))); domain != "" {
+			domains = append(domains, domain)
+		}
+	}
+	return domains
+}
+
+// DeadLetterStore 死信目录
+type DeadLetterStore struct {
+	dir string
+}
+
+// NewDeadLetterStore 创建死信目录
+func NewDeadLetterStore(dir string) (*DeadLetterStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("cannot create dead-letter directory: %v", err)
+	}
+	return &DeadLetterStore{dir: dir}, nil
+}
+
+func (s *DeadLetterStore) path(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+// Add 写入死信，ID 沿用队列中的 ID
+func (s *DeadLetterStore) Add(entry *SpoolEntry, reason string) error {
+	return s.Save(&DeadLetter{SpoolEntry: *entry, Reason: reason, DeadAt: time.Now()})
+}
+
+// Save 原子写入死信
+func (s *DeadLetterStore) Save(d *DeadLetter) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return fmt.Errorf("cannot encode dead letter: %v", err)
+	}
+
+	tmp := s.path(d.ID) + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("cannot write dead letter: %v", err)
+	}
+
+	if err := os.Rename(tmp, s.path(d.ID)); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("cannot commit dead letter: %v", err)
+	}
+
+	return nil
+}
+
+// Load 读取单个死信
+func (s *DeadLetterStore) Load(id string) (*DeadLetter, error) {
+	data, err := ioutil.ReadFile(s.path(id))
+	if err != nil {
+		return nil, err
+	}
+
+	d := &DeadLetter{}
+	if err := json.Unmarshal(data, d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// List 按 ID（即接收时间）顺序列出所有死信
+func (s *DeadLetterStore) List() ([]*DeadLetter, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []string{}
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), ".json") {
+			ids = append(ids, strings.TrimSuffix(f.Name(), ".json"))
+		}
+	}
+	sort.Strings(ids)
+
+	letters := []*DeadLetter{}
+	for _, id := range ids {
+		d, err := s.Load(id)
+		if err != nil {
+			log.Printf("DEADLETTER: Skipping unreadable entry %s: %v", id, err)
+			continue
+		}
+		letters = append(letters, d)
+	}
+
+	return letters, nil
+}
+
+// Remove 删除死信
+func (s *DeadLetterStore) Remove(id string) error {
+	if err := os.Remove(s.path(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// 全局死信目录，未配置 --dead-letter-dir 时为 nil
+var deadLetters *DeadLetterStore
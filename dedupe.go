@@ -0,0 +1,120 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HeaderIdempotencyKey 请求头，同一封邮件的重试和 SMTP 重发都使用相同的值
+const HeaderIdempotencyKey = "Idempotency-Key"
+
+// idempotencyKey 由 Message-ID、信封发件人和收件人以及内容哈希得出，SMTP 客户端超时后重发同一封邮件时保持不变
+func idempotencyKey(msg *EmailMessage, mailFrom, rcptTo string) string {
+	body := sha256.New()
+	io.WriteString(body, msg.Body.Text)
+	body.Write([]byte{0})
+	io.WriteString(body, msg.Body.HTML)
+	for _, a := range msg.Attachments {
+		body.Write([]byte{0})
+		io.WriteString(body, a.Filename)
+		body.Write([]byte{0})
+		io.Copy(body, a.File().Reader())
+	}
+	for _, e := range msg.EmbeddedFiles {
+		body.Write([]byte{0})
+		io.WriteString(body, e.CID)
+		body.Write([]byte{0})
+		io.Copy(body, e.File().Reader())
+	}
+
+	h := sha256.New()
+	for _, part := range []string{
+		strings.Trim(msg.ID, "<> "),
+		strings.ToLower(mailFrom),
+		strings.ToLower(rcptTo),
+		hex.EncodeToString(body.Sum(nil)),
+	} {
+		io.WriteString(h, part)
+		h.Write([]byte{'\n'})
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// DedupeCache 记录窗口期内已接受的邮件，容量有限，满时淘汰最早的记录
+type DedupeCache struct {
+	mu      sync.Mutex
+	window  time.Duration
+	max     int
+	entries map[string]*list.Element
+	order   *list.List // 按记录时间排序，最早的在前
+}
+
+type dedupeEntry struct {
+	key string
+	at  time.Time
+}
+
+// NewDedupeCache 创建去重缓存
+func NewDedupeCache(window time.Duration, max int) *DedupeCache {
+	if max < 1 {
+		max = 1
+	}
+	return &DedupeCache{
+		window:  window,
+		max:     max,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// Seen 窗口期内是否已经接受过该邮件
+func (c *DedupeCache) Seen(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.expire(time.Now())
+	_, exists := c.entries[key]
+	return exists
+}
+
+// Add 记录已接受的邮件
+func (c *DedupeCache) Add(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	c.expire(now)
+
+	if e, exists := c.entries[key]; exists {
+		c.order.Remove(e)
+	}
+	c.entries[key] = c.order.PushBack(&dedupeEntry{key: key, at: now})
+
+	for c.order.Len() > c.max {
+		c.remove(c.order.Front())
+	}
+}
+
+// expire 删除超出窗口期的记录
+func (c *DedupeCache) expire(now time.Time) {
+	for e := c.order.Front(); e != nil; e = c.order.Front() {
+		if now.Sub(e.Value.(*dedupeEntry).at) < c.window {
+			return
+		}
+		c.remove(e)
+	}
+}
+
+func (c *DedupeCache) remove(e *list.Element) {
+	c.order.Remove(e)
+	delete(c.entries, e.Value.(*dedupeEntry).key)
+}
+
+// 全局去重缓存，--dedupe-window 为 0 时为 nil
+var dedupeCache *DedupeCache
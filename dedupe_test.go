@@ -0,0 +1,93 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// age 把缓存中的记录往前推 d，模拟时间流逝
+func age(c *DedupeCache, key string, d time.Duration) {
+	c.entries[key].Value.(*dedupeEntry).at = time.Now().Add(-d)
+}
+
+func TestDedupeWindow(t *testing.T) {
+	c := NewDedupeCache(time.Minute, 10)
+
+	if c.Seen("a") {
+		t.Fatal("Seen() = true before Add")
+	}
+	c.Add("a")
+	if !c.Seen("a") {
+		t.Fatal("Seen() = false right after Add")
+	}
+
+	age(c, "a", 59*time.Second)
+	if !c.Seen("a") {
+		t.Error("entry expired inside the window")
+	}
+
+	age(c, "a", time.Minute)
+	if c.Seen("a") {
+		t.Error("entry still seen after the window")
+	}
+	if len(c.entries) != 0 || c.order.Len() != 0 {
+		t.Errorf("expired entry not removed: %d entries, %d in order", len(c.entries), c.order.Len())
+	}
+}
+
+func TestDedupeAddRefreshes(t *testing.T) {
+	c := NewDedupeCache(time.Minute, 10)
+
+	c.Add("a")
+	c.Add("b")
+	age(c, "a", 50*time.Second)
+	age(c, "b", 40*time.Second)
+
+	// 重新记录的邮件从现在开始计算窗口，并排到最后
+	c.Add("a")
+	age(c, "b", time.Minute)
+
+	if !c.Seen("a") {
+		t.Error("re-added entry expired with its old timestamp")
+	}
+	if c.Seen("b") {
+		t.Error("entry still seen after the window")
+	}
+}
+
+func TestDedupeCapacity(t *testing.T) {
+	c := NewDedupeCache(time.Minute, 2)
+
+	c.Add("a")
+	c.Add("b")
+	c.Add("c")
+
+	if c.Seen("a") {
+		t.Error("oldest entry not evicted when full")
+	}
+	if !c.Seen("b") || !c.Seen("c") {
+		t.Error("newer entries evicted")
+	}
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	msg := &EmailMessage{ID: "<m1@sender.test>"}
+	msg.Body.Text = "hello"
+	key := idempotencyKey(msg, "a@sender.test", "b@rcpt.test")
+
+	if got := idempotencyKey(msg, "A@Sender.test", "B@rcpt.test"); got != key {
+		t.Error("key depends on address case")
+	}
+	if got := idempotencyKey(&EmailMessage{ID: "m1@sender.test", Body: msg.Body}, "a@sender.test", "b@rcpt.test"); got != key {
+		t.Error("key depends on Message-ID brackets")
+	}
+	if got := idempotencyKey(msg, "a@sender.test", "c@rcpt.test"); got == key {
+		t.Error("different recipients share a key")
+	}
+
+	changed := &EmailMessage{ID: msg.ID}
+	changed.Body.Text = "hello!"
+	if got := idempotencyKey(changed, "a@sender.test", "b@rcpt.test"); got == key {
+		t.Error("different bodies share a key")
+	}
+}
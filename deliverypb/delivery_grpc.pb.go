@@ -0,0 +1,139 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+
+package deliverypb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// DeliveryClient is the client API for Delivery service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type DeliveryClient interface {
+	// Deliver 投递一封邮件：第一条请求携带 message，之后按顺序发送原始邮件、附件和内嵌文件的内容分块，
+	// 接收方在客户端关闭发送后返回结论
+	Deliver(ctx context.Context, opts ...grpc.CallOption) (Delivery_DeliverClient, error)
+}
+
+type deliveryClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewDeliveryClient(cc grpc.ClientConnInterface) DeliveryClient {
+	return &deliveryClient{cc}
+}
+
+func (c *deliveryClient) Deliver(ctx context.Context, opts ...grpc.CallOption) (Delivery_DeliverClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Delivery_ServiceDesc.Streams[0], "/smtp2http.v1.Delivery/Deliver", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &deliveryDeliverClient{stream}
+	return x, nil
+}
+
+type Delivery_DeliverClient interface {
+	Send(*DeliverRequest) error
+	CloseAndRecv() (*DeliverResponse, error)
+	grpc.ClientStream
+}
+
+type deliveryDeliverClient struct {
+	grpc.ClientStream
+}
+
+func (x *deliveryDeliverClient) Send(m *DeliverRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *deliveryDeliverClient) CloseAndRecv() (*DeliverResponse, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(DeliverResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// DeliveryServer is the server API for Delivery service.
+// All implementations must embed UnimplementedDeliveryServer
+// for forward compatibility
+type DeliveryServer interface {
+	// Deliver 投递一封邮件：第一条请求携带 message，之后按顺序发送原始邮件、附件和内嵌文件的内容分块，
+	// 接收方在客户端关闭发送后返回结论
+	Deliver(Delivery_DeliverServer) error
+	mustEmbedUnimplementedDeliveryServer()
+}
+
+// UnimplementedDeliveryServer must be embedded to have forward compatible implementations.
+type UnimplementedDeliveryServer struct {
+}
+
+func (UnimplementedDeliveryServer) Deliver(Delivery_DeliverServer) error {
+	return status.Errorf(codes.Unimplemented, "method Deliver not implemented")
+}
+func (UnimplementedDeliveryServer) mustEmbedUnimplementedDeliveryServer() {}
+
+// UnsafeDeliveryServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to DeliveryServer will
+// result in compilation errors.
+type UnsafeDeliveryServer interface {
+	mustEmbedUnimplementedDeliveryServer()
+}
+
+func RegisterDeliveryServer(s grpc.ServiceRegistrar, srv DeliveryServer) {
+	s.RegisterService(&Delivery_ServiceDesc, srv)
+}
+
+func _Delivery_Deliver_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(DeliveryServer).Deliver(&deliveryDeliverServer{stream})
+}
+
+type Delivery_DeliverServer interface {
+	SendAndClose(*DeliverResponse) error
+	Recv() (*DeliverRequest, error)
+	grpc.ServerStream
+}
+
+type deliveryDeliverServer struct {
+	grpc.ServerStream
+}
+
+func (x *deliveryDeliverServer) SendAndClose(m *DeliverResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *deliveryDeliverServer) Recv() (*DeliverRequest, error) {
+	m := new(DeliverRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Delivery_ServiceDesc is the grpc.ServiceDesc for Delivery service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Delivery_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "smtp2http.v1.Delivery",
+	HandlerType: (*DeliveryServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Deliver",
+			Handler:       _Delivery_Deliver_Handler,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "delivery.proto",
+}
@@ -0,0 +1,4 @@
+// Package deliverypb gRPC 投递协议，由 delivery.proto 生成
+package deliverypb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative delivery.proto
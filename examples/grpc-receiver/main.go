@@ -0,0 +1,130 @@
+// grpc-receiver 是 deliverypb.Delivery 服务的参考实现：接收邮件和附件内容，打印后返回结论
+//
+//	go run ./examples/grpc-receiver --listen=:9090
+//	smtp2http --webhook=grpc://127.0.0.1:9090
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"net"
+
+	"github.com/alash3al/smtp2http/deliverypb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	flagListen     = flag.String("listen", ":9090", "the gRPC address to listen on")
+	flagInboundKey = flag.String("inbound-key", "", "require this x-inbound-key metadata value (empty = no check)")
+)
+
+type receiver struct {
+	deliverypb.UnimplementedDeliveryServer
+}
+
+// Deliver 先读取邮件，再按下标拼接附件和内嵌文件的分块
+func (r *receiver) Deliver(stream deliverypb.Delivery_DeliverServer) error {
+	if *flagInboundKey != "" {
+		md, _ := metadata.FromIncomingContext(stream.Context())
+		if keys := md.Get("x-inbound-key"); len(keys) == 0 || keys[0] != *flagInboundKey {
+			return status.Error(codes.Unauthenticated, "invalid inbound key")
+		}
+	}
+
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+
+	msg := first.GetMessage()
+	if msg == nil {
+		return status.Error(codes.InvalidArgument, "the first request must carry the message")
+	}
+
+	attachments := make([][]byte, len(msg.Attachments))
+	embedded := make([][]byte, len(msg.EmbeddedFiles))
+	raw := make([][]byte, 1)
+
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		chunk := req.GetChunk()
+		if chunk == nil {
+			return status.Error(codes.InvalidArgument, "expected a file chunk")
+		}
+
+		var files [][]byte
+		switch chunk.Kind {
+		case deliverypb.FileChunk_KIND_ATTACHMENT:
+			files = attachments
+		case deliverypb.FileChunk_KIND_EMBEDDED:
+			files = embedded
+		case deliverypb.FileChunk_KIND_RAW:
+			files = raw
+		default:
+			return status.Errorf(codes.InvalidArgument, "unknown file chunk kind %v", chunk.Kind)
+		}
+		if int(chunk.Index) >= len(files) {
+			return status.Errorf(codes.InvalidArgument, "file index %d out of range", chunk.Index)
+		}
+		files[chunk.Index] = append(files[chunk.Index], chunk.Data...)
+	}
+
+	log.Printf("Received %q from %s to %s (spf: %s, score: %d)",
+		msg.Subject, msg.Addresses.GetFrom().GetAddress(), msg.Addresses.GetTo().GetAddress(), msg.Spf, msg.SecurityScore)
+	if r := msg.Raw; r != nil {
+		switch {
+		case r.Url != "":
+			log.Printf("  raw message (%d bytes, sha256 %s) at %s", r.Size, r.Sha256, r.Url)
+		case r.Omitted:
+			log.Printf("  raw message (%d bytes, sha256 %s) omitted", r.Size, r.Sha256)
+		default:
+			log.Printf("  raw message (%d bytes received)", len(raw[0]))
+		}
+	}
+	for i, a := range msg.Attachments {
+		if a.Url != "" {
+			log.Printf("  attachment %s (%s, %d bytes) at %s", a.Filename, a.ContentType, a.Size, a.Url)
+			continue
+		}
+		log.Printf("  attachment %s (%s, %d bytes received)", a.Filename, a.ContentType, len(attachments[i]))
+	}
+	for i, e := range msg.EmbeddedFiles {
+		log.Printf("  embedded %s (%s, %d bytes received)", e.Cid, e.ContentType, len(embedded[i]))
+	}
+
+	// 在这里处理邮件；返回 ACTION_TEMPFAIL 让发送方稍后重试，ACTION_REJECT 退信，例如：
+	//
+	//	return stream.SendAndClose(&deliverypb.DeliverResponse{
+	//		Action:       deliverypb.DeliverResponse_ACTION_REJECT,
+	//		SmtpCode:     550,
+	//		EnhancedCode: "5.1.1",
+	//		Message:      "No such user",
+	//	})
+	return stream.SendAndClose(&deliverypb.DeliverResponse{Action: deliverypb.DeliverResponse_ACTION_ACCEPT})
+}
+
+func main() {
+	flag.Parse()
+
+	lis, err := net.Listen("tcp", *flagListen)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	server := grpc.NewServer()
+	deliverypb.RegisterDeliveryServer(server, &receiver{})
+
+	log.Printf("Delivery service listening on %s", *flagListen)
+	log.Fatal(server.Serve(lis))
+}
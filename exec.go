@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 命令退出码与投递结论的对应关系，沿用 sysexits.h 的约定
+const (
+	exitTempFail = 75 // EX_TEMPFAIL
+	exitUsage    = 64 // EX_USAGE，64-78 中除 75 以外均视为永久拒绝
+	exitConfig   = 78 // EX_CONFIG
+)
+
+// ExecSink 每封邮件运行一次本地命令：
+// 邮件 JSON（或 stdin=raw 时的 RFC 822 原文）写入标准输入，信封信息通过环境变量传递
+type ExecSink struct {
+	path  string
+	args  []string
+	raw   bool
+	slots chan struct{}
+}
+
+// NewExecSink 解析 exec:///path/to/command?arg=...&stdin=json|raw
+func NewExecSink(u *url.URL) (Sink, error) {
+	s := &ExecSink{
+		path:  u.Path,
+		args:  u.Query()["arg"],
+		raw:   u.Query().Get("stdin") == "raw",
+		slots: make(chan struct{}, max(1, *flagExecConcurrency)),
+	}
+
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot use exec sink: %v", err)
+	}
+	if info.IsDir() || info.Mode()&0111 == 0 {
+		return nil, fmt.Errorf("cannot use exec sink: %s is not executable", s.path)
+	}
+
+	return s, nil
+}
+
+func (s *ExecSink) Deliver(target *WebhookTarget, msg *EmailMessage) error {
+	var stdin []byte
+	var err error
+	if s.raw {
+		stdin, err = rfc822Source(msg)
+	} else {
+		stdin, err = encodeLine(msg)
+	}
+	if err != nil {
+		return &DeliveryError{Code: "E1", Permanent: true, Err: fmt.Errorf("cannot encode message: %v", err)}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *flagExecTimeout)
+	defer cancel()
+
+	// 限制同时运行的命令数，等待空位的时间也计入超时
+	select {
+	case s.slots <- struct{}{}:
+		defer func() { <-s.slots }()
+	case <-ctx.Done():
+		return &DeliveryError{Code: "E7", Err: fmt.Errorf("timed out waiting for a free %s slot", s.path)}
+	}
+
+	stdout, stderr := &limitedBuffer{max: 64 * 1024}, &limitedBuffer{max: 64 * 1024}
+
+	cmd := exec.Command(s.path, s.args...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	cmd.Env = append(os.Environ(), execEnv(msg)...)
+	setProcessGroup(cmd)
+
+	log.Printf("EXEC: Running %s", s.path)
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		return &DeliveryError{Code: "E7", Err: fmt.Errorf("cannot start %s: %v", s.path, err)}
+	}
+
+	// 超时时结束整个进程组，否则仍持有输出管道的子进程会让 Wait 一直等待
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			killProcessGroup(cmd)
+		case <-done:
+		}
+	}()
+	err = cmd.Wait()
+	close(done)
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return &DeliveryError{Code: "E7", Err: fmt.Errorf("%s timed out after %s", s.path, *flagExecTimeout)}
+	}
+
+	code := 0
+	if err != nil {
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok || exitErr.ExitCode() < 0 {
+			// 无法启动或被信号终止
+			return &DeliveryError{Code: "E7", Err: fmt.Errorf("%s failed: %v", s.path, err)}
+		}
+		code = exitErr.ExitCode()
+	}
+
+	log.Printf("EXEC: %s exited with status %d in %s", s.path, code, time.Since(start).Round(time.Millisecond))
+	if stderr.Len() > 0 {
+		log.Printf("EXEC: %s stderr: %s", s.path, strings.TrimSpace(stderr.String()))
+	}
+
+	// 标准输出的第一行作为返回给发送方的说明
+	verdict := &WebhookVerdict{Message: firstLine(stdout.String())}
+	switch {
+	case code == 0:
+		return nil
+	case code == exitTempFail:
+		verdict.Action = VerdictTempFail
+	case code >= exitUsage && code <= exitConfig:
+		verdict.Action = VerdictReject
+	default:
+		// 脚本自身出错不应导致退信
+		return &DeliveryError{Code: "E7", Err: fmt.Errorf("%s exited with status %d", s.path, code)}
+	}
+	verdict.normalize()
+
+	log.Printf("EXEC: Verdict: %s", verdict.describe())
+	return &DeliveryError{
+		Permanent: verdict.Action == VerdictReject,
+		Verdict:   verdict,
+		Err:       fmt.Errorf("%s exited with status %d: %s", s.path, code, verdict.Message),
+	}
+}
+
+// execEnv 传递给命令的信封信息
+func execEnv(msg *EmailMessage) []string {
+	env := []string{
+		"SMTP2HTTP_MESSAGE_ID=" + msg.ID,
+		"SMTP2HTTP_IDEMPOTENCY_KEY=" + msg.IdempotencyKey,
+		"SMTP2HTTP_SUBJECT=" + msg.Subject,
+		"SMTP2HTTP_SPF=" + msg.SPFResult,
+		"SMTP2HTTP_SPAM_SCORE=" + strconv.Itoa(msg.SecurityScore),
+		"SMTP2HTTP_ATTACHMENTS=" + strconv.Itoa(len(msg.Attachments)),
+	}
+	if msg.Addresses.From != nil {
+		env = append(env, "SMTP2HTTP_FROM="+msg.Addresses.From.Address)
+	}
+	if msg.Addresses.To != nil {
+		env = append(env, "SMTP2HTTP_TO="+msg.Addresses.To.Address)
+	}
+	rcptTo := msg.Recipients
+	if msg.Envelope != nil {
+		env = append(env, "SMTP2HTTP_MAIL_FROM="+msg.Envelope.MailFrom)
+		rcptTo = msg.Envelope.RcptTo
+	}
+	env = append(env, "SMTP2HTTP_RCPT_TO="+strings.Join(rcptTo, ","))
+	if msg.Security != nil {
+		env = append(env, "SMTP2HTTP_SPAM_FLAG="+spamFlag(msg.Security.Flagged))
+	}
+	if msg.Session != nil {
+		env = append(env, "SMTP2HTTP_CLIENT_IP="+msg.Session.ClientIP, "SMTP2HTTP_HELO="+msg.Session.Helo)
+	}
+	return env
+}
+
+func firstLine(s string) string {
+	s = strings.TrimSpace(s)
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		s = s[:i]
+	}
+	return s
+}
+
+// limitedBuffer 只保留前 max 字节，防止命令输出占满内存
+type limitedBuffer struct {
+	bytes.Buffer
+	max int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - b.Len(); room > 0 {
+		if len(p) > room {
+			b.Buffer.Write(p[:room])
+		} else {
+			b.Buffer.Write(p)
+		}
+	}
+	return len(p), nil
+}
@@ -0,0 +1,112 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newShellSink 创建运行 /bin/sh -c script 的 exec 目标
+func newShellSink(t *testing.T, script string) Sink {
+	t.Helper()
+	u := &url.URL{Scheme: "exec", Path: "/bin/sh", RawQuery: url.Values{"arg": {"-c", script}}.Encode()}
+	sink, err := NewExecSink(u)
+	if err != nil {
+		t.Fatalf("NewExecSink(%s) = %v", u, err)
+	}
+	return sink
+}
+
+func TestExecSinkExitCodes(t *testing.T) {
+	tests := []struct {
+		script  string
+		want    string // accept、tempfail、reject 或 E7
+		message string
+	}{
+		{"exit 0", VerdictAccept, ""},
+		{"cat >/dev/null", VerdictAccept, ""},
+		{"echo 'mailbox full'; echo more; exit 75", VerdictTempFail, "mailbox full"},
+		{"exit 75", VerdictTempFail, "Destination temporarily unavailable, please try again later"},
+		{"echo 'no such user'; exit 67", VerdictReject, "no such user"},
+		{"exit 64", VerdictReject, "Email rejected by destination server"},
+		{"exit 78", VerdictReject, "Email rejected by destination server"},
+		{"exit 1", "E7", ""},
+		{"exit 63", "E7", ""},
+		{"exit 79", "E7", ""},
+		{"exit 127", "E7", ""},
+		{"kill -9 $$", "E7", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.script, func(t *testing.T) {
+			err := newShellSink(t, tt.script).Deliver(&WebhookTarget{}, &EmailMessage{Subject: "exec"})
+
+			if tt.want == VerdictAccept {
+				if err != nil {
+					t.Fatalf("Deliver() = %v, want success", err)
+				}
+				return
+			}
+
+			derr, ok := err.(*DeliveryError)
+			if !ok {
+				t.Fatalf("Deliver() = %v, want a *DeliveryError", err)
+			}
+			if tt.want == "E7" {
+				if derr.Code != "E7" || derr.Permanent || derr.Verdict != nil {
+					t.Errorf("Deliver() = %+v, want a temporary E7 without a verdict", derr)
+				}
+				return
+			}
+			if derr.Verdict == nil || derr.Verdict.Action != tt.want || derr.Verdict.Message != tt.message {
+				t.Fatalf("Deliver() verdict = %+v, want %s %q", derr.Verdict, tt.want, tt.message)
+			}
+			if derr.Permanent != (tt.want == VerdictReject) {
+				t.Errorf("Permanent = %v for %s", derr.Permanent, tt.want)
+			}
+		})
+	}
+}
+
+func TestExecSinkTimeoutKillsProcessGroup(t *testing.T) {
+	old := *flagExecTimeout
+	*flagExecTimeout = 200 * time.Millisecond
+	t.Cleanup(func() { *flagExecTimeout = old })
+
+	// 后台的 sleep 继承了输出管道，只结束 sh 时 Wait 要等它退出
+	sink := newShellSink(t, "sleep 30 & sleep 30")
+
+	start := time.Now()
+	err := sink.Deliver(&WebhookTarget{}, &EmailMessage{Subject: "slow"})
+	elapsed := time.Since(start)
+
+	derr, ok := err.(*DeliveryError)
+	if !ok || derr.Code != "E7" || derr.Permanent || !strings.Contains(derr.Error(), "timed out") {
+		t.Fatalf("Deliver() = %v, want a temporary E7 timeout", err)
+	}
+	if elapsed > 5*time.Second {
+		t.Errorf("Deliver() returned after %s, the background child was not killed", elapsed)
+	}
+}
+
+func TestNewExecSinkRequiresExecutable(t *testing.T) {
+	f, err := ioutil.TempFile("", "script")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	os.Chmod(f.Name(), 0644)
+
+	for _, path := range []string{"/nonexistent/command", os.TempDir(), f.Name()} {
+		if _, err := NewExecSink(&url.URL{Scheme: "exec", Path: path}); err == nil {
+			t.Errorf("NewExecSink(%s) succeeded", path)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+)
+
+// 多 webhook 投递时决定 SMTP 结果的策略
+const (
+	PolicyAll     = "all"     // 所有目标都成功才算成功
+	PolicyAny     = "any"     // 任一目标成功即算成功
+	PolicyPrimary = "primary" // 第一个目标决定结果，其余目标尽力投递
+)
+
+// webhookList 可重复的 --webhook 参数
+type webhookList struct {
+	specs   []string
+	targets []*WebhookTarget
+	set     bool
+}
+
+func (l *webhookList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(l.specs, ", ")
+}
+
+// Set 第一次设置时替换默认值，之后追加
+func (l *webhookList) Set(spec string) error {
+	target, err := parseWebhookSpec(spec)
+	if err != nil {
+		return err
+	}
+
+	if !l.set {
+		l.specs, l.targets, l.set = nil, nil, true
+	}
+
+	l.specs = append(l.specs, spec)
+	l.targets = append(l.targets, target)
+	return nil
+}
+
+// newWebhookList 创建带默认目标的参数
+func newWebhookList(defaultSpec string) *webhookList {
+	target, err := parseWebhookSpec(defaultSpec)
+	if err != nil {
+		panic(err)
+	}
+	return &webhookList{specs: []string{defaultSpec}, targets: []*WebhookTarget{target}}
+}
+
+// parseWebhookSpec 解析 "url; inbound-key=...; signing-key=...; format=...; template=...; compression=...; oauth=on|off; batch=on|off; header=Name: value" 形式的目标，
+// 分号分隔，与 DNS TXT 记录的写法一致
+func parseWebhookSpec(spec string) (*WebhookTarget, error) {
+	fields := strings.Split(spec, ";")
+
+	// 运维配置的目标默认附带 OAuth2 令牌（配置了 --oauth-token-url 时）
+	target := &WebhookTarget{URL: strings.TrimSpace(fields[0]), OAuth: true}
+	scheme, _, err := parseSinkURL(target.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, field := range fields[1:] {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid webhook option %q", field)
+		}
+
+		key := strings.TrimSpace(parts[0])
+		value := strings.TrimSpace(parts[1])
+
+		switch key {
+		case "inbound-key":
+			target.InboundKey = value
+		case "signing-key":
+			target.SigningKey = value
+		case "format":
+			switch value {
+			case FormatJSON, FormatMultipart, FormatCloudEvents, FormatCloudEventsBinary:
+			default:
+				return nil, fmt.Errorf("invalid webhook format %q", value)
+			}
+			target.Format = value
+		case "template":
+			if _, err := loadPayloadTemplate(value); err != nil {
+				return nil, err
+			}
+			target.Format = FormatTemplate
+			target.Template = value
+		case "compression":
+			if !validCompression(value) {
+				return nil, fmt.Errorf("invalid webhook compression %q", value)
+			}
+			target.Compression = value
+		case "oauth":
+			switch value {
+			case "on":
+				target.OAuth = true
+			case "off":
+				target.OAuth = false
+			default:
+				return nil, fmt.Errorf("invalid webhook oauth %q, expected on or off", value)
+			}
+		case "batch":
+			switch value {
+			case "on":
+				if scheme != "http" && scheme != "https" {
+					return nil, fmt.Errorf("batch=on is only supported for http and https webhooks, not %s", scheme)
+				}
+				target.Batch = true
+			case "off":
+				target.Batch = false
+			default:
+				return nil, fmt.Errorf("invalid webhook batch %q, expected on or off", value)
+			}
+		case "header":
+			header := strings.SplitN(value, ":", 2)
+			if len(header) != 2 || strings.TrimSpace(header[0]) == "" {
+				return nil, fmt.Errorf("invalid webhook header %q, expected Name: value", value)
+			}
+			if target.Headers == nil {
+				target.Headers = map[string]string{}
+			}
+			target.Headers[strings.TrimSpace(header[0])] = strings.TrimSpace(header[1])
+		default:
+			return nil, fmt.Errorf("unknown webhook option %q", key)
+		}
+	}
+
+	return target, nil
+}
+
+// Delivery 一封邮件的投递计划
+type Delivery struct {
+	Policy  string           `json:"policy"`
+	Targets []*WebhookTarget `json:"targets"`
+}
+
+// deliverAll 并发投递到所有未完成的目标，按策略得出结果
+func deliverAll(d *Delivery, msg *EmailMessage) error {
+	errs := make([]error, len(d.Targets))
+
+	var wg sync.WaitGroup
+	for i, target := range d.Targets {
+		if target.Delivered {
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, target *WebhookTarget) {
+			defer wg.Done()
+			errs[i] = deliverTarget(target, msg)
+		}(i, target)
+	}
+	wg.Wait()
+
+	for i, target := range d.Targets {
+		if errs[i] == nil {
+			if !target.Delivered {
+				log.Printf("WEBHOOK: Target %d/%d %s delivered", i+1, len(d.Targets), target.URL)
+			}
+			target.Delivered = true
+			continue
+		}
+		log.Printf("WEBHOOK: Target %d/%d %s failed: %v", i+1, len(d.Targets), target.URL, errs[i])
+	}
+
+	return d.verdict(errs)
+}
+
+// verdict 按策略合并各目标的结果
+func (d *Delivery) verdict(errs []error) error {
+	switch d.Policy {
+	case PolicyAny:
+		for _, target := range d.Targets {
+			if target.Delivered {
+				return nil
+			}
+		}
+		return pickFailure(errs)
+	case PolicyPrimary:
+		return errs[0]
+	default:
+		return pickFailure(errs)
+	}
+}
+
+// Done 投递是否已经完成，不再需要重试
+func (d *Delivery) Done() bool {
+	switch d.Policy {
+	case PolicyAny:
+		for _, target := range d.Targets {
+			if target.Delivered {
+				return true
+			}
+		}
+		return false
+	case PolicyPrimary:
+		return d.Targets[0].Delivered
+	default:
+		for _, target := range d.Targets {
+			if !target.Delivered {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Blocked 熔断器打开导致按策略无法投递成功
+func (d *Delivery) Blocked() bool {
+	if breaker == nil {
+		return false
+	}
+
+	blocked := 0
+	for _, target := range d.Targets {
+		if breaker.Blocked(target.URL) {
+			blocked++
+		}
+	}
+
+	switch d.Policy {
+	case PolicyAny:
+		return blocked == len(d.Targets)
+	case PolicyPrimary:
+		return breaker.Blocked(d.Targets[0].URL)
+	default:
+		return blocked > 0
+	}
+}
+
+// pickFailure 选出代表性的失败：永久拒绝优先，因为重试无法让整体成功
+func pickFailure(errs []error) error {
+	var first error
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		if derr, ok := err.(*DeliveryError); ok && derr.Permanent {
+			return err
+		}
+		if first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// newDelivery 按当前配置创建投递计划，目标会被复制以便记录各自的投递状态
+func newDelivery(targets []*WebhookTarget) *Delivery {
+	d := &Delivery{Policy: *flagWebhookPolicy}
+	for _, t := range targets {
+		c := *t
+		if c.InboundKey == "" {
+			c.InboundKey = *flagInboundKey
+		}
+		if c.SigningKey == "" {
+			c.SigningKey = *flagSigningKey
+		}
+		if c.Compression == "" {
+			c.Compression = *flagCompression
+		}
+		if c.Format == "" {
+			c.Format = *flagPayloadFormat
+			c.Template = *flagPayloadTemplate
+		}
+		d.Targets = append(d.Targets, &c)
+	}
+	return d
+}
+
+// URLs 用于日志输出
+func (d *Delivery) URLs() string {
+	urls := []string{}
+	for _, t := range d.Targets {
+		urls = append(urls, t.URL)
+	}
+	return strings.Join(urls, ", ")
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// verdictServer 按请求路径给出结论：/accept、/tempfail、/reject，并记录每个路径收到的请求数
+type verdictServer struct {
+	*httptest.Server
+
+	mu   sync.Mutex
+	hits map[string]int
+}
+
+func newVerdictServer(t *testing.T) *verdictServer {
+	s := &verdictServer{hits: make(map[string]int)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.hits[r.URL.Path]++
+		s.mu.Unlock()
+
+		switch r.URL.Path {
+		case "/accept":
+			fmt.Fprint(w, `{"action":"accept"}`)
+		case "/reject":
+			fmt.Fprint(w, `{"action":"reject","message":"no such user"}`)
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, `{"action":"tempfail","message":"try later"}`)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *verdictServer) count(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.hits[path]
+}
+
+// delivery 按策略创建指向 paths 的投递计划
+func (s *verdictServer) delivery(policy string, paths ...string) *Delivery {
+	d := &Delivery{Policy: policy}
+	for _, p := range paths {
+		d.Targets = append(d.Targets, &WebhookTarget{URL: s.URL + p, Format: FormatJSON})
+	}
+	return d
+}
+
+// outcome 将投递结果归类为 accept、tempfail 或 reject
+func outcome(err error) string {
+	if err == nil {
+		return VerdictAccept
+	}
+	if derr, ok := err.(*DeliveryError); ok && derr.Permanent {
+		return VerdictReject
+	}
+	return VerdictTempFail
+}
+
+func TestDeliveryPolicies(t *testing.T) {
+	srv := newVerdictServer(t)
+
+	tests := []struct {
+		policy string
+		paths  []string
+		want   string
+		done   bool
+	}{
+		{PolicyAll, []string{"/accept", "/accept"}, VerdictAccept, true},
+		{PolicyAll, []string{"/accept", "/tempfail"}, VerdictTempFail, false},
+		{PolicyAll, []string{"/accept", "/reject"}, VerdictReject, false},
+		{PolicyAll, []string{"/tempfail", "/reject"}, VerdictReject, false},
+
+		{PolicyAny, []string{"/tempfail", "/accept"}, VerdictAccept, true},
+		{PolicyAny, []string{"/reject", "/accept"}, VerdictAccept, true},
+		{PolicyAny, []string{"/tempfail", "/reject"}, VerdictReject, false},
+		{PolicyAny, []string{"/tempfail", "/tempfail"}, VerdictTempFail, false},
+
+		{PolicyPrimary, []string{"/accept", "/tempfail"}, VerdictAccept, true},
+		{PolicyPrimary, []string{"/accept", "/reject"}, VerdictAccept, true},
+		{PolicyPrimary, []string{"/tempfail", "/accept"}, VerdictTempFail, false},
+		{PolicyPrimary, []string{"/reject", "/accept"}, VerdictReject, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s %v", tt.policy, tt.paths), func(t *testing.T) {
+			d := srv.delivery(tt.policy, tt.paths...)
+			err := deliverAll(d, &EmailMessage{Subject: "fanout"})
+
+			if got := outcome(err); got != tt.want {
+				t.Errorf("deliverAll() = %s (%v), want %s", got, err, tt.want)
+			}
+			if got := d.Done(); got != tt.done {
+				t.Errorf("Done() = %v, want %v", got, tt.done)
+			}
+			for i, target := range d.Targets {
+				if want := tt.paths[i] == "/accept"; target.Delivered != want {
+					t.Errorf("target %d %s Delivered = %v, want %v", i, tt.paths[i], target.Delivered, want)
+				}
+			}
+		})
+	}
+}
+
+func TestDeliveryRedeliverySkipsDelivered(t *testing.T) {
+	srv := newVerdictServer(t)
+	d := srv.delivery(PolicyAll, "/accept", "/tempfail")
+	msg := &EmailMessage{Subject: "retry"}
+
+	for attempt := 1; attempt <= 3; attempt++ {
+		if err := deliverAll(d, msg); outcome(err) != VerdictTempFail {
+			t.Fatalf("attempt %d: %v, want a temporary failure", attempt, err)
+		}
+	}
+
+	if got := srv.count("/accept"); got != 1 {
+		t.Errorf("delivered target received %d requests, want 1", got)
+	}
+	if got := srv.count("/tempfail"); got != 3 {
+		t.Errorf("failing target received %d requests, want 3", got)
+	}
+}
+
+func TestDeliveryBlocked(t *testing.T) {
+	old := breaker
+	breaker = NewCircuitBreaker(1, time.Minute)
+	t.Cleanup(func() { breaker = old })
+
+	breaker.Failure("http://down.test/")
+
+	tests := []struct {
+		policy string
+		urls   []string
+		want   bool
+	}{
+		{PolicyAll, []string{"http://up.test/", "http://down.test/"}, true},
+		{PolicyAll, []string{"http://up.test/", "http://up2.test/"}, false},
+		{PolicyAny, []string{"http://up.test/", "http://down.test/"}, false},
+		{PolicyAny, []string{"http://down.test/", "http://down.test/"}, true},
+		{PolicyPrimary, []string{"http://up.test/", "http://down.test/"}, false},
+		{PolicyPrimary, []string{"http://down.test/", "http://up.test/"}, true},
+	}
+
+	for _, tt := range tests {
+		d := &Delivery{Policy: tt.policy}
+		for _, u := range tt.urls {
+			d.Targets = append(d.Targets, &WebhookTarget{URL: u})
+		}
+		if got := d.Blocked(); got != tt.want {
+			t.Errorf("%s %v: Blocked() = %v, want %v", tt.policy, tt.urls, got, tt.want)
+		}
+	}
+}
+
+func TestPickFailure(t *testing.T) {
+	temp := &DeliveryError{Code: "E2", Err: errors.New("temp")}
+	temp2 := &DeliveryError{Code: "E1", Err: errors.New("temp2")}
+	perm := &DeliveryError{Permanent: true, Err: errors.New("perm")}
+
+	tests := []struct {
+		name string
+		errs []error
+		want error
+	}{
+		{"all nil", []error{nil, nil}, nil},
+		{"first temporary", []error{nil, temp, temp2}, temp},
+		{"permanent wins", []error{temp, nil, perm}, perm},
+	}
+
+	for _, tt := range tests {
+		if got := pickFailure(tt.errs); got != tt.want {
+			t.Errorf("%s: pickFailure() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseWebhookSpec(t *testing.T) {
+	target, err := parseWebhookSpec(" https://hook.test/in ; inbound-key=k1; signing-key=s1; format=multipart; compression=gzip; oauth=off; batch=on; header=X-Tenant: a ")
+	if err != nil {
+		t.Fatalf("parseWebhookSpec() = %v", err)
+	}
+	if target.URL != "https://hook.test/in" || target.InboundKey != "k1" || target.SigningKey != "s1" ||
+		target.Format != FormatMultipart || target.Compression != "gzip" || target.OAuth || !target.Batch ||
+		target.Headers["X-Tenant"] != "a" {
+		t.Errorf("parseWebhookSpec() = %+v", target)
+	}
+
+	if target, _ := parseWebhookSpec("https://hook.test/in"); !target.OAuth {
+		t.Error("configured targets should default to oauth=on")
+	}
+
+	for _, spec := range []string{
+		"https://hook.test/in; format=xml",
+		"https://hook.test/in; compression=brotli",
+		"https://hook.test/in; oauth=yes",
+		"https://hook.test/in; batch=maybe",
+		"file:///tmp/out.jsonl; batch=on",
+		"https://hook.test/in; header=NoColon",
+		"https://hook.test/in; header=: value",
+		"https://hook.test/in; retries=3",
+		"https://hook.test/in; inbound-key",
+		"ftp://hook.test/in",
+	} {
+		if _, err := parseWebhookSpec(spec); err == nil {
+			t.Errorf("parseWebhookSpec(%q) = nil error, want an error", spec)
+		}
+	}
+}
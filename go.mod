@@ -1,8 +1,26 @@
 module github.com/alash3al/smtp2http
 
-go 1.13
+go 1.17
 
 require (
 	github.com/alash3al/go-smtpsrv v0.0.0-20220704173150-cdaad3f3f582
+	github.com/emersion/go-smtp v0.13.0
 	github.com/go-resty/resty/v2 v2.3.0
+	github.com/golang/protobuf v1.4.3
+	github.com/klauspost/compress v1.11.13
+	github.com/zaccone/spf v0.0.0-20170817004109-76747b8658d9
+	golang.org/x/text v0.3.7
+	google.golang.org/grpc v1.43.0
+	google.golang.org/protobuf v1.25.0
+)
+
+require (
+	github.com/emersion/go-sasl v0.0.0-20200509203442-7bfe0ed36a21 // indirect
+	github.com/miekg/dns v1.1.50 // indirect
+	golang.org/x/mod v0.4.2 // indirect
+	golang.org/x/net v0.0.0-20210726213435-c6fcb2dbf985 // indirect
+	golang.org/x/sys v0.0.0-20210630005230-0f9fa26af87c // indirect
+	golang.org/x/tools v0.1.6-0.20210726203631-07bc1bf47fb2 // indirect
+	golang.org/x/xerrors v0.0.0-20200804184101-5ec99f83aff1 // indirect
+	google.golang.org/genproto v0.0.0-20200526211855-cb27e3aa2013 // indirect
 )
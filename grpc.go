@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+
+	"github.com/alash3al/smtp2http/deliverypb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+)
+
+// grpcChunkSize 附件内容分块的大小
+const grpcChunkSize = 64 * 1024
+
+// GRPCSink 通过 deliverypb.Delivery/Deliver 投递，grpc:// 为明文，grpcs:// 使用 TLS
+type GRPCSink struct {
+	conn   *grpc.ClientConn
+	client deliverypb.DeliveryClient
+}
+
+// NewGRPCSink 创建连接，连接在后台建立并在断开后自动重连
+func NewGRPCSink(u *url.URL) (Sink, error) {
+	creds := insecure.NewCredentials()
+	if u.Scheme == "grpcs" {
+		tlsConfig, err := newWebhookTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+		creds = credentials.NewTLS(tlsConfig)
+	}
+
+	conn, err := grpc.Dial(u.Host, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to %s: %v", u.Host, err)
+	}
+
+	return &GRPCSink{conn: conn, client: deliverypb.NewDeliveryClient(conn)}, nil
+}
+
+func (s *GRPCSink) Deliver(target *WebhookTarget, msg *EmailMessage) error {
+	ctx, cancel := context.WithTimeout(context.Background(), *flagWebhookTimeout)
+	defer cancel()
+
+	if target.InboundKey != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "x-inbound-key", target.InboundKey)
+	}
+	if msg.IdempotencyKey != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "idempotency-key", msg.IdempotencyKey)
+	}
+
+	log.Printf("GRPC: Delivering to %s", target.URL)
+	stream, err := s.client.Deliver(ctx)
+	if err != nil {
+		return &DeliveryError{Code: "E8", Err: fmt.Errorf("cannot open stream: %v", err)}
+	}
+
+	if err := stream.Send(&deliverypb.DeliverRequest{
+		Payload: &deliverypb.DeliverRequest_Message{Message: toProtoMessage(msg)},
+	}); err != nil {
+		return s.streamError(stream, err)
+	}
+
+	if r := msg.Raw; r != nil && r.URL == "" && !r.File().Empty() {
+		if err := sendChunks(stream, deliverypb.FileChunk_KIND_RAW, 0, r.File()); err != nil {
+			return s.streamError(stream, err)
+		}
+	}
+
+	for i, a := range msg.Attachments {
+		if a.URL != "" {
+			continue
+		}
+		if err := sendChunks(stream, deliverypb.FileChunk_KIND_ATTACHMENT, i, a.File()); err != nil {
+			return s.streamError(stream, err)
+		}
+	}
+
+	for i, e := range msg.EmbeddedFiles {
+		if e.URL != "" {
+			continue
+		}
+		if err := sendChunks(stream, deliverypb.FileChunk_KIND_EMBEDDED, i, e.File()); err != nil {
+			return s.streamError(stream, err)
+		}
+	}
+
+	resp, err := stream.CloseAndRecv()
+	if err != nil {
+		return &DeliveryError{Code: "E8", Err: fmt.Errorf("delivery failed: %v", err)}
+	}
+
+	verdict := &WebhookVerdict{
+		SMTPCode:     int(resp.SmtpCode),
+		EnhancedCode: resp.EnhancedCode,
+		Message:      resp.Message,
+	}
+	switch resp.Action {
+	case deliverypb.DeliverResponse_ACTION_ACCEPT:
+		verdict.Action = VerdictAccept
+	case deliverypb.DeliverResponse_ACTION_REJECT:
+		verdict.Action = VerdictReject
+	default:
+		// ACTION_UNSPECIFIED 说明接收方没有给出结论，不能当作已接收
+		verdict.Action = VerdictTempFail
+	}
+	verdict.normalize()
+	log.Printf("GRPC: Verdict: %s", verdict.describe())
+
+	switch verdict.Action {
+	case VerdictAccept:
+		return nil
+	case VerdictReject:
+		return &DeliveryError{Permanent: true, Verdict: verdict, Err: fmt.Errorf("rejected by %s: %s", target.URL, verdict.Message)}
+	default:
+		return &DeliveryError{Verdict: verdict, Err: fmt.Errorf("temporary failure from %s: %s", target.URL, verdict.Message)}
+	}
+}
+
+// streamError Send 失败时真正的原因要从 CloseAndRecv 中取得
+func (s *GRPCSink) streamError(stream deliverypb.Delivery_DeliverClient, err error) error {
+	if _, recvErr := stream.CloseAndRecv(); recvErr != nil {
+		err = recvErr
+	}
+	return &DeliveryError{Code: "E8", Err: fmt.Errorf("delivery failed: %v", err)}
+}
+
+// sendChunks 按 grpcChunkSize 分块发送文件内容，空文件也会发送一个 last 分块
+func sendChunks(stream deliverypb.Delivery_DeliverClient, kind deliverypb.FileChunk_Kind, index int, file FileContent) error {
+	raw, err := file.Bytes()
+	if err != nil {
+		return err
+	}
+
+	for {
+		n := len(raw)
+		if n > grpcChunkSize {
+			n = grpcChunkSize
+		}
+
+		chunk := &deliverypb.FileChunk{
+			Kind:  kind,
+			Index: uint32(index),
+			Data:  raw[:n],
+			Last:  n == len(raw),
+		}
+		if err := stream.Send(&deliverypb.DeliverRequest{Payload: &deliverypb.DeliverRequest_Chunk{Chunk: chunk}}); err != nil {
+			return err
+		}
+
+		raw = raw[n:]
+		if chunk.Last {
+			return nil
+		}
+	}
+}
+
+// toProtoMessage 转换为 protobuf 消息，不含文件内容
+func toProtoMessage(msg *EmailMessage) *deliverypb.EmailMessage {
+	pm := &deliverypb.EmailMessage{
+		Id:            msg.ID,
+		Date:          msg.Date,
+		Subject:       msg.Subject,
+		References:    msg.References,
+		Spf:           msg.SPFResult,
+		SecurityScore: int32(msg.SecurityScore),
+		ResentDate:    msg.ResentDate,
+		ResentId:      msg.ResentID,
+		Body:          &deliverypb.Body{Text: msg.Body.Text, Html: msg.Body.HTML},
+		Addresses: &deliverypb.Addresses{
+			From:       toProtoAddress(msg.Addresses.From),
+			To:         toProtoAddress(msg.Addresses.To),
+			ReplyTo:    toProtoAddresses(msg.Addresses.ReplyTo),
+			Cc:         toProtoAddresses(msg.Addresses.Cc),
+			Bcc:        toProtoAddresses(msg.Addresses.Bcc),
+			InReplyTo:  msg.Addresses.InReplyTo,
+			ResentFrom: toProtoAddress(msg.Addresses.ResentFrom),
+			ResentTo:   toProtoAddresses(msg.Addresses.ResentTo),
+			ResentCc:   toProtoAddresses(msg.Addresses.ResentCc),
+			ResentBcc:  toProtoAddresses(msg.Addresses.ResentBcc),
+		},
+		Recipients: msg.Recipients,
+	}
+
+	for _, h := range msg.Headers {
+		pm.Headers = append(pm.Headers, &deliverypb.Header{Name: h.Name, Value: h.Value})
+	}
+
+	if e := msg.Envelope; e != nil {
+		pm.Envelope = &deliverypb.Envelope{MailFrom: e.MailFrom, RcptTo: e.RcptTo}
+	}
+
+	if i := msg.Session; i != nil {
+		pm.Session = &deliverypb.Session{
+			ClientIp:   i.ClientIP,
+			RemoteAddr: i.RemoteAddr,
+			ReverseDns: i.ReverseDNS,
+			Helo:       i.Helo,
+			ListenAddr: i.ListenAddr,
+			ReceivedAt: i.ReceivedAt,
+		}
+		if t := i.TLS; t != nil {
+			pm.Session.Tls = &deliverypb.TLS{Version: t.Version, CipherSuite: t.CipherSuite, ServerName: t.ServerName}
+		}
+	}
+
+	if sec := msg.Security; sec != nil {
+		pm.Security = &deliverypb.Security{
+			Score:         int32(sec.Score),
+			Threshold:     int32(sec.Threshold),
+			FlagThreshold: int32(sec.FlagThreshold),
+			Flagged:       sec.Flagged,
+		}
+		for _, c := range sec.Checks {
+			pm.Security.Checks = append(pm.Security.Checks, &deliverypb.SecurityCheck{
+				Name:      c.Name,
+				Recipient: c.Recipient,
+				Score:     int32(c.Score),
+				Reason:    c.Reason,
+				Threshold: c.Threshold,
+			})
+		}
+	}
+
+	if r := msg.Raw; r != nil {
+		pm.Raw = &deliverypb.RawMessage{Size: r.Size, Sha256: r.SHA256, Url: r.URL, Omitted: r.Omitted}
+	}
+
+	for _, a := range msg.Attachments {
+		size := int64(a.Size)
+		if a.URL == "" {
+			size = int64(a.File().Len())
+		}
+		pm.Attachments = append(pm.Attachments, &deliverypb.Attachment{
+			Filename:    a.Filename,
+			ContentType: a.ContentType,
+			Size:        size,
+			Sha256:      a.SHA256,
+			Url:         a.URL,
+		})
+	}
+
+	for _, e := range msg.EmbeddedFiles {
+		size := int64(e.Size)
+		if e.URL == "" {
+			size = int64(e.File().Len())
+		}
+		pm.EmbeddedFiles = append(pm.EmbeddedFiles, &deliverypb.EmbeddedFile{
+			Cid:         e.CID,
+			ContentType: e.ContentType,
+			Size:        size,
+			Sha256:      e.SHA256,
+			Url:         e.URL,
+		})
+	}
+
+	return pm
+}
+
+func toProtoAddress(a *EmailAddress) *deliverypb.Address {
+	if a == nil {
+		return nil
+	}
+	return &deliverypb.Address{Name: a.Name, Address: a.Address}
+}
+
+func toProtoAddresses(list []*EmailAddress) []*deliverypb.Address {
+	out := []*deliverypb.Address{}
+	for _, a := range list {
+		out = append(out, toProtoAddress(a))
+	}
+	return out
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"mime"
+	"strings"
+
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// EmailHeader 邮件头中的一行，同名的头各自一项
+type EmailHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// headerDecoder 解码 RFC 2047 编码的头，支持 WHATWG 编码标准中的字符集（GBK、ISO-2022-JP 等）
+var headerDecoder = &mime.WordDecoder{
+	CharsetReader: func(charset string, input io.Reader) (io.Reader, error) {
+		enc, err := htmlindex.Get(charset)
+		if err != nil {
+			return nil, err
+		}
+		return enc.NewDecoder().Reader(input), nil
+	},
+}
+
+// readHeaderBlock 读取邮件头直到空行（含空行），r 中留下正文
+func readHeaderBlock(r *bufio.Reader) ([]byte, error) {
+	var block []byte
+	for {
+		line, err := r.ReadBytes('\n')
+		block = append(block, line...)
+		if err == io.EOF {
+			return block, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			return block, nil
+		}
+	}
+}
+
+// parseHeaders 按原始顺序解析邮件头：折行展开，编码字解码，按 --header-allow 和 --header-deny 过滤
+func parseHeaders(block []byte) []*EmailHeader {
+	headers := []*EmailHeader{}
+
+	var name string
+	var value strings.Builder
+	flush := func() {
+		if name != "" && isHeaderAllowed(name) {
+			v := strings.TrimSpace(value.String())
+			if decoded, err := headerDecoder.DecodeHeader(v); err == nil {
+				v = decoded
+			}
+			headers = append(headers, &EmailHeader{Name: name, Value: v})
+		}
+		name = ""
+		value.Reset()
+	}
+
+	for _, line := range strings.Split(string(block), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if line == "" {
+			break
+		}
+
+		// 以空白开头的是上一行的续行
+		if line[0] == ' ' || line[0] == '\t' {
+			if name != "" {
+				value.WriteString(line)
+			}
+			continue
+		}
+
+		flush()
+		i := strings.IndexByte(line, ':')
+		if i <= 0 {
+			continue
+		}
+		name = strings.TrimSpace(line[:i])
+		value.WriteString(line[i+1:])
+	}
+	flush()
+
+	return headers
+}
+
+// isHeaderAllowed 检查头是否应出现在 payload 中：--header-deny 优先，--header-allow 为空时允许其余所有头，
+// 两者都不区分大小写并支持 X-* 这样的前缀通配
+func isHeaderAllowed(name string) bool {
+	if matchHeaderList(*flagHeaderDeny, name) {
+		return false
+	}
+	return *flagHeaderAllow == "" || matchHeaderList(*flagHeaderAllow, name)
+}
+
+func matchHeaderList(list, name string) bool {
+	name = strings.ToLower(name)
+	for _, pattern := range strings.Split(list, ",") {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		switch {
+		case pattern == "":
+		case strings.HasSuffix(pattern, "*"):
+			if strings.HasPrefix(name, strings.TrimSuffix(pattern, "*")) {
+				return true
+			}
+		case pattern == name:
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// headerPairs 将解析结果格式化为 "Name: value" 列表，便于比较
+func headerPairs(headers []*EmailHeader) []string {
+	pairs := []string{}
+	for _, h := range headers {
+		pairs = append(pairs, h.Name+": "+h.Value)
+	}
+	return pairs
+}
+
+func TestParseHeaders(t *testing.T) {
+	setFlag(t, flagHeaderAllow, "")
+	setFlag(t, flagHeaderDeny, "")
+
+	tests := []struct {
+		name  string
+		block string
+		want  []string
+	}{
+		{
+			"folded lines",
+			"Subject: a long\r\n subject\r\n\tline\r\nTo: a@example.test\r\n\r\n",
+			[]string{"Subject: a long subject\tline", "To: a@example.test"},
+		},
+		{
+			"LF only and no blank line",
+			"Subject: lf\nX-Id: 1",
+			[]string{"Subject: lf", "X-Id: 1"},
+		},
+		{
+			"UTF-8 encoded words across a fold",
+			"Subject: =?UTF-8?Q?Gr=C3=BC?=\r\n =?UTF-8?Q?=C3=9Fe?= und mehr\r\n\r\n",
+			[]string{"Subject: Grüße und mehr"},
+		},
+		{
+			"GBK",
+			"Subject: =?GBK?B?xOO6ww==?=\r\nFrom: =?gbk?B?xOO6ww==?= <a@example.test>\r\n\r\n",
+			[]string{"Subject: 你好", "From: 你好 <a@example.test>"},
+		},
+		{
+			"ISO-2022-JP",
+			"Subject: =?ISO-2022-JP?B?GyRCJDMkcyRLJEEkTxsoQg==?= =?iso-2022-jp?B?GyRCRnxLXDhsGyhC?=\r\n\r\n",
+			[]string{"Subject: こんにちは日本語"},
+		},
+		{
+			"unknown charset kept as is",
+			"Subject: =?x-unknown?B?xOO6ww==?=\r\n\r\n",
+			[]string{"Subject: =?x-unknown?B?xOO6ww==?="},
+		},
+		{
+			"duplicates keep their order",
+			"Received: from c\r\nX-Tag: 1\r\nReceived: from b\r\n (folded)\r\nX-Tag: 2\r\nReceived: from a\r\n\r\n",
+			[]string{"Received: from c", "X-Tag: 1", "Received: from b (folded)", "X-Tag: 2", "Received: from a"},
+		},
+		{
+			"malformed lines are skipped",
+			" leading continuation\r\nno colon here\r\n: empty name\r\nSubject:no space\r\n\r\n",
+			[]string{"Subject: no space"},
+		},
+		{
+			"body is not parsed",
+			"Subject: head\r\n\r\nX-Not-A-Header: body\r\n",
+			[]string{"Subject: head"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := headerPairs(parseHeaders([]byte(tt.block)))
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("parseHeaders() =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestParseHeadersFilter(t *testing.T) {
+	block := "Subject: s\r\nX-Spam: yes\r\nx-mailer: m\r\nX-Internal-Id: 1\r\nDKIM-Signature: v=1\r\nReceived: r\r\n\r\n"
+
+	tests := []struct {
+		allow, deny string
+		want        []string
+	}{
+		{"", "", []string{"Subject", "X-Spam", "x-mailer", "X-Internal-Id", "DKIM-Signature", "Received"}},
+		{"subject, x-*", "", []string{"Subject", "X-Spam", "x-mailer", "X-Internal-Id"}},
+		{"", "dkim-signature,X-Internal-*", []string{"Subject", "X-Spam", "x-mailer", "Received"}},
+		{"X-*", "x-internal-id", []string{"X-Spam", "x-mailer"}},
+		{"Subject,X-Spam", "x-*", []string{"Subject"}},
+		{"*", "received", []string{"Subject", "X-Spam", "x-mailer", "X-Internal-Id", "DKIM-Signature"}},
+		{" , ", "", nil},
+	}
+
+	for _, tt := range tests {
+		setFlag(t, flagHeaderAllow, tt.allow)
+		setFlag(t, flagHeaderDeny, tt.deny)
+
+		names := []string{}
+		for _, h := range parseHeaders([]byte(block)) {
+			names = append(names, h.Name)
+		}
+		if strings.Join(names, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("allow %q deny %q: %v, want %v", tt.allow, tt.deny, names, tt.want)
+		}
+	}
+}
+
+func TestMatchHeaderList(t *testing.T) {
+	tests := []struct {
+		list, name string
+		want       bool
+	}{
+		{"Subject", "subject", true},
+		{"subject", "Subject-Extra", false},
+		{"X-*", "x-mailer", true},
+		{"X-*", "X-", true},
+		{"X-*", "Xmailer", false},
+		{"x-spam-*, list-*", "List-Unsubscribe", true},
+		{"*", "anything", true},
+		{"", "Subject", false},
+		{",,", "Subject", false},
+	}
+
+	for _, tt := range tests {
+		if got := matchHeaderList(tt.list, tt.name); got != tt.want {
+			t.Errorf("matchHeaderList(%q, %q) = %v, want %v", tt.list, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestReadHeaderBlock(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("Subject: s\r\n folded\r\n\r\nbody\r\n"))
+	block, err := readHeaderBlock(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(block) != "Subject: s\r\n folded\r\n\r\n" {
+		t.Errorf("block = %q", block)
+	}
+	if rest, _ := ioutil.ReadAll(r); string(rest) != "body\r\n" {
+		t.Errorf("left %q, want the body", rest)
+	}
+
+	block, err = readHeaderBlock(bufio.NewReader(strings.NewReader("Subject: only headers")))
+	if err != nil || string(block) != "Subject: only headers" {
+		t.Errorf("readHeaderBlock() without a blank line = %q, %v", block, err)
+	}
+}
@@ -1,9 +1,24 @@
 package main
 
 import (
+	"io"
+	"io/ioutil"
 	"net/mail"
 )
 
+// readPart 读取解析器解码后的附件内容；解析器给出的是 bytes.Reader，按剩余长度一次分配，
+// 避免 ioutil.ReadAll 扩容时的多次复制
+func readPart(r io.Reader) ([]byte, error) {
+	sized, ok := r.(interface{ Len() int })
+	if !ok {
+		return ioutil.ReadAll(r)
+	}
+
+	data := make([]byte, sized.Len())
+	_, err := io.ReadFull(r, data)
+	return data, err
+}
+
 func extractEmails(addr []*mail.Address, _ ...error) []string {
 	ret := []string{}
 
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// newWebhookTLSConfig 按 --webhook-ca-file、--webhook-cert-file 创建 TLS 配置，HTTP 和 gRPC 目标共用
+func newWebhookTLSConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+
+	if *flagWebhookCAFile != "" {
+		pem, err := ioutil.ReadFile(*flagWebhookCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read CA file: %v", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", *flagWebhookCAFile)
+		}
+		tlsConfig.RootCAs = roots
+	}
+
+	if *flagWebhookCertFile != "" || *flagWebhookKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(*flagWebhookCertFile, *flagWebhookKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// newWebhookClient 根据配置创建 webhook 投递使用的 HTTP 客户端，socket 不为空时所有连接都发往该 Unix 套接字
+func newWebhookClient(socket string) (*resty.Client, error) {
+	tlsConfig, err := newWebhookTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   10 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConfig,
+		ForceAttemptHTTP2:     *flagWebhookHTTP2,
+		MaxIdleConns:          *flagWebhookMaxIdleConns,
+		MaxIdleConnsPerHost:   *flagWebhookMaxIdleConns,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+
+	// 未开启 HTTP/2 时显式禁用 ALPN 协商
+	if !*flagWebhookHTTP2 {
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+
+	if *flagWebhookProxy != "" {
+		proxy, err := url.Parse(*flagWebhookProxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL: %v", err)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	// 通过 Unix 套接字投递给同机的 sidecar，URL 中的主机名只用于 Host 头
+	if socket != "" {
+		transport.Proxy = nil
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", socket)
+		}
+	}
+
+	client := resty.NewWithClient(&http.Client{
+		Transport: transport,
+		Timeout:   *flagWebhookTimeout,
+	})
+
+	return client, nil
+}
+
+// clientFor 目标使用的客户端：设置了 UnixSocket 的目标使用该套接字的客户端，其余共用 webhookClient
+func clientFor(target *WebhookTarget) (*resty.Client, error) {
+	if target.UnixSocket == "" {
+		return webhookClient, nil
+	}
+
+	if client, ok := socketClients.Load(target.UnixSocket); ok {
+		return client.(*resty.Client), nil
+	}
+
+	// 磁盘队列中的目标可能来自使用其他套接字的配置
+	client, err := newWebhookClient(target.UnixSocket)
+	if err != nil {
+		return nil, fmt.Errorf("cannot configure webhook client: %v", err)
+	}
+	actual, _ := socketClients.LoadOrStore(target.UnixSocket, client)
+	return actual.(*resty.Client), nil
+}
+
+// useUnixSocket 让 --webhook 中的 HTTP 目标经 socket 发送；--route、DNS TXT hook 和令牌服务仍走网络
+func useUnixSocket(socket string) error {
+	client, err := newWebhookClient(socket)
+	if err != nil {
+		return err
+	}
+	socketClients.Store(socket, client)
+
+	for _, t := range flagWebhooks.targets {
+		if u, err := url.Parse(t.URL); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+			t.UnixSocket = socket
+		}
+	}
+	return nil
+}
+
+// 没有指定套接字的 webhook 投递共用的客户端，main 中按配置重建
+var webhookClient = resty.New()
+
+// 按套接字路径缓存的客户端，见 --webhook-unix-socket
+var socketClients sync.Map
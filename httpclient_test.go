@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// hostRecorder 记录收到的 Host 头并接受邮件
+type hostRecorder struct {
+	mu    sync.Mutex
+	hosts []string
+}
+
+func (h *hostRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	h.hosts = append(h.hosts, r.Host)
+	h.mu.Unlock()
+	fmt.Fprint(w, `{"action":"accept"}`)
+}
+
+func (h *hostRecorder) received() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]string{}, h.hosts...)
+}
+
+// useConfiguredDelivery 运行 configureDelivery，结束后恢复它替换的全局客户端
+func useConfiguredDelivery(t *testing.T) {
+	t.Helper()
+	oldClient, oldBreaker, oldTokens := webhookClient, breaker, tokenSource
+	t.Cleanup(func() {
+		webhookClient, breaker, tokenSource = oldClient, oldBreaker, oldTokens
+		socketClients.Range(func(k, _ interface{}) bool {
+			socketClients.Delete(k)
+			return true
+		})
+	})
+
+	if err := configureDelivery(); err != nil {
+		t.Fatalf("configureDelivery() = %v", err)
+	}
+}
+
+func TestUnixSocketOnlyForWebhookTargets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "inbound.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sidecar := &hostRecorder{}
+	go http.Serve(ln, sidecar)
+	defer ln.Close()
+
+	network := &hostRecorder{}
+	srv := httptest.NewServer(network)
+	defer srv.Close()
+
+	useTargets(t,
+		[]string{"http://sidecar/api/inbound", "file://" + filepath.Join(dir, "out.jsonl")},
+		[]string{"routed.test=" + srv.URL + "/route"},
+		nil)
+	setFlag(t, flagWebhookUnixSocket, socket)
+	setFlag(t, flagAllowedHookHosts, "127.0.0.1")
+	useConfiguredDelivery(t)
+
+	if got := flagWebhooks.targets[1].UnixSocket; got != "" {
+		t.Errorf("file:// target got UnixSocket %q", got)
+	}
+
+	msg := &EmailMessage{Subject: "socket"}
+	for _, rcpt := range []string{"a@other.test", "a@routed.test"} {
+		d, _ := resolveDelivery(rcpt, nil)
+		if err := deliverTarget(d.Targets[0], msg); err != nil {
+			t.Fatalf("delivery for %s = %v", rcpt, err)
+		}
+	}
+	hook, err := resolveDelivery("a@hooked.test", &DNSTXTRecord{Allow: true, Hook: srv.URL + "/hook"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := deliverTarget(hook.Targets[0], msg); err != nil {
+		t.Fatalf("DNS hook delivery = %v", err)
+	}
+
+	if got := sidecar.received(); len(got) != 1 || got[0] != "sidecar" {
+		t.Errorf("socket received Host %v, want only the --webhook request for sidecar", got)
+	}
+	if got := network.received(); len(got) != 2 {
+		t.Errorf("network server received %d requests, want the route and the DNS hook", len(got))
+	}
+
+	// 保存在磁盘队列中的目标仍经套接字发送
+	d, _ := resolveDelivery("b@other.test", nil)
+	data, _ := json.Marshal(d)
+	restored := &Delivery{}
+	json.Unmarshal(data, restored)
+	if err := deliverTarget(restored.Targets[0], msg); err != nil {
+		t.Fatal(err)
+	}
+	if got := sidecar.received(); len(got) != 2 {
+		t.Errorf("restored target was not sent over the socket, socket received %d requests", len(got))
+	}
+}
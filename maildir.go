@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// MaildirSink 按 Maildir 约定投递：先写入 tmp/，fsync 后重命名到 new/
+type MaildirSink struct {
+	dir      string
+	hostname string
+}
+
+// maildirSeq 同一进程内的序号，保证文件名唯一
+var maildirSeq uint64
+
+// NewMaildirSink 打开 Maildir，不存在时创建 tmp、new、cur 子目录
+func NewMaildirSink(dir string) (Sink, error) {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return nil, fmt.Errorf("cannot create maildir: %v", err)
+		}
+	}
+
+	hostname, _ := os.Hostname()
+	// 文件名中不能出现 / 和 :
+	hostname = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(hostname)
+	if hostname == "" {
+		hostname = "localhost"
+	}
+
+	return &MaildirSink{dir: dir, hostname: hostname}, nil
+}
+
+func (s *MaildirSink) Deliver(target *WebhookTarget, msg *EmailMessage) error {
+	data, err := rfc822Source(msg)
+	if err != nil {
+		return &DeliveryError{Code: "E1", Permanent: true, Err: fmt.Errorf("cannot encode message: %v", err)}
+	}
+
+	now := time.Now()
+	name := fmt.Sprintf("%d.M%dP%dQ%d.%s", now.Unix(), now.Nanosecond()/1000, os.Getpid(),
+		atomic.AddUint64(&maildirSeq, 1), s.hostname)
+
+	tmp := filepath.Join(s.dir, "tmp", name)
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return sinkError(fmt.Errorf("cannot write maildir message: %v", err))
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return sinkError(fmt.Errorf("cannot write maildir message: %v", err))
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return sinkError(fmt.Errorf("cannot sync maildir message: %v", err))
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return sinkError(fmt.Errorf("cannot write maildir message: %v", err))
+	}
+
+	if err := os.Rename(tmp, filepath.Join(s.dir, "new", name)); err != nil {
+		os.Remove(tmp)
+		return sinkError(fmt.Errorf("cannot commit maildir message: %v", err))
+	}
+
+	return nil
+}
+
+// buildRFC822 由解析后的邮件重新生成 RFC 822 格式；已存入外部存储的文件只保留链接
+func buildRFC822(msg *EmailMessage) ([]byte, error) {
+	buf := &bytes.Buffer{}
+
+	header := func(name, value string) {
+		if value != "" {
+			fmt.Fprintf(buf, "%s: %s\r\n", name, value)
+		}
+	}
+
+	header("Date", rfc822Date(msg.Date))
+	header("From", mailAddress(msg.Addresses.From))
+	header("To", mailAddress(msg.Addresses.To))
+	header("Cc", mailAddressList(msg.Addresses.Cc))
+	header("Reply-To", mailAddressList(msg.Addresses.ReplyTo))
+	header("Subject", mime.QEncoding.Encode("utf-8", msg.Subject))
+	header("Message-ID", angleID(msg.ID))
+	header("In-Reply-To", angleIDs(msg.Addresses.InReplyTo))
+	header("References", angleIDs(msg.References))
+	header("MIME-Version", "1.0")
+
+	mixed := multipart.NewWriter(buf)
+	header("Content-Type", mime.FormatMediaType("multipart/mixed", map[string]string{"boundary": mixed.Boundary()}))
+	buf.WriteString("\r\n")
+
+	// 正文：text 和 html 作为 multipart/alternative
+	alt := &bytes.Buffer{}
+	altWriter := multipart.NewWriter(alt)
+	for _, body := range []struct{ contentType, text string }{
+		{"text/plain; charset=utf-8", msg.Body.Text},
+		{"text/html; charset=utf-8", msg.Body.HTML},
+	} {
+		if body.text == "" {
+			continue
+		}
+		h := textproto.MIMEHeader{}
+		h.Set("Content-Type", body.contentType)
+		h.Set("Content-Transfer-Encoding", "quoted-printable")
+		pw, err := altWriter.CreatePart(h)
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(pw)
+		if _, err := qp.Write([]byte(body.text)); err != nil {
+			return nil, err
+		}
+		qp.Close()
+	}
+	altWriter.Close()
+
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Type", mime.FormatMediaType("multipart/alternative", map[string]string{"boundary": altWriter.Boundary()}))
+	pw, err := mixed.CreatePart(h)
+	if err != nil {
+		return nil, err
+	}
+	pw.Write(alt.Bytes())
+
+	for _, a := range msg.Attachments {
+		if err := writeMIMEFile(mixed, "attachment", a.Filename, "", a.ContentType, a.File(), a.URL); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, e := range msg.EmbeddedFiles {
+		if err := writeMIMEFile(mixed, "inline", "", e.CID, e.ContentType, e.File(), e.URL); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := mixed.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// writeMIMEFile 写入 base64 编码的文件部分，已外部存储的文件写入带链接的 message/external-body
+func writeMIMEFile(w *multipart.Writer, disposition, filename, cid, contentType string, file FileContent, url string) error {
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	h := textproto.MIMEHeader{}
+	if filename != "" {
+		h.Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": filename}))
+	} else {
+		h.Set("Content-Disposition", disposition)
+	}
+	if cid != "" {
+		h.Set("Content-ID", angleID(cid))
+	}
+
+	if url != "" {
+		h.Set("Content-Type", mime.FormatMediaType("message/external-body", map[string]string{"access-type": "URL", "URL": url}))
+		pw, err := w.CreatePart(h)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(pw, "Content-Type: %s\r\n\r\n", contentType)
+		return err
+	}
+
+	raw, err := file.Bytes()
+	if err != nil {
+		return err
+	}
+
+	h.Set("Content-Type", contentType)
+	h.Set("Content-Transfer-Encoding", "base64")
+	pw, err := w.CreatePart(h)
+	if err != nil {
+		return err
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(raw)
+	for len(encoded) > 76 {
+		if _, err := fmt.Fprintf(pw, "%s\r\n", encoded[:76]); err != nil {
+			return err
+		}
+		encoded = encoded[76:]
+	}
+	_, err = fmt.Fprintf(pw, "%s\r\n", encoded)
+	return err
+}
+
+// rfc822Date 将 time.Time.String() 格式的日期转换为 RFC 5322 格式
+func rfc822Date(s string) string {
+	t, err := time.Parse("2006-01-02 15:04:05.999999999 -0700 MST", s)
+	if err != nil || t.IsZero() || t.Year() < 1970 {
+		return time.Now().Format(time.RFC1123Z)
+	}
+	return t.Format(time.RFC1123Z)
+}
+
+func mailAddress(a *EmailAddress) string {
+	if a == nil || a.Address == "" {
+		return ""
+	}
+	return (&mail.Address{Name: a.Name, Address: a.Address}).String()
+}
+
+func mailAddressList(list []*EmailAddress) string {
+	out := []string{}
+	for _, a := range list {
+		if s := mailAddress(a); s != "" {
+			out = append(out, s)
+		}
+	}
+	return strings.Join(out, ", ")
+}
+
+func angleID(id string) string {
+	if id == "" {
+		return ""
+	}
+	return "<" + strings.Trim(id, "<>") + ">"
+}
+
+func angleIDs(ids []string) string {
+	out := []string{}
+	for _, id := range ids {
+		if id = angleID(id); id != "" {
+			out = append(out, id)
+		}
+	}
+	return strings.Join(out, " ")
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func newTestMaildir(t *testing.T) (*MaildirSink, string) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "maildir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	sink, err := NewMaildirSink(filepath.Join(dir, "Maildir"))
+	if err != nil {
+		t.Fatalf("NewMaildirSink() = %v", err)
+	}
+	return sink.(*MaildirSink), filepath.Join(dir, "Maildir")
+}
+
+func readDir(t *testing.T, dir string) []os.FileInfo {
+	t.Helper()
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestMaildirDeliver(t *testing.T) {
+	sink, dir := newTestMaildir(t)
+
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if info, err := os.Stat(filepath.Join(dir, sub)); err != nil || !info.IsDir() {
+			t.Fatalf("%s/ not created: %v", sub, err)
+		}
+	}
+
+	msg := &EmailMessage{Subject: "Grüße", ID: "abc@example.test"}
+	msg.Addresses.From = &EmailAddress{Address: "s@example.test"}
+	msg.Body.Text = "hello"
+	if err := sink.Deliver(&WebhookTarget{}, msg); err != nil {
+		t.Fatalf("Deliver() = %v", err)
+	}
+
+	if tmp := readDir(t, filepath.Join(dir, "tmp")); len(tmp) != 0 {
+		t.Errorf("tmp/ still holds %d files after delivery", len(tmp))
+	}
+	files := readDir(t, filepath.Join(dir, "new"))
+	if len(files) != 1 {
+		t.Fatalf("new/ holds %d files, want 1", len(files))
+	}
+
+	name := files[0].Name()
+	if !regexp.MustCompile(`^\d+\.M\d+P\d+Q\d+\.[^/:]+$`).MatchString(name) {
+		t.Errorf("file name %q does not follow the maildir convention", name)
+	}
+	if files[0].Mode().Perm() != 0600 {
+		t.Errorf("file mode = %v, want 0600", files[0].Mode().Perm())
+	}
+
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "new", name))
+	m, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("delivered file is not a message: %v", err)
+	}
+	if subject, _ := new(mime.WordDecoder).DecodeHeader(m.Header.Get("Subject")); subject != "Grüße" {
+		t.Errorf("Subject = %q, want Grüße", subject)
+	}
+	if got := m.Header.Get("Message-Id"); got != "<abc@example.test>" {
+		t.Errorf("Message-ID = %q", got)
+	}
+}
+
+func TestMaildirDeliverRaw(t *testing.T) {
+	sink, dir := newTestMaildir(t)
+
+	raw := []byte("Subject: original\r\n\r\nbody\r\n")
+	msg := &EmailMessage{Subject: "parsed", Raw: &EmailRaw{Content: raw}}
+	if err := sink.Deliver(&WebhookTarget{}, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	files := readDir(t, filepath.Join(dir, "new"))
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "new", files[0].Name()))
+	if !bytes.Equal(data, raw) {
+		t.Errorf("delivered %q, want the raw message", data)
+	}
+}
+
+func TestMaildirUniqueNames(t *testing.T) {
+	sink, dir := newTestMaildir(t)
+
+	const n = 50
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := sink.Deliver(&WebhookTarget{}, &EmailMessage{Subject: fmt.Sprint(i)}); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if got := len(readDir(t, filepath.Join(dir, "new"))); got != n {
+		t.Errorf("new/ holds %d files after %d concurrent deliveries", got, n)
+	}
+}
+
+func TestMaildirHostnameEscaping(t *testing.T) {
+	sink, _ := newTestMaildir(t)
+	if strings.ContainsAny(sink.hostname, "/:") || sink.hostname == "" {
+		t.Errorf("hostname %q cannot be used in a file name", sink.hostname)
+	}
+}
+
+func TestMaildirCommitFailure(t *testing.T) {
+	sink, dir := newTestMaildir(t)
+	os.RemoveAll(filepath.Join(dir, "new"))
+
+	err := sink.Deliver(&WebhookTarget{}, &EmailMessage{Subject: "lost"})
+	derr, ok := err.(*DeliveryError)
+	if !ok || derr.Permanent || derr.Code != "E6" {
+		t.Fatalf("Deliver() = %v, want a temporary E6", err)
+	}
+	if tmp := readDir(t, filepath.Join(dir, "tmp")); len(tmp) != 0 {
+		t.Errorf("tmp/ still holds %d files after a failed delivery", len(tmp))
+	}
+}
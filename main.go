@@ -1,18 +1,18 @@
 package main
 
 import (
-	"encoding/base64"
 	"errors"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
+	"net/http"
 	"net/mail"
+	"net/url"
+	"os"
 	"strings"
 	"time"
 
-	"github.com/alash3al/go-smtpsrv"
-	"github.com/go-resty/resty/v2"
+	"github.com/emersion/go-smtp"
 )
 
 // min returns the smaller of two integers (for Go versions < 1.21)
@@ -23,8 +23,130 @@ func min(a, b int) int {
 	return b
 }
 
+// max returns the larger of two integers (for Go versions < 1.21)
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// configureDelivery 校验投递相关参数并创建共用的 webhook 客户端
+func configureDelivery() error {
+	if *flagPayloadTemplate != "" {
+		*flagPayloadFormat = FormatTemplate
+		if _, err := loadPayloadTemplate(*flagPayloadTemplate); err != nil {
+			return err
+		}
+	}
+
+	switch *flagPayloadFormat {
+	case FormatJSON, FormatMultipart, FormatCloudEvents, FormatCloudEventsBinary:
+	case FormatTemplate:
+		if *flagPayloadTemplate == "" {
+			return fmt.Errorf("--payload-format=template requires --payload-template")
+		}
+	default:
+		return fmt.Errorf("invalid --payload-format %q, expected %s, %s, %s, %s or %s", *flagPayloadFormat,
+			FormatJSON, FormatMultipart, FormatCloudEvents, FormatCloudEventsBinary, FormatTemplate)
+	}
+
+	if !validCompression(*flagCompression) {
+		return fmt.Errorf("invalid --webhook-compression %q, expected %s, %s or %s", *flagCompression, CompressionNone, CompressionGzip, CompressionZstd)
+	}
+
+	switch *flagRecipientMode {
+	case RecipientsCombined, RecipientsSplit:
+	default:
+		return fmt.Errorf("invalid --recipient-mode %q, expected %s or %s", *flagRecipientMode, RecipientsCombined, RecipientsSplit)
+	}
+
+	switch *flagRawMessage {
+	case RawNone, RawInline:
+	case RawReference:
+		if *flagBlobStore == "" {
+			return fmt.Errorf("--raw-message=%s requires --blob-store", RawReference)
+		}
+	default:
+		return fmt.Errorf("invalid --raw-message %q, expected %s, %s or %s", *flagRawMessage, RawNone, RawInline, RawReference)
+	}
+
+	if *flagSignWithDomainSecret && (*flagSigningKey == "" || *flagRcptDomainSecret == "") {
+		return fmt.Errorf("--sign-with-domain-secret requires --signing-key and --rcpt-domain-secret")
+	}
+
+	switch *flagWebhookPolicy {
+	case PolicyAll, PolicyAny, PolicyPrimary:
+	default:
+		return fmt.Errorf("invalid --webhook-policy %q, expected %s, %s or %s", *flagWebhookPolicy, PolicyAll, PolicyAny, PolicyPrimary)
+	}
+
+	client, err := newWebhookClient("")
+	if err != nil {
+		return fmt.Errorf("cannot configure webhook client: %v", err)
+	}
+	webhookClient = client
+
+	if *flagWebhookUnixSocket != "" {
+		if err := useUnixSocket(*flagWebhookUnixSocket); err != nil {
+			return fmt.Errorf("cannot configure webhook client: %v", err)
+		}
+	}
+
+	if *flagOAuthTokenURL != "" {
+		client, err := newTokenClient()
+		if err != nil {
+			return fmt.Errorf("cannot configure OAuth2 client: %v", err)
+		}
+		tokenSource, err = NewTokenSource(client, *flagOAuthTokenURL, *flagOAuthClientID, *flagOAuthClientSecret, *flagOAuthScopes, *flagOAuthClientAuth)
+		if err != nil {
+			return err
+		}
+	}
+
+	if *flagBreakerThreshold > 0 {
+		breaker = NewCircuitBreaker(*flagBreakerThreshold, *flagBreakerCooldown)
+	}
+
+	if batchEnabled() {
+		if *flagBatchMaxItems < 1 || *flagBatchMaxBytes < 1 || *flagBatchMaxWait <= 0 {
+			return fmt.Errorf("--batch-max-items, --batch-max-bytes and --batch-max-wait must be positive")
+		}
+
+		// 批次是 JSON 数组，只支持 json 格式
+		targets := append([]*WebhookTarget{}, flagWebhooks.targets...)
+		for _, r := range flagRoutes.routes {
+			targets = append(targets, r.Targets...)
+		}
+		for _, t := range newDelivery(targets).Targets {
+			if t.Batch && t.Format != FormatJSON {
+				return fmt.Errorf("batch=on requires the json payload format, %s uses %s", t.URL, t.Format)
+			}
+		}
+
+		batcher = NewBatcher(*flagBatchMaxItems, *flagBatchMaxBytes, *flagBatchMaxWait)
+	}
+
+	return nil
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		if err := runReplay(os.Args[2:]); err != nil {
+			log.Fatalf("Replay failed: %v", err)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "schema" {
+		if err := runSchema(os.Args[2:]); err != nil {
+			log.Fatalf("Cannot write schema: %v", err)
+		}
+		return
+	}
+
 	flag.Parse()
+	rateLimiter = NewRateLimiter(*flagMaxEmailsPerMin, time.Minute)
 
 	log.Printf("Starting smtp2http server with enhanced logging and DNS TXT validation")
 	if *flagRcptDomainSecret != "" {
@@ -35,34 +157,104 @@ func main() {
 				}
 				return *flagRcptDomainSecret
 			}())
+		if *flagAllowedHookHosts == "" {
+			log.Printf("DNS TXT hook= URLs are disabled, list their hosts in --allowed-hook-hosts to enable them")
+		}
 	} else {
 		log.Printf("DNS TXT domain validation disabled")
 	}
 
-	cfg := smtpsrv.ServerConfig{
-		ReadTimeout:     time.Duration(*flagReadTimeout) * time.Second,
-		WriteTimeout:    time.Duration(*flagWriteTimeout) * time.Second,
-		ListenAddr:      *flagListenAddr,
-		MaxMessageBytes: int(*flagMaxMessageSize),
-		BannerDomain:    *flagServerName,
-		Handler: smtpsrv.HandlerFunc(func(c *smtpsrv.Context) error {
+	if err := configureDelivery(); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Webhook targets: %s (policy: %s)", newDelivery(flagWebhooks.targets).URLs(), *flagWebhookPolicy)
+	for _, r := range flagRoutes.routes {
+		log.Printf("Route: %s -> %s", r.Domain, newDelivery(r.Targets).URLs())
+	}
+
+	if *flagDedupeWindow > 0 {
+		dedupeCache = NewDedupeCache(*flagDedupeWindow, *flagDedupeMaxEntries)
+		log.Printf("Duplicate suppression enabled (window: %s, max entries: %d)", *flagDedupeWindow, *flagDedupeMaxEntries)
+	}
+
+	if *flagDeadLetterDir != "" {
+		store, err := NewDeadLetterStore(*flagDeadLetterDir)
+		if err != nil {
+			log.Fatalf("Cannot open dead-letter directory: %v", err)
+		}
+		deadLetters = store
+		log.Printf("Dead letters are kept in %s", *flagDeadLetterDir)
+	}
+
+	switch *flagBlobStore {
+	case "":
+	case "local":
+		store, err := NewLocalBlobStore(*flagBlobDir, *flagBlobBaseURL, *flagBlobSecret, *flagBlobURLTTL)
+		if err != nil {
+			log.Fatalf("Cannot open blob store: %v", err)
+		}
+		blobStore = store
+
+		handler := http.Handler(store)
+		if u, err := url.Parse(*flagBlobBaseURL); err == nil && strings.Trim(u.Path, "/") != "" {
+			handler = http.StripPrefix(strings.TrimSuffix(u.Path, "/"), handler)
+		}
+		go func() {
+			log.Fatal(http.ListenAndServe(*flagBlobListen, handler))
+		}()
+		log.Printf("Local blob store at %s served on %s as %s", *flagBlobDir, *flagBlobListen, *flagBlobBaseURL)
+	case "s3":
+		store, err := NewS3BlobStore(*flagS3Endpoint, *flagS3Region, *flagS3Bucket, *flagS3AccessKey, *flagS3SecretKey, *flagS3PathStyle, *flagBlobURLTTL)
+		if err != nil {
+			log.Fatalf("Cannot open blob store: %v", err)
+		}
+		blobStore = store
+		log.Printf("S3 blob store: bucket %s at %s", *flagS3Bucket, *flagS3Endpoint)
+	default:
+		log.Fatalf("Invalid --blob-store %q, expected local or s3", *flagBlobStore)
+	}
+
+	if *flagSpoolDir != "" {
+		var err error
+		spool, err = NewSpool(*flagSpoolDir, *flagSpoolMaxAge, *flagSpoolRetryMin, *flagSpoolRetryMax,
+			func(entry *SpoolEntry) error {
+				return deliverAll(entry.Delivery, entry.Message)
+			})
+		if err != nil {
+			log.Fatalf("Cannot open spool: %v", err)
+		}
+		// 每个 worker 阻塞等待所在批次的结果，worker 数少于批次大小时批次永远凑不满
+		workers := *flagSpoolWorkers
+		if batcher != nil && workers < *flagBatchMaxItems {
+			log.Printf("SPOOL: Raising workers from %d to %d to fill batches", workers, *flagBatchMaxItems)
+			workers = *flagBatchMaxItems
+		}
+		spool.Start(workers)
+		log.Printf("Spool enabled at %s (workers: %d, max age: %s)", *flagSpoolDir, workers, *flagSpoolMaxAge)
+	}
+
+	server, err := newSMTPServer(&Backend{
+		handler: func(c *Session) error {
 			// 获取客户端信息
-			clientIP := GetClientIP(c.RemoteAddr().String())
-			recipientEmail := c.To().Address
+			clientIP := c.ClientIP()
+			recipients := c.Recipients()
+			recipientEmail := recipientList(recipients)
 			senderEmail := c.From().Address
 
-			log.Printf("SMTP: New connection from %s, MAIL FROM: %s, RCPT TO: %s", clientIP, senderEmail, recipientEmail)
+			log.Printf("SMTP: New message from %s, MAIL FROM: %s, RCPT TO: %s", clientIP, senderEmail, recipientEmail)
 
-			// DNS TXT 记录域名验证（在解析邮件内容之前进行）
-			if *flagRcptDomainSecret != "" {
-				log.Printf("SMTP: Performing DNS TXT validation for recipient domain")
-				dnsCheck := ValidateRecipientDomainDNS(recipientEmail, *flagRcptDomainSecret)
-				if !dnsCheck.Allowed {
-					log.Printf("SMTP: DNS TXT validation failed: %s (From: %s, To: %s, IP: %s)",
-						dnsCheck.Reason, senderEmail, recipientEmail, clientIP)
-					return errors.New("Domain not authorized: " + dnsCheck.Reason)
+			// 投递计划相同的收件人合并为一个请求，--recipient-mode=split 时每个收件人一个请求
+			groups := groupRecipients(recipients, *flagRecipientMode)
+
+			// 同步投递时 webhook 已熔断则直接临时拒绝，让发送方稍后重试
+			if spool == nil && groupsBlocked(groups) {
+				log.Printf("SMTP: Webhook circuit open, deferring message (From: %s, To: %s, IP: %s)",
+					senderEmail, recipientEmail, clientIP)
+				return &smtp.SMTPError{
+					Code:         451,
+					EnhancedCode: smtp.EnhancedCode{4, 4, 1},
+					Message:      "Destination temporarily unavailable, please try again later",
 				}
-				log.Printf("SMTP: DNS TXT validation passed: %s", dnsCheck.Reason)
 			}
 
 			log.Printf("SMTP: Parsing email message")
@@ -84,10 +276,8 @@ func main() {
 
 			// 执行安全检查（在解析附件之前进行基础检查）
 			log.Printf("SMTP: Performing security checks")
-			allowed, reason, score := PerformSecurityChecks(
-				clientIP,
+			allowed, reason, score, checks := PerformSecurityChecks(
 				senderEmail,
-				recipientEmail,
 				msg.Subject,
 				string(msg.TextBody),
 				spfResult.String(),
@@ -100,20 +290,27 @@ func main() {
 				return errors.New("Email rejected: " + reason)
 			}
 			log.Printf("SMTP: Security checks passed (Score: %d)", score)
+			checks = append([]*EmailSecurityCheck{c.RateLimit()}, checks...)
 
 			log.Printf("SMTP: Building email message structure")
 			jsonData := EmailMessage{
+				SchemaVersion: PayloadSchemaVersion,
 				ID:            msg.MessageID,
 				Date:          msg.Date.String(),
 				References:    msg.References,
 				SPFResult:     spfResult.String(),
+				SecurityScore: score,
+				Security:      securityReport(checks),
 				ResentDate:    msg.ResentDate.String(),
 				ResentID:      msg.ResentMessageID,
 				Subject:       msg.Subject,
+				Envelope:      c.Envelope(),
+				Session:       c.Info(),
 				Attachments:   []*EmailAttachment{},
 				EmbeddedFiles: []*EmailEmbeddedFile{},
 			}
 
+			jsonData.Headers = c.Headers()
 			jsonData.Body.HTML = string(msg.HTMLBody)
 			jsonData.Body.Text = string(msg.TextBody)
 
@@ -129,22 +326,9 @@ func main() {
 				jsonData.Addresses.From = transformStdAddressToEmailAddress([]*mail.Address{c.From()})[0]
 				log.Printf("SMTP: Using envelope From address: %s", jsonData.Addresses.From.Address)
 			}
-			jsonData.Addresses.To = transformStdAddressToEmailAddress([]*mail.Address{c.To()})[0]
+			jsonData.Addresses.To = &EmailAddress{Address: recipients[0].Address}
 			log.Printf("SMTP: To address: %s", jsonData.Addresses.To.Address)
 
-			// 检查传统域名限制（向后兼容）
-			toSplited := strings.Split(jsonData.Addresses.To.Address, "@")
-			if len(*flagDomain) > 0 && (len(toSplited) < 2 || toSplited[1] != *flagDomain) {
-				log.Printf("SMTP: Domain restriction failed - expected: %s, got: %s",
-					*flagDomain, func() string {
-						if len(toSplited) >= 2 {
-							return toSplited[1]
-						}
-						return "invalid"
-					}())
-				return errors.New("Unauthorized TO domain")
-			}
-
 			jsonData.Addresses.Cc = transformStdAddressToEmailAddress(msg.Cc)
 			jsonData.Addresses.Bcc = transformStdAddressToEmailAddress(msg.Bcc)
 			jsonData.Addresses.ReplyTo = transformStdAddressToEmailAddress(msg.ReplyTo)
@@ -161,7 +345,8 @@ func main() {
 			// 处理附件
 			log.Printf("SMTP: Processing %d attachments", len(msg.Attachments))
 			for i, a := range msg.Attachments {
-				data, err := ioutil.ReadAll(a.Data)
+				data, err := readPart(a.Data)
+				a.Data = nil // 解析器的缓冲不再需要，只保留一份内容
 				if err != nil {
 					log.Printf("SMTP: Failed to read attachment %d (%s): %v", i+1, a.Filename, err)
 					return errors.New("Failed to process attachment: " + a.Filename)
@@ -170,8 +355,7 @@ func main() {
 				attachment := &EmailAttachment{
 					Filename:    a.Filename,
 					ContentType: a.ContentType,
-					Data:        base64.StdEncoding.EncodeToString(data),
-					Content:     data, // 用于安全检查
+					Content:     data, // 用于安全检查，序列化时再编码为 base64
 				}
 				jsonData.Attachments = append(jsonData.Attachments, attachment)
 				log.Printf("SMTP: Processed attachment %d: %s (%s, %d bytes)",
@@ -181,18 +365,23 @@ func main() {
 			// 执行附件安全检查
 			if len(jsonData.Attachments) > 0 {
 				log.Printf("SMTP: Performing attachment security checks")
-				if attachCheck := CheckAttachments(jsonData.Attachments); !attachCheck.Allowed {
+				attachCheck := CheckAttachments(jsonData.Attachments)
+				if !attachCheck.Allowed {
 					log.Printf("SMTP: Attachment security check failed: %s (From: %s, To: %s)",
 						attachCheck.Reason, senderEmail, recipientEmail)
 					return errors.New("Email rejected: " + attachCheck.Reason)
 				}
+				checks = append(checks, attachCheck.Result(CheckNameAttachments))
+				jsonData.Security = securityReport(checks)
+				jsonData.SecurityScore = jsonData.Security.Score
 				log.Printf("SMTP: Attachment security checks passed")
 			}
 
 			// 处理嵌入文件
 			log.Printf("SMTP: Processing %d embedded files", len(msg.EmbeddedFiles))
 			for i, a := range msg.EmbeddedFiles {
-				data, err := ioutil.ReadAll(a.Data)
+				data, err := readPart(a.Data)
+				a.Data = nil
 				if err != nil {
 					log.Printf("SMTP: Failed to read embedded file %d (CID: %s): %v", i+1, a.CID, err)
 					return errors.New("Failed to process embedded file: " + a.CID)
@@ -201,57 +390,53 @@ func main() {
 				jsonData.EmbeddedFiles = append(jsonData.EmbeddedFiles, &EmailEmbeddedFile{
 					CID:         a.CID,
 					ContentType: a.ContentType,
-					Data:        base64.StdEncoding.EncodeToString(data),
+					Content:     data,
 				})
 				log.Printf("SMTP: Processed embedded file %d: CID=%s (%s, %d bytes)",
 					i+1, a.CID, a.ContentType, len(data))
 			}
 
-			// 准备 webhook 请求
-			log.Printf("SMTP: Preparing webhook request to %s", *flagWebhook)
-			req := resty.New().R().SetHeader("Content-Type", "application/json").SetBody(jsonData)
-
-			// Add API key header if provided (for cloud-mail inbound authentication)
-			if *flagInboundKey != "" {
-				req.SetHeader("X-Inbound-Key", *flagInboundKey)
-				log.Printf("SMTP: Adding API key header: %s...", (*flagInboundKey)[:min(8, len(*flagInboundKey))])
-			}
-
-			// 记录邮件接受信息
-			log.Printf("SMTP: Email accepted for processing - From=%s, To=%s, Subject=%s, IP=%s, SPF=%s, Score=%d",
-				senderEmail, recipientEmail, msg.Subject, clientIP, spfResult.String(), score)
-
-			// 发送 webhook 请求
-			log.Printf("WEBHOOK: Sending POST request to %s", *flagWebhook)
-			resp, err := req.Post(*flagWebhook)
-			if err != nil {
-				log.Printf("WEBHOOK: Request failed - %v (From: %s, To: %s)", err, senderEmail, recipientEmail)
-				return errors.New("E1: Cannot accept your message due to internal error, please report that to our engineers")
+			// 原始邮件
+			if jsonData.Raw = c.Raw(); jsonData.Raw != nil {
+				log.Printf("SMTP: Raw message: %d bytes, sha256 %s...", jsonData.Raw.Size, jsonData.Raw.SHA256[:12])
+				if jsonData.Raw.Omitted {
+					log.Printf("SMTP: Raw message exceeds --raw-max-size (%d bytes), sending only its size and hash", *flagRawMaxSize)
+				}
 			}
 
-			log.Printf("WEBHOOK: Received response - Status: %d, Size: %d bytes",
-				resp.StatusCode(), len(resp.Body()))
-
-			if resp.StatusCode() != 200 {
-				log.Printf("WEBHOOK: Non-200 status received - %s, Body: %s (From: %s, To: %s)",
-					resp.Status(), string(resp.Body()), senderEmail, recipientEmail)
-				return errors.New("E2: Cannot accept your message due to internal error, please report that to our engineers")
+			// SMTP 客户端超时后重发的同一封邮件只确认，不再转发；多收件人时只跳过已经接受过的收件人
+			if groups = pendingGroups(groups, &jsonData, c.From().Address); len(groups) == 0 {
+				log.Printf("SMTP: Duplicate of an accepted message, acknowledging without redelivery (From: %s, To: %s)",
+					senderEmail, recipientEmail)
+				return nil
 			}
 
-			// 检查响应内容是否包含错误信息
-			responseBody := string(resp.Body())
-			if strings.Contains(responseBody, `"code":403`) || strings.Contains(responseBody, `"code":400`) {
-				log.Printf("WEBHOOK: Application-level rejection - %s (From: %s, To: %s)",
-					responseBody, senderEmail, recipientEmail)
-				return errors.New("Email rejected by destination server")
+			// 将附件写入外部存储，payload 中只保留链接
+			if blobStore != nil {
+				if err := offloadFiles(blobStore, &jsonData); err != nil {
+					log.Printf("BLOB: %v (From: %s, To: %s)", err, senderEmail, recipientEmail)
+					return &smtp.SMTPError{
+						Code:         451,
+						EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+						Message:      "E4: Cannot accept your message due to internal error, please try again later",
+					}
+				}
 			}
 
-			log.Printf("WEBHOOK: Email successfully processed and forwarded to %s (From: %s, To: %s)",
-				*flagWebhook, senderEmail, recipientEmail)
+			// 记录邮件接受信息
+			log.Printf("SMTP: Email accepted for processing - From=%s, To=%s, Subject=%s, IP=%s, SPF=%s, Score=%d",
+				senderEmail, recipientEmail, msg.Subject, clientIP, spfResult.String(), score)
 
-			return nil
-		}),
+			return deliverGroups(groups, &jsonData, senderEmail)
+		},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if server.TLSConfig != nil {
+		log.Printf("SMTP: STARTTLS enabled")
 	}
 
-	fmt.Println(smtpsrv.ListenAndServe(&cfg))
+	log.Printf("SMTP: Listening on %s", server.Addr)
+	log.Fatal(server.ListenAndServe())
 }
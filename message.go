@@ -1,5 +1,9 @@
 package main
 
+import (
+	"encoding/json"
+)
+
 // EmailAddress ...
 type EmailAddress struct {
 	Name    string `json:"name,omitempty"`
@@ -10,29 +14,99 @@ type EmailAddress struct {
 type EmailAttachment struct {
 	Filename    string `json:"filename"`
 	ContentType string `json:"content_type"`
-	Data        string `json:"data"`
-	Content     []byte `json:"-"` // 用于安全检查，不序列化到JSON
+	Data        string `json:"data,omitempty"`   // 只在从磁盘恢复时有值，收到的邮件只保留 Content，序列化时再编码
+	Part        string `json:"part,omitempty"`   // multipart 模式下对应的文件部分名称
+	URL         string `json:"url,omitempty"`    // 存入外部存储后的下载地址，此时不再携带 data
+	Size        int    `json:"size,omitempty"`   // 存入外部存储时的原始大小
+	SHA256      string `json:"sha256,omitempty"` // 存入外部存储时的内容哈希
+	Content     []byte `json:"-"`                // 用于安全检查，不序列化到JSON
 }
 
 // EmailEmbeddedFile ...
 type EmailEmbeddedFile struct {
 	CID         string `json:"cid"`
 	ContentType string `json:"content_type"`
-	Data        string `json:"data"`
+	Data        string `json:"data,omitempty"`
+	Part        string `json:"part,omitempty"` // multipart 模式下对应的文件部分名称
+	URL         string `json:"url,omitempty"`
+	Size        int    `json:"size,omitempty"`
+	SHA256      string `json:"sha256,omitempty"`
+	Content     []byte `json:"-"`
+}
+
+// EmailRaw 按 DATA 收到的原始邮件，见 --raw-message
+type EmailRaw struct {
+	Size    int64  `json:"size"`
+	SHA256  string `json:"sha256"`
+	Data    string `json:"data,omitempty"`    // 同 EmailAttachment，只在从磁盘恢复时有值
+	Part    string `json:"part,omitempty"`    // multipart 模式下对应的文件部分名称
+	URL     string `json:"url,omitempty"`     // reference 模式下的下载地址
+	Omitted bool   `json:"omitted,omitempty"` // 超过 --raw-max-size，只提供大小和 sha256
+	Content []byte `json:"-"`
+}
+
+// EmailEnvelope SMTP 信封，不受邮件头中地址的影响
+type EmailEnvelope struct {
+	MailFrom string   `json:"mail_from"`
+	RcptTo   []string `json:"rcpt_to"` // 本次请求对应的信封收件人，与 recipients 相同
+}
+
+// EmailSession 收到邮件的 SMTP 会话
+type EmailSession struct {
+	ClientIP   string    `json:"client_ip"`
+	RemoteAddr string    `json:"remote_addr"`
+	ReverseDNS string    `json:"reverse_dns,omitempty"` // 客户端 IP 的 PTR 记录，见 --reverse-dns
+	Helo       string    `json:"helo,omitempty"`        // HELO/EHLO 中的主机名
+	TLS        *EmailTLS `json:"tls,omitempty"`         // 未使用 STARTTLS 时为空
+	ListenAddr string    `json:"listen_addr"`           // 接收连接的本地地址
+	ReceivedAt string    `json:"received_at"`           // 开始接收 DATA 的时间，RFC 3339 UTC
+}
+
+// EmailTLS STARTTLS 协商的结果
+type EmailTLS struct {
+	Version     string `json:"version"`
+	CipherSuite string `json:"cipher_suite"`
+	ServerName  string `json:"server_name,omitempty"` // 客户端发送的 SNI
+}
+
+// EmailSecurity 安全检查的结论和各项检查的明细，只包含通过的检查，未通过时邮件已被拒收
+type EmailSecurity struct {
+	Score         int                   `json:"score"`
+	Threshold     int                   `json:"threshold"`      // 达到该分数拒收，--spam-reject-score
+	FlagThreshold int                   `json:"flag_threshold"` // 达到该分数标记为垃圾邮件，--spam-flag-score
+	Flagged       bool                  `json:"flagged"`        // 同 X-Spam-Flag 请求头
+	Checks        []*EmailSecurityCheck `json:"checks"`
+}
+
+// EmailSecurityCheck 一项安全检查
+type EmailSecurityCheck struct {
+	Name      string `json:"name"`
+	Recipient string `json:"recipient,omitempty"` // RCPT 阶段按收件人执行的检查
+	Score     int    `json:"score"`
+	Reason    string `json:"reason"`
+	Threshold string `json:"threshold,omitempty"` // 检查使用的限制，未配置时为空
 }
 
 // EmailMessage ...
 type EmailMessage struct {
+	SchemaVersion string `json:"schema_version"` // 见 PayloadSchemaVersion 和 `smtp2http schema`
+
 	References []string `json:"references,omitempty"`
 	SPFResult  string   `json:"spf,omitempty"`
 
-	ID      string `json:"id,omitempty"`
-	Date    string `json:"date,omitempty"`
-	Subject string `json:"subject,omitempty"`
+	SecurityScore int            `json:"security_score,omitempty"` // 安全检查的可疑度评分，越高越可疑
+	Security      *EmailSecurity `json:"security,omitempty"`       // 评分明细
+
+	ID             string `json:"id,omitempty"`
+	IdempotencyKey string `json:"idempotency_key,omitempty"` // 同时作为 Idempotency-Key 请求头发送
+	Date           string `json:"date,omitempty"`
+	Subject        string `json:"subject,omitempty"`
 
 	ResentDate string `json:"resent_date,omitempty"`
 	ResentID   string `json:"resent_id,omitempty"`
 
+	Headers []*EmailHeader `json:"headers,omitempty"` // 全部邮件头，按原始顺序，见 --header-allow 和 --header-deny
+
 	Body struct {
 		Text string `json:"text,omitempty"`
 		HTML string `json:"html,omitempty"`
@@ -52,6 +126,58 @@ type EmailMessage struct {
 		ResentBcc  []*EmailAddress `json:"resent_bcc,omitempty"`
 	} `json:"addresses"`
 
+	Recipients []string `json:"recipients,omitempty"` // 本次请求对应的全部信封收件人，addresses.to 为其中第一个
+
+	Envelope *EmailEnvelope `json:"envelope,omitempty"`
+	Session  *EmailSession  `json:"session,omitempty"`
+
+	Raw *EmailRaw `json:"raw,omitempty"`
+
 	Attachments   []*EmailAttachment   `json:"attachments,omitempty"`
 	EmbeddedFiles []*EmailEmbeddedFile `json:"embedded_files,omitempty"`
 }
+
+// File 附件内容，见 FileContent
+func (a *EmailAttachment) File() FileContent {
+	return FileContent{content: a.Content, data: a.Data}
+}
+
+// File 内嵌文件内容，见 FileContent
+func (e *EmailEmbeddedFile) File() FileContent {
+	return FileContent{content: e.Content, data: e.Data}
+}
+
+// File 原始邮件内容，见 FileContent
+func (r *EmailRaw) File() FileContent {
+	return FileContent{content: r.Content, data: r.Data}
+}
+
+// MarshalJSON 收到的附件只在内存中保留一份原始内容，data 在序列化时才编码
+func (a *EmailAttachment) MarshalJSON() ([]byte, error) {
+	type plain EmailAttachment
+	c := plain(*a)
+	if c.URL == "" {
+		c.Data = a.File().Base64()
+	}
+	return json.Marshal(&c)
+}
+
+// MarshalJSON 同 EmailAttachment
+func (e *EmailEmbeddedFile) MarshalJSON() ([]byte, error) {
+	type plain EmailEmbeddedFile
+	c := plain(*e)
+	if c.URL == "" {
+		c.Data = e.File().Base64()
+	}
+	return json.Marshal(&c)
+}
+
+// MarshalJSON 同 EmailAttachment，超过大小上限的原始邮件没有内容
+func (r *EmailRaw) MarshalJSON() ([]byte, error) {
+	type plain EmailRaw
+	c := plain(*r)
+	if c.URL == "" {
+		c.Data = r.File().Base64()
+	}
+	return json.Marshal(&c)
+}
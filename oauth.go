@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// oauthExpiryMargin 令牌到期前提前刷新，避免请求途中过期
+const oauthExpiryMargin = 30 * time.Second
+
+// TokenSource OAuth2 client credentials 令牌，缓存到过期前，过期或被 webhook 拒绝后重新获取
+type TokenSource struct {
+	client       *resty.Client
+	tokenURL     string
+	clientID     string
+	clientSecret string
+	scopes       []string
+	authInBody   bool
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time // 零值表示令牌服务未给出有效期，一直使用到被拒绝
+}
+
+// NewTokenSource 创建令牌来源，authStyle 为 basic（HTTP Basic 认证）或 post（放在请求体中）
+func NewTokenSource(client *resty.Client, tokenURL, clientID, clientSecret, scopes, authStyle string) (*TokenSource, error) {
+	if u, err := url.Parse(tokenURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid --oauth-token-url %q", tokenURL)
+	}
+
+	if clientID == "" || clientSecret == "" {
+		return nil, fmt.Errorf("--oauth-client-id and --oauth-client-secret are required")
+	}
+
+	if authStyle != "basic" && authStyle != "post" {
+		return nil, fmt.Errorf("invalid --oauth-client-auth %q, expected basic or post", authStyle)
+	}
+
+	return &TokenSource{
+		client:       client,
+		tokenURL:     tokenURL,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		scopes:       strings.FieldsFunc(scopes, func(r rune) bool { return r == ',' || r == ' ' }),
+		authInBody:   authStyle == "post",
+	}, nil
+}
+
+// Token 返回有效的访问令牌，需要时向令牌服务请求新的令牌
+func (t *TokenSource) Token() (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.token != "" && (t.expiry.IsZero() || time.Now().Add(oauthExpiryMargin).Before(t.expiry)) {
+		return t.token, nil
+	}
+
+	token, expiresIn, err := t.fetch()
+	if err != nil {
+		return "", err
+	}
+
+	t.token = token
+	t.expiry = time.Time{}
+	if expiresIn > 0 {
+		t.expiry = time.Now().Add(time.Duration(expiresIn) * time.Second)
+	}
+
+	log.Printf("OAUTH: Obtained access token from %s (expires in %ds)", t.tokenURL, expiresIn)
+	return t.token, nil
+}
+
+// Invalidate 丢弃被 webhook 拒绝的令牌；其他请求已经换过新令牌时不做处理
+func (t *TokenSource) Invalidate(token string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.token == token {
+		t.token = ""
+	}
+}
+
+// fetch 按 RFC 6749 4.4 请求令牌
+func (t *TokenSource) fetch() (string, int64, error) {
+	form := map[string]string{"grant_type": "client_credentials"}
+	if len(t.scopes) > 0 {
+		form["scope"] = strings.Join(t.scopes, " ")
+	}
+
+	req := t.client.R().SetHeader("Accept", "application/json")
+	if t.authInBody {
+		form["client_id"] = t.clientID
+		form["client_secret"] = t.clientSecret
+	} else {
+		// RFC 6749 2.3.1 要求先对 ID 和密钥做 form 编码
+		req.SetBasicAuth(url.QueryEscape(t.clientID), url.QueryEscape(t.clientSecret))
+	}
+
+	resp, err := req.SetFormData(form).Post(t.tokenURL)
+	if err != nil {
+		return "", 0, fmt.Errorf("token request failed: %v", err)
+	}
+
+	var body struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int64  `json:"expires_in"`
+		Error       string `json:"error"`
+		Description string `json:"error_description"`
+	}
+	json.Unmarshal(resp.Body(), &body)
+
+	if resp.StatusCode() != http.StatusOK || body.AccessToken == "" {
+		if body.Error != "" {
+			return "", 0, fmt.Errorf("token request rejected - %s: %s %s", resp.Status(), body.Error, body.Description)
+		}
+		return "", 0, fmt.Errorf("token request rejected - %s", resp.Status())
+	}
+
+	if body.TokenType != "" && !strings.EqualFold(body.TokenType, "bearer") {
+		return "", 0, fmt.Errorf("unsupported token type %q", body.TokenType)
+	}
+
+	return body.AccessToken, body.ExpiresIn, nil
+}
+
+// newTokenClient 令牌请求使用的 HTTP 客户端，与 webhook 共用 TLS 配置，但不经过 --webhook-unix-socket
+func newTokenClient() (*resty.Client, error) {
+	tlsConfig, err := newWebhookTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+
+	if *flagWebhookProxy != "" {
+		proxy, err := url.Parse(*flagWebhookProxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL: %v", err)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	return resty.NewWithClient(&http.Client{Transport: transport, Timeout: *flagWebhookTimeout}), nil
+}
+
+// 全局令牌来源，未配置 --oauth-token-url 时为 nil
+var tokenSource *TokenSource
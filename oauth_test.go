@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// tokenServer 模拟令牌服务，每次请求发放 tok-1、tok-2……，expires_in 由 expiresIn 指定
+type tokenServer struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	fetches   int
+	expiresIn int
+	requests  []*http.Request
+}
+
+func newTokenServer(t *testing.T, expiresIn int) *tokenServer {
+	s := &tokenServer{expiresIn: expiresIn}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+
+		s.mu.Lock()
+		s.fetches++
+		n := s.fetches
+		s.requests = append(s.requests, r)
+		s.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token":"tok-%d","token_type":"Bearer","expires_in":%d}`, n, s.expiresIn)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *tokenServer) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.fetches
+}
+
+func newTestTokenSource(t *testing.T, tokenURL, authStyle string) *TokenSource {
+	t.Helper()
+	ts, err := NewTokenSource(resty.New(), tokenURL, "smtp2http client", "s3cret&=", "inbound.write, inbound.read", authStyle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ts
+}
+
+func TestTokenSourceCaching(t *testing.T) {
+	tests := []struct {
+		name      string
+		expiresIn int
+		fetches   int // 三次 Token() 之后的请求数
+	}{
+		{"cached until expiry", 3600, 1},
+		{"no expiry given", 0, 1},
+		{"expires within the margin", 10, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTokenServer(t, tt.expiresIn)
+			ts := newTestTokenSource(t, srv.URL, "basic")
+
+			for i := 0; i < 3; i++ {
+				if _, err := ts.Token(); err != nil {
+					t.Fatalf("Token() = %v", err)
+				}
+			}
+			if got := srv.count(); got != tt.fetches {
+				t.Errorf("%d token requests, want %d", got, tt.fetches)
+			}
+		})
+	}
+}
+
+func TestTokenSourceInvalidate(t *testing.T) {
+	srv := newTokenServer(t, 3600)
+	ts := newTestTokenSource(t, srv.URL, "basic")
+
+	first, _ := ts.Token()
+	ts.Invalidate(first)
+	second, _ := ts.Token()
+	if first != "tok-1" || second != "tok-2" {
+		t.Fatalf("tokens %s, %s, want tok-1 then tok-2", first, second)
+	}
+
+	// 另一个请求拿着旧令牌失败时，不丢弃已经换过的新令牌
+	ts.Invalidate(first)
+	if third, _ := ts.Token(); third != "tok-2" || srv.count() != 2 {
+		t.Errorf("Token() after invalidating a stale token = %s with %d fetches, want tok-2 with 2", third, srv.count())
+	}
+}
+
+func TestTokenSourceClientAuth(t *testing.T) {
+	srv := newTokenServer(t, 3600)
+
+	basic := newTestTokenSource(t, srv.URL, "basic")
+	basic.Token()
+	post := newTestTokenSource(t, srv.URL, "post")
+	post.Token()
+
+	r := srv.requests[0]
+	user, pass, ok := r.BasicAuth()
+	if !ok || user != "smtp2http+client" || pass != "s3cret%26%3D" {
+		t.Errorf("basic auth = %q, %q, want the form-encoded client ID and secret", user, pass)
+	}
+	if r.PostForm.Get("client_secret") != "" {
+		t.Error("basic auth also sent client_secret in the body")
+	}
+	if got := r.PostForm.Get("grant_type"); got != "client_credentials" {
+		t.Errorf("grant_type = %s", got)
+	}
+	if got := r.PostForm.Get("scope"); got != "inbound.write inbound.read" {
+		t.Errorf("scope = %q, want space-separated scopes", got)
+	}
+
+	r = srv.requests[1]
+	if _, _, ok := r.BasicAuth(); ok {
+		t.Error("post auth also sent an Authorization header")
+	}
+	if r.PostForm.Get("client_id") != "smtp2http client" || r.PostForm.Get("client_secret") != "s3cret&=" {
+		t.Errorf("post auth form = %v", r.PostForm)
+	}
+}
+
+func TestTokenSourceErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		want   string
+	}{
+		{"rejected client", http.StatusUnauthorized, `{"error":"invalid_client","error_description":"unknown client"}`, "invalid_client"},
+		{"server error", http.StatusBadGateway, `<html>`, "502"},
+		{"missing token", http.StatusOK, `{"token_type":"Bearer"}`, "rejected"},
+		{"unsupported type", http.StatusOK, `{"access_token":"x","token_type":"mac"}`, "unsupported token type"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				fmt.Fprint(w, tt.body)
+			}))
+			defer srv.Close()
+
+			_, err := newTestTokenSource(t, srv.URL, "basic").Token()
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Token() = %v, want an error mentioning %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewTokenSource(t *testing.T) {
+	tests := []struct {
+		url, id, secret, auth string
+	}{
+		{"ftp://auth.test/token", "id", "secret", "basic"},
+		{"https:///token", "id", "secret", "basic"},
+		{"https://auth.test/token", "", "secret", "basic"},
+		{"https://auth.test/token", "id", "", "basic"},
+		{"https://auth.test/token", "id", "secret", "jwt"},
+	}
+
+	for _, tt := range tests {
+		if _, err := NewTokenSource(resty.New(), tt.url, tt.id, tt.secret, "", tt.auth); err == nil {
+			t.Errorf("NewTokenSource(%+v) succeeded", tt)
+		}
+	}
+}
+
+// useTokenSource 在测试期间使用 tokenURL 的令牌服务
+func useTokenSource(t *testing.T, tokenURL string) {
+	t.Helper()
+	old := tokenSource
+	t.Cleanup(func() { tokenSource = old })
+	tokenSource = newTestTokenSource(t, tokenURL, "basic")
+}
+
+func TestExchangeWebhookRefreshesTokenOn401(t *testing.T) {
+	tests := []struct {
+		name     string
+		rejected string // webhook 拒绝的令牌，"*" 表示全部拒绝
+		oauth    bool
+		status   int
+		auth     []string // webhook 依次收到的 Authorization
+		fetches  int
+	}{
+		{"expired token is refreshed once", "Bearer tok-1", true, http.StatusOK, []string{"Bearer tok-1", "Bearer tok-2"}, 2},
+		{"valid token", "", true, http.StatusOK, []string{"Bearer tok-1"}, 1},
+		{"single retry", "*", true, http.StatusUnauthorized, []string{"Bearer tok-1", "Bearer tok-2"}, 2},
+		{"oauth=off target", "*", false, http.StatusUnauthorized, []string{""}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens := newTokenServer(t, 3600)
+			useTokenSource(t, tokens.URL)
+
+			var mu sync.Mutex
+			auth := []string{}
+			hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got := r.Header.Get("Authorization")
+				mu.Lock()
+				auth = append(auth, got)
+				mu.Unlock()
+
+				if tt.rejected == "*" || got == tt.rejected {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				fmt.Fprint(w, `{"action":"accept"}`)
+			}))
+			defer hook.Close()
+
+			target := &WebhookTarget{URL: hook.URL, Format: FormatJSON, OAuth: tt.oauth}
+			payload, _ := encodePayload(target, &EmailMessage{Subject: "oauth"})
+
+			resp, err := exchangeWebhook(target, payload)
+			if err != nil {
+				t.Fatalf("exchangeWebhook() = %v", err)
+			}
+			if resp.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if strings.Join(auth, "|") != strings.Join(tt.auth, "|") {
+				t.Errorf("webhook received Authorization %q, want %q", auth, tt.auth)
+			}
+			if got := tokens.count(); got != tt.fetches {
+				t.Errorf("%d token requests, want %d", got, tt.fetches)
+			}
+		})
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/textproto"
+	"strings"
+)
+
+// webhook 请求体格式
+const (
+	FormatJSON      = "json"
+	FormatMultipart = "multipart"
+	FormatTemplate  = "template" // 使用 --payload-template 渲染，见 template.go
+	// FormatCloudEvents 和 FormatCloudEventsBinary 见 cloudevents.go
+)
+
+// Payload 编码后的请求。请求体不预先生成，每次发送时由 write 流式写出，
+// write 可以重复调用且每次输出相同的字节，以便先计算长度和签名再发送
+type Payload struct {
+	ContentType    string
+	Headers        map[string]string
+	IdempotencyKey string
+	Security       *EmailSecurity // 以 X-Spam-Score 和 X-Spam-Flag 请求头发送
+
+	write func(w io.Writer) error
+	size  int64 // 未压缩的请求体大小，-1 表示尚未计算
+}
+
+// newPayload 创建流式请求体
+func newPayload(contentType string, write func(w io.Writer) error) *Payload {
+	return &Payload{ContentType: contentType, write: write, size: -1}
+}
+
+// WriteBody 将请求体写入 w
+func (p *Payload) WriteBody(w io.Writer) error {
+	return p.write(w)
+}
+
+// Size 未压缩的请求体大小，第一次调用时空跑一遍编码得出
+func (p *Payload) Size() (int64, error) {
+	if p.size < 0 {
+		counter := &countingWriter{}
+		if err := p.write(counter); err != nil {
+			return 0, err
+		}
+		p.size = counter.n
+	}
+	return p.size, nil
+}
+
+// staticBody 已经在内存中生成的请求体
+func staticBody(body []byte) func(w io.Writer) error {
+	return func(w io.Writer) error {
+		_, err := w.Write(body)
+		return err
+	}
+}
+
+// encodePayload 按目标的格式准备请求体
+func encodePayload(target *WebhookTarget, msg *EmailMessage) (*Payload, error) {
+	var payload *Payload
+
+	switch target.Format {
+	case FormatMultipart:
+		// 每次写出都使用同一个 boundary，保证多次输出一致
+		mw := multipart.NewWriter(ioutil.Discard)
+		boundary := mw.Boundary()
+		payload = newPayload(mw.FormDataContentType(), func(w io.Writer) error {
+			return writeMultipart(w, msg, boundary)
+		})
+	case FormatTemplate:
+		var err error
+		if payload, err = renderTemplate(target.Template, msg); err != nil {
+			return nil, err
+		}
+	case FormatCloudEvents:
+		event := newCloudEvent(msg)
+		payload = newPayload("application/cloudevents+json", func(w io.Writer) error {
+			return writeCloudEvent(w, event, msg)
+		})
+	case FormatCloudEventsBinary:
+		payload = newPayload("application/json", func(w io.Writer) error {
+			return writeMessageJSON(w, msg)
+		})
+		payload.Headers = newCloudEvent(msg).headers()
+	default:
+		payload = newPayload("application/json", func(w io.Writer) error {
+			return writeMessageJSON(w, msg)
+		})
+	}
+
+	payload.IdempotencyKey = msg.IdempotencyKey
+	payload.Security = msg.Security
+	return payload, nil
+}
+
+// writeMultipart 写出 multipart/form-data 请求体：
+// "message" 部分是去掉 data 的 JSON 元数据，原始邮件、每个附件和内嵌文件各自是一个二进制文件部分，
+// 元数据中的 part 字段指向对应的部分名称
+func writeMultipart(dst io.Writer, msg *EmailMessage, boundary string) error {
+	meta := *msg
+	meta.Attachments = make([]*EmailAttachment, len(msg.Attachments))
+	meta.EmbeddedFiles = make([]*EmailEmbeddedFile, len(msg.EmbeddedFiles))
+
+	bw := bufio.NewWriterSize(dst, streamBufferSize)
+	w := multipart.NewWriter(bw)
+	if err := w.SetBoundary(boundary); err != nil {
+		return err
+	}
+
+	files := []func() error{}
+
+	// 原始邮件作为 message/rfc822 部分，只有大小和哈希或已存入外部存储时原样保留
+	if r := msg.Raw; r != nil && r.URL == "" && !r.File().Empty() {
+		meta.Raw = &EmailRaw{Size: r.Size, SHA256: r.SHA256, Part: "raw"}
+		files = append(files, func() error {
+			return writeFilePart(w, "raw", rawFilename, "message/rfc822", r.File().Reader())
+		})
+	}
+
+	for i, a := range msg.Attachments {
+		// 已存入外部存储的文件只保留 URL
+		if a.URL != "" {
+			meta.Attachments[i] = a
+			continue
+		}
+
+		a, part := a, fmt.Sprintf("attachment-%d", i+1)
+		meta.Attachments[i] = &EmailAttachment{Filename: a.Filename, ContentType: a.ContentType, Part: part}
+		files = append(files, func() error {
+			return writeFilePart(w, part, a.Filename, a.ContentType, a.File().Reader())
+		})
+	}
+
+	for i, e := range msg.EmbeddedFiles {
+		if e.URL != "" {
+			meta.EmbeddedFiles[i] = e
+			continue
+		}
+
+		e, part := e, fmt.Sprintf("embedded-%d", i+1)
+		meta.EmbeddedFiles[i] = &EmailEmbeddedFile{CID: e.CID, ContentType: e.ContentType, Part: part}
+		files = append(files, func() error {
+			return writeFilePart(w, part, e.CID, e.ContentType, e.File().Reader())
+		})
+	}
+
+	metaJSON, err := json.Marshal(&meta)
+	if err != nil {
+		return err
+	}
+
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Disposition", `form-data; name="message"`)
+	h.Set("Content-Type", "application/json")
+	pw, err := w.CreatePart(h)
+	if err != nil {
+		return err
+	}
+	if _, err := pw.Write(metaJSON); err != nil {
+		return err
+	}
+
+	for _, write := range files {
+		if err := write(); err != nil {
+			return err
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+// writeFilePart 写入一个带文件名和内容类型的文件部分
+func writeFilePart(w *multipart.Writer, name, filename, contentType string, data io.Reader) error {
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`,
+		escapeQuotes(name), escapeQuotes(filename)))
+	h.Set("Content-Type", contentType)
+
+	pw, err := w.CreatePart(h)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(pw, data)
+	return err
+}
+
+var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"", "\r", "", "\n", "")
+
+func escapeQuotes(s string) string {
+	return quoteEscaper.Replace(s)
+}
+
+// FileContent 附件、内嵌文件或原始邮件的内容。收到的邮件只在 Content 中保留原始字节，
+// 从磁盘队列或死信恢复的邮件只有 base64 的 Data；读取内容的地方都通过它，不直接访问这两个字段
+type FileContent struct {
+	content []byte
+	data    string
+}
+
+// Empty 没有内容：已存入外部存储、超过大小上限或本身为空
+func (f FileContent) Empty() bool {
+	return len(f.content) == 0 && f.data == ""
+}
+
+// Encoded 内容只有 base64 形式，序列化时可以原样输出
+func (f FileContent) Encoded() bool {
+	return f.content == nil && f.data != ""
+}
+
+// Bytes 原始内容
+func (f FileContent) Bytes() ([]byte, error) {
+	if f.content != nil {
+		return f.content, nil
+	}
+	return base64.StdEncoding.DecodeString(f.data)
+}
+
+// Reader 与 Bytes 相同，但 base64 数据边读边解码
+func (f FileContent) Reader() io.Reader {
+	if f.content != nil {
+		return bytes.NewReader(f.content)
+	}
+	return base64.NewDecoder(base64.StdEncoding, strings.NewReader(f.data))
+}
+
+// Base64 base64 编码的内容
+func (f FileContent) Base64() string {
+	if f.content != nil {
+		return base64.StdEncoding.EncodeToString(f.content)
+	}
+	return f.data
+}
+
+// Len 原始大小
+func (f FileContent) Len() int {
+	if f.content != nil {
+		return len(f.content)
+	}
+	return base64.StdEncoding.DecodedLen(len(f.data)) - strings.Count(f.data[max(0, len(f.data)-2):], "=")
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+)
+
+// 原始邮件的携带方式
+const (
+	RawNone      = "none"
+	RawInline    = "inline"    // json 中为 base64 的 data 字段，multipart 中为 message/rfc822 文件部分
+	RawReference = "reference" // 存入 --blob-store，只发送 url
+)
+
+// rawFilename 原始邮件作为文件时使用的文件名
+const rawFilename = "message.eml"
+
+// rawCapture 记录 DATA 阶段收到的原始邮件。go-smtp 的 DotReader 已经去掉了点转义并把 CRLF 换成 LF，
+// 这里还原为 CRLF；超过上限后不再保留内容，但仍然计算完整的大小和 sha256
+type rawCapture struct {
+	max  int64
+	buf  bytes.Buffer
+	size int64
+	hash hash.Hash
+	over bool
+}
+
+func newRawCapture(max int64) *rawCapture {
+	return &rawCapture{max: max, hash: sha256.New()}
+}
+
+func (c *rawCapture) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		line := p
+		i := bytes.IndexByte(p, '\n')
+		if i >= 0 {
+			line, p = p[:i], p[i+1:]
+		} else {
+			p = nil
+		}
+
+		c.write(line)
+		if i >= 0 {
+			c.write([]byte("\r\n"))
+		}
+	}
+	return n, nil
+}
+
+func (c *rawCapture) write(p []byte) {
+	c.hash.Write(p)
+	c.size += int64(len(p))
+
+	if c.over {
+		return
+	}
+	if c.size > c.max {
+		c.over = true
+		c.buf = bytes.Buffer{}
+		return
+	}
+	c.buf.Write(p)
+}
+
+// Message 生成 payload 中的 raw 字段
+func (c *rawCapture) Message() *EmailRaw {
+	raw := &EmailRaw{
+		Size:   c.size,
+		SHA256: hex.EncodeToString(c.hash.Sum(nil)),
+	}
+	if c.over {
+		raw.Omitted = true
+	} else {
+		raw.Content = c.buf.Bytes()
+	}
+	return raw
+}
+
+// offloadRaw 将原始邮件写入外部存储，payload 中只保留 URL
+func offloadRaw(store BlobStore, raw *EmailRaw) error {
+	if raw.File().Empty() {
+		return nil
+	}
+
+	content, err := raw.File().Bytes()
+	if err != nil {
+		return err
+	}
+	url, _, err := putBlob(store, rawFilename, content, "message/rfc822")
+	if err != nil {
+		return fmt.Errorf("cannot offload raw message: %v", err)
+	}
+	raw.URL = url
+	raw.Content, raw.Data = nil, ""
+	return nil
+}
+
+// rfc822Source 原始邮件还在 payload 中时直接使用，否则由解析后的字段重新生成
+func rfc822Source(msg *EmailMessage) ([]byte, error) {
+	if raw := msg.Raw; raw != nil && !raw.File().Empty() {
+		return raw.File().Bytes()
+	}
+	return buildRFC822(msg)
+}
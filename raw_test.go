@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// DotReader 输出的 LF 邮件及其还原后的 CRLF 形式
+const (
+	rawLF   = "Subject: =?utf-8?q?Gr=C3=BC=C3=9Fe?=\nFrom: a@example.test\n\nline one\n.dot line\n\nlast"
+	rawCRLF = "Subject: =?utf-8?q?Gr=C3=BC=C3=9Fe?=\r\nFrom: a@example.test\r\n\r\nline one\r\n.dot line\r\n\r\nlast"
+)
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestRawCaptureRestoresCRLF(t *testing.T) {
+	// 在每个位置把输入拆成两次 Write，包括正好拆在换行前后
+	for i := 0; i <= len(rawLF); i++ {
+		c := newRawCapture(1 << 20)
+		c.Write([]byte(rawLF[:i]))
+		c.Write([]byte(rawLF[i:]))
+
+		raw := c.Message()
+		if string(raw.Content) != rawCRLF {
+			t.Fatalf("split at %d: content %q, want %q", i, raw.Content, rawCRLF)
+		}
+		if raw.Size != int64(len(rawCRLF)) || raw.SHA256 != sha256Hex(rawCRLF) || raw.Omitted {
+			t.Fatalf("split at %d: size %d sha256 %s omitted %v", i, raw.Size, raw.SHA256, raw.Omitted)
+		}
+	}
+
+	// 逐字节写入
+	c := newRawCapture(1 << 20)
+	for i := 0; i < len(rawLF); i++ {
+		c.Write([]byte{rawLF[i]})
+	}
+	if got := string(c.Message().Content); got != rawCRLF {
+		t.Errorf("byte-by-byte content %q, want %q", got, rawCRLF)
+	}
+}
+
+func TestRawCaptureLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		max     int64
+		omitted bool
+	}{
+		{"under the limit", int64(len(rawCRLF)) + 1, false},
+		{"exactly the limit", int64(len(rawCRLF)), false},
+		{"one byte over", int64(len(rawCRLF)) - 1, true},
+		{"limit inside a CRLF", int64(strings.Index(rawCRLF, "\r\n")) + 1, true},
+		{"tiny limit", 1, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newRawCapture(tt.max)
+			for _, part := range strings.SplitAfter(rawLF, "\n") {
+				c.Write([]byte(part))
+			}
+
+			raw := c.Message()
+			if raw.Omitted != tt.omitted {
+				t.Fatalf("Omitted = %v, want %v", raw.Omitted, tt.omitted)
+			}
+			if tt.omitted && raw.Content != nil {
+				t.Errorf("omitted message still carries %d bytes", len(raw.Content))
+			}
+			// 大小和哈希始终覆盖完整邮件
+			if raw.Size != int64(len(rawCRLF)) || raw.SHA256 != sha256Hex(rawCRLF) {
+				t.Errorf("size %d sha256 %s, want the full message's %d %s", raw.Size, raw.SHA256, len(rawCRLF), sha256Hex(rawCRLF))
+			}
+		})
+	}
+}
+
+// failingStore 总是写入失败的外部存储
+type failingStore struct{}
+
+func (failingStore) Put(string, []byte, string) (string, error) {
+	return "", errors.New("bucket unavailable")
+}
+
+func TestOffloadRaw(t *testing.T) {
+	store, _ := newTestLocalStore(t, time.Hour)
+
+	tests := []struct {
+		name string
+		raw  *EmailRaw
+	}{
+		{"received", &EmailRaw{Size: int64(len(rawCRLF)), SHA256: sha256Hex(rawCRLF), Content: []byte(rawCRLF)}},
+		{"restored from the spool", &EmailRaw{Size: int64(len(rawCRLF)), SHA256: sha256Hex(rawCRLF), Data: base64.StdEncoding.EncodeToString([]byte(rawCRLF))}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := offloadRaw(store, tt.raw); err != nil {
+				t.Fatalf("offloadRaw() = %v", err)
+			}
+			if tt.raw.URL == "" || tt.raw.Content != nil || tt.raw.Data != "" {
+				t.Fatalf("offloaded raw = %+v, want only the URL, size and sha256", tt.raw)
+			}
+			if !strings.Contains(tt.raw.URL, "/"+sha256Hex(rawCRLF)+"/"+rawFilename+"?") {
+				t.Errorf("URL %s does not name the message by its hash", tt.raw.URL)
+			}
+
+			resp, err := http.Get(tt.raw.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(body) != rawCRLF {
+				t.Errorf("stored %q, want the raw message", body)
+			}
+		})
+	}
+
+	omitted := &EmailRaw{Size: 1 << 30, SHA256: "abc", Omitted: true}
+	if err := offloadRaw(failingStore{}, omitted); err != nil || omitted.URL != "" {
+		t.Errorf("offloadRaw(omitted) = %v, URL %q, want nothing stored", err, omitted.URL)
+	}
+
+	failed := &EmailRaw{Content: []byte(rawCRLF)}
+	if err := offloadRaw(failingStore{}, failed); err == nil || !strings.Contains(err.Error(), "bucket unavailable") {
+		t.Errorf("offloadRaw() with a failing store = %v", err)
+	}
+	if string(failed.Content) != rawCRLF || failed.URL != "" {
+		t.Error("a failed offload dropped the raw content")
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// 多收件人邮件的投递方式
+const (
+	RecipientsCombined = "combined" // 投递计划相同的收件人合并为一个请求，recipients 列出全部收件人
+	RecipientsSplit    = "split"    // 每个收件人一个请求
+)
+
+// recipientGroup 共用一个请求的收件人
+type recipientGroup struct {
+	Recipients []string
+	Delivery   *Delivery
+	Checks     []*EmailSecurityCheck // 分组内收件人在 RCPT 阶段通过的检查
+	Key        string                // 幂等键，见 dedupe.go
+}
+
+// groupRecipients 按投递方式将信封收件人分组，保持 RCPT TO 的顺序
+func groupRecipients(rcpts []*Recipient, mode string) []*recipientGroup {
+	groups := []*recipientGroup{}
+	index := map[string]*recipientGroup{}
+
+	for _, r := range rcpts {
+		// 只有目标及其密钥完全相同的收件人才能合并，不同租户的邮件不会出现在同一个请求中
+		key := ""
+		if mode == RecipientsCombined {
+			if data, err := json.Marshal(r.Delivery); err == nil {
+				key = string(data)
+			}
+		}
+
+		if g, exists := index[key]; exists && key != "" {
+			g.Recipients = append(g.Recipients, r.Address)
+			g.Checks = append(g.Checks, r.Checks...)
+			continue
+		}
+
+		g := &recipientGroup{Recipients: []string{r.Address}, Delivery: r.Delivery, Checks: r.Checks}
+		groups = append(groups, g)
+		if key != "" {
+			index[key] = g
+		}
+	}
+
+	return groups
+}
+
+// groupsBlocked 是否有分组的目标处于熔断状态
+func groupsBlocked(groups []*recipientGroup) bool {
+	for _, g := range groups {
+		if g.Delivery.Blocked() {
+			return true
+		}
+	}
+	return false
+}
+
+// pendingGroups 计算各分组的幂等键，去掉窗口期内已经接受过的分组
+func pendingGroups(groups []*recipientGroup, msg *EmailMessage, mailFrom string) []*recipientGroup {
+	pending := []*recipientGroup{}
+	for _, g := range groups {
+		g.Key = idempotencyKey(msg, mailFrom, strings.Join(g.Recipients, ","))
+		if dedupeCache != nil && dedupeCache.Seen(g.Key) {
+			log.Printf("SMTP: Duplicate for %s (key %s...), skipping", strings.Join(g.Recipients, ", "), g.Key[:12])
+			continue
+		}
+		pending = append(pending, g)
+	}
+	return pending
+}
+
+// deliverGroups 并发投递各分组（启用磁盘队列时写入队列），合并为一个 SMTP 结果：
+// 任一分组临时失败时返回临时失败，发送方重发时已接受的分组会被去重；
+// 部分分组被永久拒绝时，SMTP 在 DATA 之后无法按收件人回复，被拒绝的分组写入死信后接受邮件，
+// 无法写入死信时返回永久失败，由发送方退信，不会静默丢弃
+func deliverGroups(groups []*recipientGroup, base *EmailMessage, senderEmail string) error {
+	errs := make([]error, len(groups))
+	msgs := make([]*EmailMessage, len(groups))
+
+	var wg sync.WaitGroup
+	for i, g := range groups {
+		msg := *base
+		msg.Recipients = g.Recipients
+		msg.Addresses.To = &EmailAddress{Address: g.Recipients[0]}
+		msg.IdempotencyKey = g.Key
+		if base.Envelope != nil {
+			envelope := *base.Envelope
+			envelope.RcptTo = g.Recipients
+			msg.Envelope = &envelope
+		}
+		if base.Security != nil {
+			msg.Security = securityReport(append(append([]*EmailSecurityCheck{}, g.Checks...), base.Security.Checks...))
+		}
+
+		msgs[i] = &msg
+
+		wg.Add(1)
+		go func(i int, g *recipientGroup, msg *EmailMessage) {
+			defer wg.Done()
+			errs[i] = deliverGroup(g, msg, senderEmail)
+		}(i, g, &msg)
+	}
+	wg.Wait()
+
+	var temporary, permanent error
+	rejected := []int{}
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+
+		if smtpErr, ok := err.(*smtp.SMTPError); ok && smtpErr.Code < 500 {
+			if temporary == nil {
+				temporary = err
+			}
+			continue
+		}
+
+		rejected = append(rejected, i)
+		if permanent == nil {
+			permanent = err
+		}
+	}
+
+	if temporary != nil {
+		return temporary
+	}
+	if permanent == nil || len(rejected) == len(groups) {
+		return permanent
+	}
+
+	for _, i := range rejected {
+		if err := buryGroup(groups[i], msgs[i], errs[i]); err != nil {
+			log.Printf("SMTP: Cannot keep rejected mail for %s - %v, rejecting the message (From: %s)",
+				strings.Join(groups[i].Recipients, ", "), err, senderEmail)
+			return permanent
+		}
+	}
+	return nil
+}
+
+// buryGroup 将被永久拒绝的分组写入死信，以便查明原因后用 replay 重新投递
+func buryGroup(g *recipientGroup, msg *EmailMessage, reason error) error {
+	if deadLetters == nil {
+		return errors.New("no --dead-letter-dir configured")
+	}
+
+	id, err := newSpoolID()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	entry := &SpoolEntry{
+		ID:        id,
+		Delivery:  g.Delivery,
+		CreatedAt: now,
+		Attempts:  1,
+		LastError: reason.Error(),
+		History:   []SpoolFailure{{At: now, Error: reason.Error()}},
+		Message:   msg,
+	}
+	if err := deadLetters.Add(entry, DeadReasonRejected); err != nil {
+		return err
+	}
+
+	log.Printf("SMTP: Rejected mail for %s moved to dead letters as %s", strings.Join(g.Recipients, ", "), id)
+	return nil
+}
+
+// deliverGroup 投递一个分组，返回给 SMTP 客户端的错误
+func deliverGroup(g *recipientGroup, msg *EmailMessage, senderEmail string) error {
+	recipientEmail := strings.Join(g.Recipients, ", ")
+
+	// 启用磁盘队列时先落盘，由后台 worker 投递
+	if spool != nil {
+		id, err := spool.Enqueue(g.Delivery, msg)
+		if err != nil {
+			log.Printf("SPOOL: Cannot queue message - %v (From: %s, To: %s)", err, senderEmail, recipientEmail)
+			return errors.New("E3: Cannot accept your message due to internal error, please report that to our engineers")
+		}
+		log.Printf("SPOOL: Email queued as %s for delivery to %s (From: %s, To: %s)",
+			id, g.Delivery.URLs(), senderEmail, recipientEmail)
+		if dedupeCache != nil {
+			dedupeCache.Add(g.Key)
+		}
+		return nil
+	}
+
+	// 发送 webhook 请求
+	if err := deliverAll(g.Delivery, msg); err != nil {
+		log.Printf("WEBHOOK: Delivery failed - %v (From: %s, To: %s)", err, senderEmail, recipientEmail)
+		if derr, ok := err.(*DeliveryError); ok {
+			return derr.SMTPError()
+		}
+		return err
+	}
+
+	log.Printf("WEBHOOK: Email successfully processed and forwarded to %s (From: %s, To: %s)",
+		g.Delivery.URLs(), senderEmail, recipientEmail)
+	if dedupeCache != nil {
+		dedupeCache.Add(g.Key)
+	}
+
+	return nil
+}
+
+// recipientList 用于日志输出
+func recipientList(rcpts []*Recipient) string {
+	list := []string{}
+	for _, r := range rcpts {
+		list = append(list, r.Address)
+	}
+	return strings.Join(list, ", ")
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+)
+
+func TestGroupRecipients(t *testing.T) {
+	tenantA := &Delivery{Policy: PolicyAll, Targets: []*WebhookTarget{{URL: "https://a.test/in", SigningKey: "a"}}}
+	tenantB := &Delivery{Policy: PolicyAll, Targets: []*WebhookTarget{{URL: "https://a.test/in", SigningKey: "b"}}}
+	sameAsA := &Delivery{Policy: PolicyAll, Targets: []*WebhookTarget{{URL: "https://a.test/in", SigningKey: "a"}}}
+
+	rcpts := []*Recipient{
+		{Address: "1@a.test", Delivery: tenantA, Checks: []*EmailSecurityCheck{{Name: "one"}}},
+		{Address: "2@b.test", Delivery: tenantB},
+		{Address: "3@a.test", Delivery: sameAsA, Checks: []*EmailSecurityCheck{{Name: "three"}}},
+	}
+
+	tests := []struct {
+		mode   string
+		groups [][]string
+	}{
+		// 目标相同但签名密钥不同的收件人不能合并
+		{RecipientsCombined, [][]string{{"1@a.test", "3@a.test"}, {"2@b.test"}}},
+		{RecipientsSplit, [][]string{{"1@a.test"}, {"2@b.test"}, {"3@a.test"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			groups := groupRecipients(rcpts, tt.mode)
+			got := [][]string{}
+			for _, g := range groups {
+				got = append(got, g.Recipients)
+			}
+			if !reflect.DeepEqual(got, tt.groups) {
+				t.Fatalf("groupRecipients() = %v, want %v", got, tt.groups)
+			}
+		})
+	}
+
+	combined := groupRecipients(rcpts, RecipientsCombined)
+	if names := []string{combined[0].Checks[0].Name, combined[0].Checks[1].Name}; names[0] != "one" || names[1] != "three" {
+		t.Errorf("merged group checks = %v, want both recipients' checks", names)
+	}
+}
+
+// useDeadLetters 在测试期间使用临时死信目录，enabled 为 false 时不配置死信目录
+func useDeadLetters(t *testing.T, enabled bool) *DeadLetterStore {
+	t.Helper()
+	old := deadLetters
+	t.Cleanup(func() { deadLetters = old })
+
+	if !enabled {
+		deadLetters = nil
+		return nil
+	}
+
+	dir, err := ioutil.TempDir("", "dead")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	store, err := NewDeadLetterStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadLetters = store
+	return store
+}
+
+// smtpCode 返回给 SMTP 客户端的响应码，成功时为 250
+func smtpCode(err error) int {
+	if err == nil {
+		return 250
+	}
+	if smtpErr, ok := err.(*smtp.SMTPError); ok {
+		return smtpErr.Code
+	}
+	return 554
+}
+
+func TestDeliverGroups(t *testing.T) {
+	srv := newVerdictServer(t)
+
+	tests := []struct {
+		name        string
+		paths       []string
+		deadLetters bool
+		code        int
+		buried      []string // 写入死信的分组收件人
+	}{
+		{"all accepted", []string{"/accept", "/accept"}, true, 250, nil},
+		{"temporary failure wins over rejection", []string{"/accept", "/tempfail", "/reject"}, true, 451, nil},
+		{"partial rejection goes to dead letters", []string{"/accept", "/reject", "/accept"}, true, 250, []string{"1@rcpt.test"}},
+		{"partial rejection without dead-letter dir", []string{"/accept", "/reject"}, false, 550, nil},
+		{"every group rejected", []string{"/reject", "/reject"}, true, 550, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := useDeadLetters(t, tt.deadLetters)
+
+			groups := []*recipientGroup{}
+			for i, p := range tt.paths {
+				groups = append(groups, &recipientGroup{
+					Recipients: []string{string(rune('0'+i)) + "@rcpt.test"},
+					Delivery:   srv.delivery(PolicyAll, p),
+				})
+			}
+			base := &EmailMessage{Subject: "groups", Envelope: &EmailEnvelope{MailFrom: "s@sender.test"}}
+
+			err := deliverGroups(groups, base, "s@sender.test")
+			if got := smtpCode(err); got != tt.code {
+				t.Errorf("deliverGroups() = %d (%v), want %d", got, err, tt.code)
+			}
+
+			if store == nil {
+				return
+			}
+			letters, err := store.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			buried := []string{}
+			for _, d := range letters {
+				buried = append(buried, strings.Join(d.Recipients(), ","))
+				if d.Reason != DeadReasonRejected || !strings.HasSuffix(d.Delivery.URLs(), "/reject") {
+					t.Errorf("dead letter %s: reason %s, targets %s", d.ID, d.Reason, d.Delivery.URLs())
+				}
+				if d.Message.Envelope == nil || strings.Join(d.Message.Envelope.RcptTo, ",") != strings.Join(d.Recipients(), ",") {
+					t.Errorf("dead letter %s envelope = %+v, want only its own recipients", d.ID, d.Message.Envelope)
+				}
+			}
+			sort.Strings(buried)
+			if strings.Join(buried, " ") != strings.Join(tt.buried, " ") {
+				t.Errorf("dead letters for %v, want %v", buried, tt.buried)
+			}
+		})
+	}
+}
+
+func TestDeliverGroupsPerGroupMessage(t *testing.T) {
+	srv := newVerdictServer(t)
+	useDeadLetters(t, false)
+
+	groups := []*recipientGroup{
+		{Recipients: []string{"a@one.test", "b@one.test"}, Delivery: srv.delivery(PolicyAll, "/accept")},
+		{Recipients: []string{"c@two.test"}, Delivery: srv.delivery(PolicyAll, "/accept")},
+	}
+	base := &EmailMessage{Subject: "split", Recipients: []string{"a@one.test", "b@one.test", "c@two.test"}}
+
+	if err := deliverGroups(groups, base, "s@sender.test"); err != nil {
+		t.Fatalf("deliverGroups() = %v", err)
+	}
+	if len(base.Recipients) != 3 || base.Addresses.To != nil {
+		t.Errorf("base message was modified: %v %v", base.Recipients, base.Addresses.To)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// runReplay 实现 `smtp2http replay` 子命令：按条件将死信重新投递到各自原来的目标，
+// 只有指定 --override-webhook 时才改投到 --webhook
+func runReplay(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+
+	ids := fs.String("id", "", "comma-separated dead-letter IDs to replay")
+	since := fs.String("since", "", "only replay messages received at or after this time (RFC 3339, or a duration such as 24h meaning that long ago)")
+	until := fs.String("until", "", "only replay messages received before this time (RFC 3339 or duration)")
+	domains := fs.String("rcpt-domain", "", "comma-separated recipient domains to replay")
+	dryRun := fs.Bool("dry-run", false, "list matching dead letters without sending them")
+	keep := fs.Bool("keep", false, "keep dead letters after a successful replay")
+	override := fs.Bool("override-webhook", false, "send to the --webhook targets instead of each dead letter's own targets (its route, DNS hook or the webhooks at the time it was received)")
+
+	// 全局参数（--webhook、--signing-key、--dead-letter-dir 等）在 replay 中同样可用
+	flag.VisitAll(func(f *flag.Flag) {
+		fs.Var(f.Value, f.Name, f.Usage)
+	})
+
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s replay [flags]\n\nRe-send dead letters to the targets they were meant for.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+
+	fs.Parse(args)
+
+	if *flagDeadLetterDir == "" {
+		return fmt.Errorf("--dead-letter-dir is required")
+	}
+
+	store, err := NewDeadLetterStore(*flagDeadLetterDir)
+	if err != nil {
+		return err
+	}
+
+	sinceTime, err := parseReplayTime(*since)
+	if err != nil {
+		return fmt.Errorf("invalid --since: %v", err)
+	}
+
+	untilTime, err := parseReplayTime(*until)
+	if err != nil {
+		return fmt.Errorf("invalid --until: %v", err)
+	}
+
+	if err := configureDelivery(); err != nil {
+		return err
+	}
+
+	letters, err := store.List()
+	if err != nil {
+		return fmt.Errorf("cannot read dead letters: %v", err)
+	}
+
+	idSet := splitSet(*ids, false)
+	domainSet := splitSet(*domains, true)
+
+	var matched, replayed, failed int
+	for _, d := range letters {
+		if len(idSet) > 0 && !idSet[d.ID] {
+			continue
+		}
+		if len(domainSet) > 0 && !matchAny(domainSet, d.Domains()) {
+			continue
+		}
+		if !sinceTime.IsZero() && d.CreatedAt.Before(sinceTime) {
+			continue
+		}
+		if !untilTime.IsZero() && !d.CreatedAt.Before(untilTime) {
+			continue
+		}
+
+		matched++
+		log.Printf("REPLAY: %s received %s, to %s, %s after %d attempts: %s",
+			d.ID, d.CreatedAt.Format(time.RFC3339), strings.Join(d.Recipients(), ", "), d.Reason, d.Attempts, d.LastError)
+
+		if *dryRun {
+			continue
+		}
+
+		delivery, err := replayDelivery(d, *override)
+		if err == nil {
+			err = deliverAll(delivery, d.Message)
+		}
+		if err != nil {
+			failed++
+			d.Attempts++
+			d.LastError = err.Error()
+			d.History = append(d.History, SpoolFailure{At: time.Now(), Error: "replay: " + err.Error()})
+			if err := store.Save(d); err != nil {
+				log.Printf("REPLAY: Cannot update %s: %v", d.ID, err)
+			}
+			log.Printf("REPLAY: %s failed: %v", d.ID, err)
+			continue
+		}
+
+		replayed++
+		log.Printf("REPLAY: %s delivered to %s", d.ID, delivery.URLs())
+
+		if !*keep {
+			if err := store.Remove(d.ID); err != nil {
+				log.Printf("REPLAY: Cannot remove %s: %v", d.ID, err)
+			}
+		}
+	}
+
+	log.Printf("REPLAY: %d matched, %d delivered, %d failed", matched, replayed, failed)
+
+	if failed > 0 {
+		return fmt.Errorf("%d dead letters could not be replayed", failed)
+	}
+
+	return nil
+}
+
+// replayDelivery 死信的投递计划：优先使用死信中保存的目标（已接受的目标会被跳过），
+// 没有保存时按收件人重新解析 --route 和 DNS TXT 记录；两者都没有匹配时返回错误，
+// 不会落到不相关的全局 webhook，除非指定了 --override-webhook
+func replayDelivery(d *DeadLetter, override bool) (*Delivery, error) {
+	if override {
+		return newDelivery(flagWebhooks.targets), nil
+	}
+	if d.Delivery != nil && len(d.Delivery.Targets) > 0 {
+		return d.Delivery, nil
+	}
+
+	rcpts := d.Recipients()
+	if len(rcpts) == 0 {
+		return nil, fmt.Errorf("dead letter has neither targets nor recipients")
+	}
+
+	var record *DNSTXTRecord
+	if *flagRcptDomainSecret != "" {
+		check := ValidateRecipientDomainDNS(rcpts[0], *flagRcptDomainSecret)
+		if !check.Allowed {
+			return nil, fmt.Errorf("domain no longer authorized: %s", check.Reason)
+		}
+		record = check.Record
+	}
+
+	if flagRoutes.match(rcptDomain(rcpts[0])) == nil && (record == nil || record.Hook == "") {
+		return nil, fmt.Errorf("no stored targets and no --route or DNS TXT hook for %s, use --override-webhook to send it to --webhook", rcpts[0])
+	}
+	return resolveDelivery(rcpts[0], record)
+}
+
+// parseReplayTime 解析 RFC 3339 时间或相对当前的时长
+func parseReplayTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+
+	return time.Parse(time.RFC3339, s)
+}
+
+// matchAny values 中是否有集合内的值
+func matchAny(set map[string]bool, values []string) bool {
+	for _, v := range values {
+		if set[v] {
+			return true
+		}
+	}
+	return false
+}
+
+// splitSet 将逗号分隔的列表转为集合
+func splitSet(s string, lower bool) map[string]bool {
+	set := map[string]bool{}
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if lower {
+			v = strings.ToLower(v)
+		}
+		if v != "" {
+			set[v] = true
+		}
+	}
+	return set
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newReplayStore 在临时目录中准备死信并设置 --dead-letter-dir；runReplay 会重新配置的全局状态在测试结束后恢复
+func newReplayStore(t *testing.T, letters ...*DeadLetter) *DeadLetterStore {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	setFlag(t, flagDeadLetterDir, dir)
+
+	oldClient, oldBreaker, oldTokens := webhookClient, breaker, tokenSource
+	t.Cleanup(func() { webhookClient, breaker, tokenSource = oldClient, oldBreaker, oldTokens })
+
+	store, err := NewDeadLetterStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range letters {
+		if err := store.Save(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return store
+}
+
+// deadLetter 创建收件人为 rcpt、接收于 created 的死信
+func deadLetter(id, rcpt string, created time.Time, delivery *Delivery) *DeadLetter {
+	msg := &EmailMessage{Subject: id, Recipients: []string{rcpt}}
+	return &DeadLetter{
+		SpoolEntry: SpoolEntry{ID: id, Delivery: delivery, CreatedAt: created, Message: msg},
+		Reason:     DeadReasonRejected,
+	}
+}
+
+// remaining 目录中剩下的死信 ID
+func remaining(t *testing.T, store *DeadLetterStore) string {
+	t.Helper()
+	letters, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{}
+	for _, d := range letters {
+		ids = append(ids, d.ID)
+	}
+	return strings.Join(ids, ",")
+}
+
+func TestRunReplayFilters(t *testing.T) {
+	srv := newVerdictServer(t)
+	useTargets(t, nil, nil, nil)
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		args    []string
+		left    string
+		replays int
+	}{
+		{"everything", nil, "", 4},
+		{"by id", []string{"--id=b, d"}, "a,c", 2},
+		{"by domain", []string{"--rcpt-domain=TWO.test,three.test"}, "a,d", 2},
+		{"since duration", []string{"--since=90m"}, "a,b", 2},
+		{"until RFC 3339", []string{"--until=" + now.Add(-90*time.Minute).Format(time.RFC3339)}, "c,d", 2},
+		{"since and until", []string{"--since=150m", "--until=30m"}, "a,d", 2},
+		{"id and domain", []string{"--id=a,b", "--rcpt-domain=one.test"}, "b,c,d", 1},
+		{"dry run", []string{"--dry-run"}, "a,b,c,d", 0},
+		{"keep", []string{"--keep", "--id=a"}, "a,b,c,d", 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := srv.count("/accept")
+			store := newReplayStore(t,
+				deadLetter("a", "x@one.test", now.Add(-3*time.Hour), srv.delivery(PolicyAll, "/accept")),
+				deadLetter("b", "x@two.test", now.Add(-2*time.Hour), srv.delivery(PolicyAll, "/accept")),
+				deadLetter("c", "x@three.test", now.Add(-time.Hour), srv.delivery(PolicyAll, "/accept")),
+				deadLetter("d", "x@one.test", now, srv.delivery(PolicyAll, "/accept")),
+			)
+
+			if err := runReplay(tt.args); err != nil {
+				t.Fatalf("runReplay(%v) = %v", tt.args, err)
+			}
+			if got := remaining(t, store); got != tt.left {
+				t.Errorf("left %q, want %q", got, tt.left)
+			}
+			if got := srv.count("/accept") - before; got != tt.replays {
+				t.Errorf("%d requests sent, want %d", got, tt.replays)
+			}
+		})
+	}
+}
+
+func TestRunReplayFailureKeepsDeadLetter(t *testing.T) {
+	srv := newVerdictServer(t)
+	useTargets(t, nil, nil, nil)
+
+	store := newReplayStore(t,
+		deadLetter("a", "x@one.test", time.Now(), srv.delivery(PolicyAll, "/accept")),
+		deadLetter("b", "x@two.test", time.Now(), srv.delivery(PolicyAll, "/reject")),
+	)
+
+	if err := runReplay(nil); err == nil || !strings.Contains(err.Error(), "1 dead letters") {
+		t.Fatalf("runReplay() = %v, want one failure", err)
+	}
+	if got := remaining(t, store); got != "b" {
+		t.Fatalf("left %q, want the failed dead letter b", got)
+	}
+
+	d, err := store.Load("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Attempts != 1 || len(d.History) != 1 || !strings.HasPrefix(d.History[0].Error, "replay: rejected") {
+		t.Errorf("failed dead letter = attempts %d, history %+v", d.Attempts, d.History)
+	}
+}
+
+func TestRunReplayRequiresDeadLetterDir(t *testing.T) {
+	setFlag(t, flagDeadLetterDir, "")
+	if err := runReplay(nil); err == nil {
+		t.Error("runReplay() without --dead-letter-dir succeeded")
+	}
+}
+
+func TestReplayDelivery(t *testing.T) {
+	useTargets(t, []string{"https://global.test/hook"}, []string{"routed.test=https://route.test/hook"}, nil)
+	setFlag(t, flagAllowedHookHosts, "*.tenant.test")
+	setFlag(t, flagRcptDomainSecret, "")
+
+	stored := &Delivery{Policy: PolicyAll, Targets: []*WebhookTarget{{URL: "https://stored.test/hook"}}}
+
+	tests := []struct {
+		name     string
+		letter   *DeadLetter
+		secret   string
+		override bool
+		want     string
+		wantErr  bool
+	}{
+		{"stored targets", deadLetter("a", "x@routed.test", time.Now(), stored), "", false, "https://stored.test/hook", false},
+		{"override", deadLetter("a", "x@routed.test", time.Now(), stored), "", true, "https://global.test/hook", false},
+		{"route", deadLetter("a", "x@routed.test", time.Now(), nil), "", false, "https://route.test/hook", false},
+		{"DNS hook", deadLetter("a", "x@hooked.test", time.Now(), nil), "s3cret", false, "https://a.tenant.test/in", false},
+		{"no route or hook", deadLetter("a", "x@other.test", time.Now(), nil), "", false, "", true},
+		{"DNS record without hook", deadLetter("a", "x@plain.test", time.Now(), nil), "s3cret", false, "", true},
+		{"no route or hook with override", deadLetter("a", "x@other.test", time.Now(), nil), "", true, "https://global.test/hook", false},
+		{"domain no longer authorized", deadLetter("a", "x@denied.test", time.Now(), nil), "s3cret", false, "", true},
+		{"no recipients", &DeadLetter{SpoolEntry: SpoolEntry{ID: "a", Message: &EmailMessage{}}}, "", false, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, flagRcptDomainSecret, tt.secret)
+			useDNSRecords(t, map[string]*DNSTXTRecord{
+				"hooked.test": {Allow: true, Secret: "s3cret", Hook: "https://a.tenant.test/in"},
+				"plain.test":  {Allow: true, Secret: "s3cret"},
+				"denied.test": {Allow: false, Secret: "s3cret"},
+			})
+
+			d, err := replayDelivery(tt.letter, tt.override)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("replayDelivery() error = %v, want error %v", err, tt.wantErr)
+			}
+			if got := deliveryURLs(d); got != tt.want {
+				t.Errorf("replayDelivery() targets = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseReplayTime(t *testing.T) {
+	if got, err := parseReplayTime(""); err != nil || !got.IsZero() {
+		t.Errorf(`parseReplayTime("") = %v, %v, want the zero time`, got, err)
+	}
+
+	got, err := parseReplayTime("24h")
+	if want := time.Now().Add(-24 * time.Hour); err != nil || got.Sub(want) > time.Second || want.Sub(got) > time.Second {
+		t.Errorf(`parseReplayTime("24h") = %v, %v, want about %v`, got, err, want)
+	}
+
+	got, err = parseReplayTime("2024-03-01T08:00:00+08:00")
+	if want := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC); err != nil || !got.Equal(want) {
+		t.Errorf("parseReplayTime(RFC 3339) = %v, %v, want %v", got, err, want)
+	}
+
+	for _, s := range []string{"yesterday", "2024-03-01", "24"} {
+		if _, err := parseReplayTime(s); err == nil {
+			t.Errorf("parseReplayTime(%q) = nil error", s)
+		}
+	}
+}
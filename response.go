@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+)
+
+// webhook 可以返回的投递结论
+const (
+	VerdictAccept   = "accept"
+	VerdictTempFail = "tempfail"
+	VerdictReject   = "reject"
+)
+
+// WebhookVerdict webhook 响应体中的投递结论，见 README 中的响应约定
+type WebhookVerdict struct {
+	Action       string `json:"action"`
+	SMTPCode     int    `json:"smtp_code,omitempty"`
+	EnhancedCode string `json:"enhanced_code,omitempty"`
+	Message      string `json:"message,omitempty"`
+
+	// Code 兼容 cloud-mail 旧的响应格式 {"code":403,...}
+	Code int `json:"code,omitempty"`
+}
+
+// parseVerdict 根据 HTTP 状态码和响应体得出投递结论
+func parseVerdict(status int, body []byte) *WebhookVerdict {
+	verdict := &WebhookVerdict{}
+	if err := json.Unmarshal(body, verdict); err != nil {
+		verdict = &WebhookVerdict{}
+	}
+
+	verdict.Action = strings.ToLower(strings.TrimSpace(verdict.Action))
+
+	if verdict.Action == "" {
+		switch {
+		case verdict.Code == 400 || verdict.Code == 403:
+			verdict.Action = VerdictReject
+		case status >= 200 && status < 300:
+			verdict.Action = VerdictAccept
+		default:
+			verdict.Action = VerdictTempFail
+		}
+	}
+
+	verdict.normalize()
+	return verdict
+}
+
+// normalize 补全与结论不一致或缺失的 SMTP 码和消息
+func (v *WebhookVerdict) normalize() {
+	switch v.Action {
+	case VerdictAccept:
+	case VerdictReject:
+		if v.SMTPCode < 500 || v.SMTPCode > 599 {
+			v.SMTPCode = 550
+			v.EnhancedCode = ""
+		}
+		if v.Message == "" {
+			v.Message = "Email rejected by destination server"
+		}
+	default:
+		v.Action = VerdictTempFail
+		if v.SMTPCode < 400 || v.SMTPCode > 499 {
+			v.SMTPCode = 451
+			v.EnhancedCode = ""
+		}
+		if v.Message == "" {
+			v.Message = "Destination temporarily unavailable, please try again later"
+		}
+	}
+}
+
+// hasExplicitVerdict 响应体是否明确给出了 action
+func hasExplicitVerdict(body []byte) bool {
+	v := &WebhookVerdict{}
+	return json.Unmarshal(body, v) == nil && v.Action != ""
+}
+
+// SMTPError 将结论转换为返回给发送方 MTA 的 SMTP 响应
+func (v *WebhookVerdict) SMTPError() *smtp.SMTPError {
+	return &smtp.SMTPError{
+		Code:         v.SMTPCode,
+		EnhancedCode: parseEnhancedCode(v.EnhancedCode, v.SMTPCode),
+		Message:      sanitizeSMTPMessage(v.Message),
+	}
+}
+
+// parseEnhancedCode 解析 "5.7.1" 形式的增强状态码，类别必须与 SMTP 码一致
+func parseEnhancedCode(s string, code int) smtp.EnhancedCode {
+	parts := strings.Split(strings.TrimSpace(s), ".")
+	if len(parts) != 3 {
+		return smtp.EnhancedCodeNotSet
+	}
+
+	var ec smtp.EnhancedCode
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 || n > 999 {
+			return smtp.EnhancedCodeNotSet
+		}
+		ec[i] = n
+	}
+
+	if ec[0] != code/100 {
+		return smtp.EnhancedCodeNotSet
+	}
+
+	return ec
+}
+
+// sanitizeSMTPMessage 只保留可打印 ASCII 并限制长度，避免破坏 SMTP 响应
+func sanitizeSMTPMessage(msg string) string {
+	msg = strings.Map(func(r rune) rune {
+		if r < 0x20 {
+			return ' '
+		}
+		if r >= 0x7f {
+			return '?'
+		}
+		return r
+	}, msg)
+	msg = strings.TrimSpace(msg)
+
+	if len(msg) > 200 {
+		msg = msg[:200]
+	}
+
+	return msg
+}
+
+// describe 用于日志输出
+func (v *WebhookVerdict) describe() string {
+	if v.Action == VerdictAccept {
+		return v.Action
+	}
+	return fmt.Sprintf("%s %d %s %s", v.Action, v.SMTPCode, v.EnhancedCode, v.Message)
+}
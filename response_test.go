@@ -0,0 +1,130 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+)
+
+func TestParseVerdict(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		body     string
+		action   string
+		code     int
+		enhanced string
+		message  string
+	}{
+		{"explicit accept", 200, `{"action":"accept"}`, VerdictAccept, 0, "", ""},
+		{"action is case-insensitive", 200, `{"action":" Reject "}`, VerdictReject, 550, "", "Email rejected by destination server"},
+		{"reject with own code", 200, `{"action":"reject","smtp_code":554,"enhanced_code":"5.7.1","message":"spam"}`, VerdictReject, 554, "5.7.1", "spam"},
+		{"reject with 4xx code", 200, `{"action":"reject","smtp_code":451,"enhanced_code":"4.3.0"}`, VerdictReject, 550, "", "Email rejected by destination server"},
+		{"tempfail with own code", 500, `{"action":"tempfail","smtp_code":452,"message":"full"}`, VerdictTempFail, 452, "", "full"},
+		{"tempfail with 5xx code", 200, `{"action":"tempfail","smtp_code":550,"enhanced_code":"5.1.1"}`, VerdictTempFail, 451, "", "Destination temporarily unavailable, please try again later"},
+		{"unknown action", 200, `{"action":"maybe"}`, VerdictTempFail, 451, "", "Destination temporarily unavailable, please try again later"},
+		{"legacy code 403", 200, `{"code":403,"message":"blocked"}`, VerdictReject, 550, "", "blocked"},
+		{"legacy code 400", 200, `{"code":400}`, VerdictReject, 550, "", "Email rejected by destination server"},
+		{"legacy other code", 200, `{"code":200}`, VerdictAccept, 0, "", ""},
+		{"2xx without body", 204, ``, VerdictAccept, 0, "", ""},
+		{"2xx plain text", 200, `ok`, VerdictAccept, 0, "", ""},
+		{"5xx plain text", 500, `Internal Server Error`, VerdictTempFail, 451, "", "Destination temporarily unavailable, please try again later"},
+		{"4xx without action", 404, `{"error":"not found"}`, VerdictTempFail, 451, "", "Destination temporarily unavailable, please try again later"},
+		{"truncated JSON", 200, `{"action":"reject"`, VerdictAccept, 0, "", ""},
+		{"wrong field type", 500, `{"action":1}`, VerdictTempFail, 451, "", "Destination temporarily unavailable, please try again later"},
+		{"JSON array", 200, `[{"action":"reject"}]`, VerdictAccept, 0, "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := parseVerdict(tt.status, []byte(tt.body))
+			if v.Action != tt.action || v.SMTPCode != tt.code || v.EnhancedCode != tt.enhanced || v.Message != tt.message {
+				t.Errorf("parseVerdict() = %+v, want %s %d %q %q", v, tt.action, tt.code, tt.enhanced, tt.message)
+			}
+		})
+	}
+}
+
+func TestHasExplicitVerdict(t *testing.T) {
+	tests := []struct {
+		body string
+		want bool
+	}{
+		{`{"action":"accept"}`, true},
+		{`{"action":""}`, false},
+		{`{"code":403}`, false},
+		{`not json`, false},
+		{``, false},
+	}
+
+	for _, tt := range tests {
+		if got := hasExplicitVerdict([]byte(tt.body)); got != tt.want {
+			t.Errorf("hasExplicitVerdict(%q) = %v, want %v", tt.body, got, tt.want)
+		}
+	}
+}
+
+func TestVerdictError(t *testing.T) {
+	if err := verdictError(&WebhookVerdict{Action: VerdictAccept}, true, "200"); err != nil {
+		t.Errorf("accept: %v, want nil", err)
+	}
+
+	reject := parseVerdict(200, []byte(`{"action":"reject"}`))
+	if derr, ok := verdictError(reject, true, "200").(*DeliveryError); !ok || !derr.Permanent || derr.Verdict != reject {
+		t.Errorf("reject: %#v, want a permanent error carrying the verdict", derr)
+	}
+
+	tempfail := parseVerdict(503, []byte(`{"action":"tempfail","message":"later"}`))
+	if derr, ok := verdictError(tempfail, true, "503").(*DeliveryError); !ok || derr.Permanent || derr.Code != "" || derr.Verdict != tempfail {
+		t.Errorf("explicit tempfail: %#v, want the webhook verdict", derr)
+	}
+
+	// 未给出结论的非 2xx 响应不向发送方透露内容
+	implicit := parseVerdict(500, []byte(`stack trace`))
+	if derr, ok := verdictError(implicit, false, "500").(*DeliveryError); !ok || derr.Permanent || derr.Code != "E2" || derr.Verdict != nil {
+		t.Errorf("implicit tempfail: %#v, want a generic E2", derr)
+	}
+}
+
+func TestParseEnhancedCode(t *testing.T) {
+	tests := []struct {
+		s    string
+		code int
+		want smtp.EnhancedCode
+	}{
+		{"5.7.1", 550, smtp.EnhancedCode{5, 7, 1}},
+		{" 4.2.2 ", 452, smtp.EnhancedCode{4, 2, 2}},
+		{"4.2.2", 550, smtp.EnhancedCodeNotSet},
+		{"5.7", 550, smtp.EnhancedCodeNotSet},
+		{"5.x.1", 550, smtp.EnhancedCodeNotSet},
+		{"5.-1.1", 550, smtp.EnhancedCodeNotSet},
+		{"5.1000.1", 550, smtp.EnhancedCodeNotSet},
+		{"", 550, smtp.EnhancedCodeNotSet},
+	}
+
+	for _, tt := range tests {
+		if got := parseEnhancedCode(tt.s, tt.code); got != tt.want {
+			t.Errorf("parseEnhancedCode(%q, %d) = %v, want %v", tt.s, tt.code, got, tt.want)
+		}
+	}
+}
+
+func TestSanitizeSMTPMessage(t *testing.T) {
+	tests := []struct {
+		msg  string
+		want string
+	}{
+		{"mailbox full", "mailbox full"},
+		{"line one\r\n250 OK", "line one  250 OK"},
+		{"  padded\t", "padded"},
+		{"café", "caf?"},
+		{strings.Repeat("x", 300), strings.Repeat("x", 200)},
+	}
+
+	for _, tt := range tests {
+		if got := sanitizeSMTPMessage(tt.msg); got != tt.want {
+			t.Errorf("sanitizeSMTPMessage(%q) = %q, want %q", tt.msg, got, tt.want)
+		}
+	}
+}
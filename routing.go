@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/alash3al/smtp2http/signature"
+)
+
+// routeList 可重复的 --route 参数，按收件人域名选择投递目标
+type routeList struct {
+	specs  []string
+	routes []*route
+}
+
+// route 一条本地路由，同一域名的多条路由合并为多个目标
+type route struct {
+	Domain  string
+	Targets []*WebhookTarget
+}
+
+func (l *routeList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(l.specs, ", ")
+}
+
+// Set 解析 "domain=target" 形式的路由，target 与 --webhook 写法相同
+func (l *routeList) Set(spec string) error {
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid route %q, expected domain=target", spec)
+	}
+
+	domain := strings.ToLower(strings.TrimSuffix(strings.TrimSpace(parts[0]), "."))
+	if domain == "" || strings.ContainsAny(domain, " ;/") {
+		return fmt.Errorf("invalid route domain %q", parts[0])
+	}
+
+	target, err := parseWebhookSpec(parts[1])
+	if err != nil {
+		return err
+	}
+
+	l.specs = append(l.specs, spec)
+	for _, r := range l.routes {
+		if r.Domain == domain {
+			r.Targets = append(r.Targets, target)
+			return nil
+		}
+	}
+	l.routes = append(l.routes, &route{Domain: domain, Targets: []*WebhookTarget{target}})
+	return nil
+}
+
+// match 返回收件人域名对应的目标：精确匹配优先，其次是最长的 *.example.com 通配
+func (l *routeList) match(domain string) []*WebhookTarget {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+
+	var best *route
+	for _, r := range l.routes {
+		if r.Domain == domain {
+			return r.Targets
+		}
+		if matchDomain(r.Domain, domain) && (best == nil || len(r.Domain) > len(best.Domain)) {
+			best = r
+		}
+	}
+
+	if best == nil {
+		return nil
+	}
+	return best.Targets
+}
+
+// matchDomain 支持 *.example.com 通配，IP 地址不参与通配匹配
+func matchDomain(pattern, host string) bool {
+	if strings.HasPrefix(pattern, "*.") {
+		return net.ParseIP(host) == nil && strings.HasSuffix(host, pattern[1:])
+	}
+	return host == pattern
+}
+
+// rcptDomain 收件人地址的域名部分
+func rcptDomain(rcpt string) string {
+	if i := strings.LastIndex(rcpt, "@"); i >= 0 {
+		return rcpt[i+1:]
+	}
+	return ""
+}
+
+// resolveDelivery 决定一封邮件的投递计划：本地 --route 优先，其次是通过验证的 DNS TXT 记录中的 hook，
+// 都没有时回退到全局 --webhook；域名自己的 hook 会替换全部全局目标，避免租户邮件被投递到其他目标
+func resolveDelivery(rcpt string, record *DNSTXTRecord) (*Delivery, error) {
+	if targets := flagRoutes.match(rcptDomain(rcpt)); targets != nil {
+		d := newDelivery(targets)
+		if record != nil {
+			signWithDomainKey(d, rcpt)
+		}
+		return d, nil
+	}
+
+	if record == nil {
+		return newDelivery(flagWebhooks.targets), nil
+	}
+
+	if record.Hook == "" {
+		d := newDelivery(flagWebhooks.targets)
+		signWithDomainKey(d, rcpt)
+		return d, nil
+	}
+
+	u, err := url.Parse(record.Hook)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hook URL: %v", err)
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported hook URL scheme: %s", u.Scheme)
+	}
+
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("hook URL has no host")
+	}
+
+	if !isHookHostAllowed(u.Hostname()) {
+		return nil, fmt.Errorf("hook host %s not in allowed list", u.Hostname())
+	}
+
+	d := newHookDelivery(record.Hook, u.Hostname())
+	signWithDomainKey(d, rcpt)
+	return d, nil
+}
+
+// signWithDomainKey 启用 --sign-with-domain-secret 时，用 --signing-key 为收件人域名派生的密钥签名。
+// 不能直接使用 TXT 记录中的 secret：它对所有域名相同，而且任何人都能查到
+func signWithDomainKey(d *Delivery, rcpt string) {
+	if !*flagSignWithDomainSecret {
+		return
+	}
+
+	key := signature.DomainKey([]byte(*flagSigningKey), rcptDomain(rcpt))
+	for _, t := range d.Targets {
+		t.SigningKey = key
+	}
+}
+
+// newHookDelivery DNS TXT 记录中的 hook 由域名所有者指定，不能附带全局的 --inbound-key 和 --signing-key，
+// 否则任何发布 TXT 记录的人都能拿到 X-Inbound-Key 和有效签名；只使用 --hook-credentials 中为该主机配置的密钥
+func newHookDelivery(hook, host string) *Delivery {
+	d := newDelivery([]*WebhookTarget{{URL: hook}})
+	t := d.Targets[0]
+	t.InboundKey, t.SigningKey = "", ""
+	if c := flagHookCredentials.match(host); c != nil {
+		t.InboundKey, t.SigningKey = c.InboundKey, c.SigningKey
+	}
+	return d
+}
+
+// hookCredentialList 可重复的 --hook-credentials 参数，为 DNS TXT 记录中的 hook 主机单独配置密钥
+type hookCredentialList struct {
+	specs       []string
+	credentials []*hookCredential
+}
+
+// hookCredential 一个 hook 主机的密钥
+type hookCredential struct {
+	Host       string
+	InboundKey string
+	SigningKey string
+}
+
+func (l *hookCredentialList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(l.specs, ", ")
+}
+
+// Set 解析 "host; inbound-key=...; signing-key=..." 形式的参数，host 可以是 *.example.com
+func (l *hookCredentialList) Set(spec string) error {
+	fields := strings.Split(spec, ";")
+	c := &hookCredential{Host: strings.ToLower(strings.TrimSuffix(strings.TrimSpace(fields[0]), "."))}
+	if c.Host == "" || strings.ContainsAny(c.Host, " =/") {
+		return fmt.Errorf("invalid hook credentials host %q", fields[0])
+	}
+
+	for _, field := range fields[1:] {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid hook credentials option %q", field)
+		}
+
+		switch key, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]); key {
+		case "inbound-key":
+			c.InboundKey = value
+		case "signing-key":
+			c.SigningKey = value
+		default:
+			return fmt.Errorf("unknown hook credentials option %q", key)
+		}
+	}
+
+	l.specs = append(l.specs, spec)
+	l.credentials = append(l.credentials, c)
+	return nil
+}
+
+// match 返回 hook 主机的密钥：精确匹配优先，其次是最长的 *.example.com 通配
+func (l *hookCredentialList) match(host string) *hookCredential {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	var best *hookCredential
+	for _, c := range l.credentials {
+		if c.Host == host {
+			return c
+		}
+		if matchDomain(c.Host, host) && (best == nil || len(c.Host) > len(best.Host)) {
+			best = c
+		}
+	}
+	return best
+}
+
+// isHookHostAllowed 检查 hook 主机是否在 --allowed-hook-hosts 中，支持 *.example.com 通配。
+// 列表为空时拒绝所有主机：hook 由域名所有者指定，不加限制就能让网关向 127.0.0.1、
+// 169.254.169.254 或内网地址发送请求
+func isHookHostAllowed(host string) bool {
+	if *flagAllowedHookHosts == "" {
+		return false
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	for _, allowed := range strings.Split(*flagAllowedHookHosts, ",") {
+		allowed = strings.ToLower(strings.TrimSpace(allowed))
+		if allowed != "" && matchDomain(allowed, host) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/alash3al/smtp2http/signature"
+)
+
+// setFlag 在测试期间修改字符串参数，结束后恢复
+func setFlag(t *testing.T, p *string, value string) {
+	t.Helper()
+	old := *p
+	*p = value
+	t.Cleanup(func() { *p = old })
+}
+
+// setBoolFlag 在测试期间修改布尔参数，结束后恢复
+func setBoolFlag(t *testing.T, p *bool, value bool) {
+	t.Helper()
+	old := *p
+	*p = value
+	t.Cleanup(func() { *p = old })
+}
+
+// useTargets 在测试期间替换 --webhook、--route 和 --hook-credentials
+func useTargets(t *testing.T, webhooks, routes, credentials []string) {
+	t.Helper()
+	oldWebhooks, oldRoutes, oldCredentials := flagWebhooks, flagRoutes, flagHookCredentials
+	t.Cleanup(func() {
+		flagWebhooks, flagRoutes, flagHookCredentials = oldWebhooks, oldRoutes, oldCredentials
+	})
+
+	flagWebhooks, flagRoutes, flagHookCredentials = &webhookList{}, &routeList{}, &hookCredentialList{}
+	for _, spec := range webhooks {
+		if err := flagWebhooks.Set(spec); err != nil {
+			t.Fatalf("--webhook %q: %v", spec, err)
+		}
+	}
+	for _, spec := range routes {
+		if err := flagRoutes.Set(spec); err != nil {
+			t.Fatalf("--route %q: %v", spec, err)
+		}
+	}
+	for _, spec := range credentials {
+		if err := flagHookCredentials.Set(spec); err != nil {
+			t.Fatalf("--hook-credentials %q: %v", spec, err)
+		}
+	}
+}
+
+func deliveryURLs(d *Delivery) string {
+	if d == nil {
+		return ""
+	}
+	return d.URLs()
+}
+
+func TestResolveDeliveryPrecedence(t *testing.T) {
+	useTargets(t,
+		[]string{"https://global.test/hook"},
+		[]string{"routed.test=https://route.test/hook", "*.wild.test=https://wild-route.test/hook"},
+		nil)
+	setFlag(t, flagAllowedHookHosts, "*.tenant.test")
+
+	tests := []struct {
+		name    string
+		rcpt    string
+		record  *DNSTXTRecord
+		want    string
+		wantErr bool
+	}{
+		{"route without record", "a@routed.test", nil, "https://route.test/hook", false},
+		{"route wins over TXT hook", "a@routed.test", &DNSTXTRecord{Allow: true, Hook: "https://a.tenant.test/in"}, "https://route.test/hook", false},
+		{"wildcard route", "a@mx.wild.test", &DNSTXTRecord{Allow: true}, "https://wild-route.test/hook", false},
+		{"TXT hook wins over global", "a@other.test", &DNSTXTRecord{Allow: true, Hook: "https://a.tenant.test/in"}, "https://a.tenant.test/in", false},
+		{"record without hook", "a@other.test", &DNSTXTRecord{Allow: true}, "https://global.test/hook", false},
+		{"no route and no record", "a@other.test", nil, "https://global.test/hook", false},
+		{"hook host not allowed", "a@other.test", &DNSTXTRecord{Allow: true, Hook: "https://evil.test/in"}, "", true},
+		{"hook scheme not allowed", "a@other.test", &DNSTXTRecord{Allow: true, Hook: "file:///etc/passwd"}, "", true},
+		{"hook without host", "a@other.test", &DNSTXTRecord{Allow: true, Hook: "https:///in"}, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := resolveDelivery(tt.rcpt, tt.record)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resolveDelivery() error = %v, want error %v", err, tt.wantErr)
+			}
+			if got := deliveryURLs(d); got != tt.want {
+				t.Errorf("resolveDelivery() targets = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveDeliveryHookCredentials(t *testing.T) {
+	useTargets(t, []string{"https://global.test/hook"}, nil,
+		[]string{"a.tenant.test; inbound-key=tenant-key; signing-key=tenant-signing"})
+	setFlag(t, flagAllowedHookHosts, "*.tenant.test")
+	setFlag(t, flagInboundKey, "global-key")
+	setFlag(t, flagSigningKey, "global-signing")
+
+	d, err := resolveDelivery("x@other.test", &DNSTXTRecord{Allow: true, Hook: "https://a.tenant.test/in"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := d.Targets[0]; got.InboundKey != "tenant-key" || got.SigningKey != "tenant-signing" {
+		t.Errorf("configured hook got keys %q/%q, want the --hook-credentials keys", got.InboundKey, got.SigningKey)
+	}
+
+	d, err = resolveDelivery("x@other.test", &DNSTXTRecord{Allow: true, Hook: "https://b.tenant.test/in"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := d.Targets[0]; got.InboundKey != "" || got.SigningKey != "" {
+		t.Errorf("unconfigured hook got keys %q/%q, want none", got.InboundKey, got.SigningKey)
+	}
+
+	d, _ = resolveDelivery("x@other.test", nil)
+	if got := d.Targets[0]; got.InboundKey != "global-key" || got.SigningKey != "global-signing" {
+		t.Errorf("global webhook got keys %q/%q, want the global keys", got.InboundKey, got.SigningKey)
+	}
+}
+
+func TestIsHookHostAllowed(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed string
+		host    string
+		want    bool
+	}{
+		{"empty list denies public host", "", "hooks.example.net", false},
+		{"empty list denies loopback", "", "127.0.0.1", false},
+		{"empty list denies metadata address", "", "169.254.169.254", false},
+		{"empty list denies internal name", "", "localhost", false},
+		{"exact match", "hooks.example.net", "hooks.example.net", true},
+		{"case and trailing dot", "hooks.example.net", "Hooks.Example.NET.", true},
+		{"wildcard subdomain", "*.example.net", "a.b.example.net", true},
+		{"wildcard excludes apex", "*.example.net", "example.net", false},
+		{"wildcard excludes suffix lookalike", "*.example.net", "evilexample.net", false},
+		{"wildcard excludes IP", "*.0.0.1", "127.0.0.1", false},
+		{"second entry", "a.test, b.test", "b.test", true},
+		{"not listed", "a.test,b.test", "c.test", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, flagAllowedHookHosts, tt.allowed)
+			if got := isHookHostAllowed(tt.host); got != tt.want {
+				t.Errorf("isHookHostAllowed(%q) with %q = %v, want %v", tt.host, tt.allowed, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveDeliveryDomainSigningKey(t *testing.T) {
+	useTargets(t, []string{"https://global.test/hook"}, []string{"routed.test=https://route.test/hook"}, nil)
+	setFlag(t, flagSigningKey, "global-signing")
+	setBoolFlag(t, flagSignWithDomainSecret, true)
+
+	tests := []struct {
+		name   string
+		rcpt   string
+		record *DNSTXTRecord
+		want   string
+	}{
+		{"verified domain", "a@Other.test", &DNSTXTRecord{Allow: true}, signature.DomainKey([]byte("global-signing"), "other.test")},
+		{"verified routed domain", "a@routed.test", &DNSTXTRecord{Allow: true}, signature.DomainKey([]byte("global-signing"), "routed.test")},
+		{"unverified domain", "a@other.test", nil, "global-signing"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := resolveDelivery(tt.rcpt, tt.record)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := d.Targets[0].SigningKey; got != tt.want {
+				t.Errorf("signing key = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRouteListSet(t *testing.T) {
+	routes := &routeList{}
+	for _, spec := range []string{
+		"Example.test.=https://a.test/in",
+		"example.test=https://b.test/in; format=multipart",
+		"*.example.test=https://wild.test/in",
+	} {
+		if err := routes.Set(spec); err != nil {
+			t.Fatalf("Set(%q) = %v", spec, err)
+		}
+	}
+
+	if len(routes.routes) != 2 || routes.routes[0].Domain != "example.test" || len(routes.routes[0].Targets) != 2 {
+		t.Fatalf("routes = %+v, want the two example.test targets merged", routes.routes)
+	}
+	if got := routes.routes[0].Targets[1]; got.URL != "https://b.test/in" || got.Format != FormatMultipart {
+		t.Errorf("second target = %+v", got)
+	}
+
+	for _, spec := range []string{
+		"https://a.test/in",
+		"=https://a.test/in",
+		"exa mple.test=https://a.test/in",
+		"example.test/x=https://a.test/in",
+		"example.test=",
+		"example.test=https://a.test/in; format=xml",
+	} {
+		if err := (&routeList{}).Set(spec); err == nil {
+			t.Errorf("Set(%q) = nil error", spec)
+		}
+	}
+}
+
+func TestRouteListMatch(t *testing.T) {
+	useTargets(t, nil, []string{
+		"example.test=https://exact.test/in",
+		"*.example.test=https://wild.test/in",
+		"*.eu.example.test=https://eu.test/in",
+		"10.0.0.1=https://ip.test/in",
+	}, nil)
+
+	tests := []struct {
+		domain string
+		want   string
+	}{
+		{"example.test", "https://exact.test/in"},
+		{"EXAMPLE.test.", "https://exact.test/in"},
+		{"mx.example.test", "https://wild.test/in"},
+		{"a.b.example.test", "https://wild.test/in"},
+		{"mx.eu.example.test", "https://eu.test/in"},
+		{"eu.example.test", "https://wild.test/in"},
+		{"badexample.test", ""},
+		{"example.test.evil", ""},
+		{"10.0.0.1", "https://ip.test/in"},
+		{"other.test", ""},
+	}
+
+	for _, tt := range tests {
+		got := ""
+		if targets := flagRoutes.match(tt.domain); targets != nil {
+			got = targets[0].URL
+		}
+		if got != tt.want {
+			t.Errorf("match(%q) = %q, want %q", tt.domain, got, tt.want)
+		}
+	}
+}
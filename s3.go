@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3BlobStore S3 兼容对象存储（AWS S3、MinIO 等），使用 SigV4 签名上传和生成预签名下载链接
+type S3BlobStore struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	pathStyle bool
+	ttl       time.Duration
+	client    *http.Client
+}
+
+// NewS3BlobStore 创建 S3 兼容存储
+func NewS3BlobStore(endpoint, region, bucket, accessKey, secretKey string, pathStyle bool, ttl time.Duration) (*S3BlobStore, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint: %q", endpoint)
+	}
+
+	if bucket == "" || accessKey == "" || secretKey == "" {
+		return nil, fmt.Errorf("--s3-bucket, --s3-access-key and --s3-secret-key are required for the S3 blob store")
+	}
+
+	// SigV4 预签名链接最长有效 7 天
+	if ttl > 7*24*time.Hour {
+		ttl = 7 * 24 * time.Hour
+	}
+
+	return &S3BlobStore{
+		endpoint:  u,
+		region:    region,
+		bucket:    bucket,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		pathStyle: pathStyle,
+		ttl:       ttl,
+		client:    &http.Client{Timeout: 60 * time.Second},
+	}, nil
+}
+
+// objectURL 对象地址，path-style 为 endpoint/bucket/key，否则为 bucket.endpoint/key
+func (s *S3BlobStore) objectURL(key string) *url.URL {
+	u := *s.endpoint
+	if s.pathStyle {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.bucket + "/" + key
+	} else {
+		u.Host = s.bucket + "." + u.Host
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + key
+	}
+	return &u
+}
+
+// Put 上传对象并返回预签名的 GET 链接
+func (s *S3BlobStore) Put(key string, data []byte, contentType string) (string, error) {
+	u := s.objectURL(key)
+
+	req, err := http.NewRequest(http.MethodPut, u.String(), bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	sum := sha256.Sum256(data)
+	s.signRequest(req, hex.EncodeToString(sum[:]), time.Now().UTC())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return "", fmt.Errorf("S3 PUT %s failed: %s %s", key, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	return s.presign(http.MethodGet, u, s.ttl, time.Now().UTC()), nil
+}
+
+const (
+	sigV4Algorithm   = "AWS4-HMAC-SHA256"
+	sigV4TimeFormat  = "20060102T150405Z"
+	sigV4DateFormat  = "20060102"
+	sigV4Unsigned    = "UNSIGNED-PAYLOAD"
+	sigV4ServiceName = "s3"
+)
+
+// signRequest 为请求添加 SigV4 Authorization 头
+func (s *S3BlobStore) signRequest(req *http.Request, payloadHash string, now time.Time) {
+	req.Header.Set("Host", req.URL.Host)
+	req.Header.Set("X-Amz-Date", now.Format(sigV4TimeFormat))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	names := []string{}
+	for name := range req.Header {
+		names = append(names, strings.ToLower(name))
+	}
+	sort.Strings(names)
+
+	canonicalHeaders := ""
+	for _, name := range names {
+		canonicalHeaders += name + ":" + strings.TrimSpace(req.Header.Get(name)) + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3EscapePath(req.URL.Path),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := s.scope(now)
+	sig := s.signature(now, scope, canonicalRequest)
+
+	req.Header.Del("Host")
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sigV4Algorithm, s.accessKey, scope, signedHeaders, sig))
+}
+
+// presign 生成预签名 URL
+func (s *S3BlobStore) presign(method string, u *url.URL, ttl time.Duration, now time.Time) string {
+	scope := s.scope(now)
+
+	q := url.Values{}
+	q.Set("X-Amz-Algorithm", sigV4Algorithm)
+	q.Set("X-Amz-Credential", s.accessKey+"/"+scope)
+	q.Set("X-Amz-Date", now.Format(sigV4TimeFormat))
+	q.Set("X-Amz-Expires", strconv.Itoa(int(ttl/time.Second)))
+	q.Set("X-Amz-SignedHeaders", "host")
+
+	canonicalRequest := strings.Join([]string{
+		method,
+		s3EscapePath(u.Path),
+		canonicalQuery(q),
+		"host:" + u.Host + "\n",
+		"host",
+		sigV4Unsigned,
+	}, "\n")
+
+	q.Set("X-Amz-Signature", s.signature(now, scope, canonicalRequest))
+
+	signed := *u
+	signed.RawQuery = canonicalQuery(q)
+	return signed.String()
+}
+
+func (s *S3BlobStore) scope(now time.Time) string {
+	return now.Format(sigV4DateFormat) + "/" + s.region + "/" + sigV4ServiceName + "/aws4_request"
+}
+
+// signature 计算 SigV4 签名
+func (s *S3BlobStore) signature(now time.Time, scope, canonicalRequest string) string {
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := sigV4Algorithm + "\n" + now.Format(sigV4TimeFormat) + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), now.Format(sigV4DateFormat))
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, sigV4ServiceName)
+	key = hmacSHA256(key, "aws4_request")
+
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalQuery 按 SigV4 要求排序并编码查询参数
+func canonicalQuery(q url.Values) string {
+	keys := []string{}
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := []string{}
+	for _, k := range keys {
+		for _, v := range q[k] {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func s3EscapePath(p string) string {
+	if p == "" {
+		return "/"
+	}
+	return s3Escape(p, false)
+}
+
+// s3Escape 按 RFC 3986 编码，仅保留非保留字符；路径中保留 '/'
+func s3Escape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
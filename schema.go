@@ -0,0 +1,143 @@
+package main
+
+//go:generate go run . schema --out schema/email-message.schema.json
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// PayloadSchemaVersion payload 的版本，随 schema_version 字段发送。
+// 新增字段时增加次版本号，删除字段或改变字段含义时增加主版本号
+const PayloadSchemaVersion = "1.0"
+
+// PayloadSchemaID JSON Schema 的 $id，也是 CloudEvents 的 dataschema
+const PayloadSchemaID = "urn:smtp2http:schema:email-message:" + PayloadSchemaVersion
+
+// payloadSchema 由 EmailMessage 的类型定义生成 JSON Schema（draft 2020-12）：
+// 没有 omitempty 的字段为必填，json:"-" 的字段不出现，具名结构体放在 $defs 中
+func payloadSchema() map[string]interface{} {
+	defs := map[string]interface{}{}
+	root := schemaStruct(reflect.TypeOf(EmailMessage{}), defs)
+
+	schema := map[string]interface{}{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"$id":     PayloadSchemaID,
+		"title":   "smtp2http email message",
+	}
+	for k, v := range root {
+		schema[k] = v
+	}
+	schema["$defs"] = defs
+	return schema
+}
+
+// schemaType 单个类型的 schema
+func schemaType(t reflect.Type, defs map[string]interface{}) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return schemaType(t.Elem(), defs)
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "contentEncoding": "base64"}
+		}
+		return map[string]interface{}{"type": "array", "items": schemaType(t.Elem(), defs)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaType(t.Elem(), defs)}
+	case reflect.Struct:
+		// 匿名结构体（body、addresses）直接内联
+		if t.Name() == "" {
+			return schemaStruct(t, defs)
+		}
+		if _, exists := defs[t.Name()]; !exists {
+			defs[t.Name()] = nil // 先占位，避免递归类型无限展开
+			defs[t.Name()] = schemaStruct(t, defs)
+		}
+		return map[string]interface{}{"$ref": "#/$defs/" + t.Name()}
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+// schemaStruct 按 json 标签生成对象的 schema
+func schemaStruct(t reflect.Type, defs map[string]interface{}) map[string]interface{} {
+	properties := map[string]interface{}{}
+	required := []string{}
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts := tag, ""
+		if j := strings.IndexByte(tag, ','); j >= 0 {
+			name, opts = tag[:j], tag[j:]
+		}
+		if name == "" {
+			name = f.Name
+		}
+
+		prop := schemaType(f.Type, defs)
+		omitempty := strings.Contains(opts, ",omitempty")
+		if !omitempty {
+			required = append(required, name)
+			// 没有 omitempty 的指针、切片和 map 为空时序列化为 null
+			switch f.Type.Kind() {
+			case reflect.Ptr, reflect.Slice, reflect.Map:
+				prop = map[string]interface{}{"anyOf": []interface{}{prop, map[string]interface{}{"type": "null"}}}
+			}
+		}
+		properties[name] = prop
+	}
+
+	schema := map[string]interface{}{
+		"type":       "object",
+		"properties": properties,
+	}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// runSchema 实现 `smtp2http schema` 子命令：输出 webhook payload 的 JSON Schema
+func runSchema(args []string) error {
+	fs := flag.NewFlagSet("schema", flag.ExitOnError)
+	out := fs.String("out", "", "write the schema to this file instead of stdout")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s schema [flags]\n\nPrint the JSON Schema of the webhook payload (schema_version %s).\n\n", os.Args[0], PayloadSchemaVersion)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	data, err := json.MarshalIndent(payloadSchema(), "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	if *out == "" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return ioutil.WriteFile(*out, data, 0644)
+}
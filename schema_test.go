@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// 提交的 schema 文件必须与反射生成的一致，修改 EmailMessage 后运行 go generate 更新
+func TestCommittedSchemaUpToDate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "schema")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, "schema.json")
+	if err := runSchema([]string{"--out", out}); err != nil {
+		t.Fatalf("runSchema() = %v", err)
+	}
+
+	generated, _ := ioutil.ReadFile(out)
+	committed, err := ioutil.ReadFile("schema/email-message.schema.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(generated, committed) {
+		t.Error("schema/email-message.schema.json is out of date, run go generate")
+	}
+}
+
+func TestPayloadSchemaFields(t *testing.T) {
+	schema := payloadSchema()
+	if schema["$id"] != PayloadSchemaID {
+		t.Errorf("$id = %v, want %s", schema["$id"], PayloadSchemaID)
+	}
+
+	props, _ := schema["properties"].(map[string]interface{})
+	for _, name := range []string{"schema_version", "subject", "body", "addresses", "headers", "raw", "attachments"} {
+		if _, ok := props[name]; !ok {
+			t.Errorf("schema has no %s property", name)
+		}
+	}
+
+	defs, _ := schema["$defs"].(map[string]interface{})
+	attachment, _ := defs["EmailAttachment"].(map[string]interface{})
+	attachmentProps, _ := attachment["properties"].(map[string]interface{})
+	if _, ok := attachmentProps["Content"]; ok {
+		t.Error(`json:"-" field Content appears in the schema`)
+	}
+}
@@ -57,18 +57,60 @@ func (rl *RateLimiter) Allow(key string) bool {
 	return true
 }
 
-// 全局速率限制器
+// 全局速率限制器，解析参数后按 --rate-limit 创建
 var rateLimiter *RateLimiter
 
-func init() {
-	rateLimiter = NewRateLimiter(*flagMaxEmailsPerMin, time.Minute)
-}
-
 // SecurityCheck 安全检查结果
 type SecurityCheck struct {
-	Allowed bool
-	Reason  string
-	Score   int
+	Allowed   bool
+	Reason    string
+	Score     int
+	Threshold string        // 本次检查使用的限制，随结果一起发给 webhook
+	Record    *DNSTXTRecord // 通过验证的 DNS TXT 记录，仅 DNS 验证通过时设置
+}
+
+// Result 转换为 payload 中 security.checks 的一项
+func (c SecurityCheck) Result(name string) *EmailSecurityCheck {
+	return &EmailSecurityCheck{Name: name, Score: c.Score, Reason: c.Reason, Threshold: c.Threshold}
+}
+
+// 各项检查在 security.checks 中的名称
+const (
+	CheckNameRateLimit       = "rate_limit"
+	CheckNameRecipientDomain = "recipient_domain"
+	CheckNameDomain          = "domain"
+	CheckNameDNSTXT          = "dns_txt"
+	CheckNameSenderDomain    = "sender_domain"
+	CheckNameSPF             = "spf"
+	CheckNameSpamKeywords    = "spam_keywords"
+	CheckNameAttachments     = "attachments"
+)
+
+// 安全评分请求头
+const (
+	HeaderSpamScore = "X-Spam-Score"
+	HeaderSpamFlag  = "X-Spam-Flag"
+)
+
+func spamFlag(flagged bool) string {
+	if flagged {
+		return "YES"
+	}
+	return "NO"
+}
+
+// securityReport 汇总各项检查，生成 payload 中的 security 对象
+func securityReport(checks []*EmailSecurityCheck) *EmailSecurity {
+	report := &EmailSecurity{
+		Threshold:     *flagSpamRejectScore,
+		FlagThreshold: *flagSpamFlagScore,
+		Checks:        checks,
+	}
+	for _, c := range checks {
+		report.Score += c.Score
+	}
+	report.Flagged = report.Score >= *flagSpamFlagScore
+	return report
 }
 
 // ValidateRecipientDomain 验证收件人域名
@@ -76,6 +118,7 @@ func ValidateRecipientDomain(recipientEmail string) SecurityCheck {
 	if *flagAllowedDomains == "" {
 		return SecurityCheck{Allowed: true, Reason: "No domain restrictions"}
 	}
+	threshold := "allowed: " + *flagAllowedDomains
 
 	allowedDomains := strings.Split(*flagAllowedDomains, ",")
 	parts := strings.Split(recipientEmail, "@")
@@ -87,11 +130,11 @@ func ValidateRecipientDomain(recipientEmail string) SecurityCheck {
 
 	for _, domain := range allowedDomains {
 		if strings.ToLower(strings.TrimSpace(domain)) == recipientDomain {
-			return SecurityCheck{Allowed: true, Reason: "Domain allowed"}
+			return SecurityCheck{Allowed: true, Reason: "Domain allowed", Threshold: threshold}
 		}
 	}
 
-	return SecurityCheck{Allowed: false, Reason: fmt.Sprintf("Domain %s not in allowed list", recipientDomain)}
+	return SecurityCheck{Allowed: false, Reason: fmt.Sprintf("Domain %s not in allowed list", recipientDomain), Threshold: threshold}
 }
 
 // ValidateSenderDomain 验证发送者域名
@@ -99,30 +142,32 @@ func ValidateSenderDomain(senderEmail string) SecurityCheck {
 	if *flagBlacklistDomains == "" {
 		return SecurityCheck{Allowed: true, Reason: "No sender domain restrictions"}
 	}
+	threshold := "blacklisted: " + *flagBlacklistDomains
 
 	blacklistDomains := strings.Split(*flagBlacklistDomains, ",")
 	parts := strings.Split(senderEmail, "@")
 	if len(parts) != 2 {
-		return SecurityCheck{Allowed: true, Reason: "Invalid sender email format, allowing"}
+		return SecurityCheck{Allowed: true, Reason: "Invalid sender email format, allowing", Threshold: threshold}
 	}
 
 	senderDomain := strings.ToLower(strings.TrimSpace(parts[1]))
 
 	for _, domain := range blacklistDomains {
 		if strings.ToLower(strings.TrimSpace(domain)) == senderDomain {
-			return SecurityCheck{Allowed: false, Reason: fmt.Sprintf("Sender domain %s is blacklisted", senderDomain)}
+			return SecurityCheck{Allowed: false, Reason: fmt.Sprintf("Sender domain %s is blacklisted", senderDomain), Threshold: threshold}
 		}
 	}
 
-	return SecurityCheck{Allowed: true, Reason: "Sender domain not blacklisted"}
+	return SecurityCheck{Allowed: true, Reason: "Sender domain not blacklisted", Threshold: threshold}
 }
 
 // CheckRateLimit 检查速率限制
 func CheckRateLimit(clientIP string) SecurityCheck {
+	threshold := fmt.Sprintf("%d per minute per IP", *flagMaxEmailsPerMin)
 	if rateLimiter.Allow(clientIP) {
-		return SecurityCheck{Allowed: true, Reason: "Rate limit OK"}
+		return SecurityCheck{Allowed: true, Reason: "Rate limit OK", Threshold: threshold}
 	}
-	return SecurityCheck{Allowed: false, Reason: fmt.Sprintf("Rate limit exceeded for IP %s", clientIP)}
+	return SecurityCheck{Allowed: false, Reason: fmt.Sprintf("Rate limit exceeded for IP %s", clientIP), Threshold: threshold}
 }
 
 // CheckSpamKeywords 检查垃圾邮件关键词
@@ -133,25 +178,28 @@ func CheckSpamKeywords(subject, body string) SecurityCheck {
 
 	keywords := strings.Split(*flagSpamKeywords, ",")
 	content := strings.ToLower(subject + " " + body)
+	threshold := fmt.Sprintf("keywords: %d", len(keywords))
 
 	for _, keyword := range keywords {
 		keyword = strings.ToLower(strings.TrimSpace(keyword))
 		if keyword != "" && strings.Contains(content, keyword) {
 			return SecurityCheck{
-				Allowed: false,
-				Reason:  fmt.Sprintf("Contains spam keyword: %s", keyword),
-				Score:   50,
+				Allowed:   false,
+				Reason:    fmt.Sprintf("Contains spam keyword: %s", keyword),
+				Score:     50,
+				Threshold: threshold,
 			}
 		}
 	}
 
-	return SecurityCheck{Allowed: true, Reason: "No spam keywords detected"}
+	return SecurityCheck{Allowed: true, Reason: "No spam keywords detected", Threshold: threshold}
 }
 
 // CheckAttachments 检查附件安全性
 func CheckAttachments(attachments []*EmailAttachment) SecurityCheck {
+	threshold := fmt.Sprintf("max %d bytes, forbidden: %s", *flagMaxAttachSize, *flagForbiddenTypes)
 	if len(attachments) == 0 {
-		return SecurityCheck{Allowed: true, Reason: "No attachments"}
+		return SecurityCheck{Allowed: true, Reason: "No attachments", Threshold: threshold}
 	}
 
 	forbiddenTypes := strings.Split(*flagForbiddenTypes, ",")
@@ -165,9 +213,10 @@ func CheckAttachments(attachments []*EmailAttachment) SecurityCheck {
 				for _, forbiddenExt := range forbiddenTypes {
 					if strings.ToLower(strings.TrimSpace(forbiddenExt)) == ext {
 						return SecurityCheck{
-							Allowed: false,
-							Reason:  fmt.Sprintf("Forbidden file type: %s (%s)", ext, attachment.Filename),
-							Score:   80,
+							Allowed:   false,
+							Reason:    fmt.Sprintf("Forbidden file type: %s (%s)", ext, attachment.Filename),
+							Score:     80,
+							Threshold: threshold,
 						}
 					}
 				}
@@ -175,16 +224,17 @@ func CheckAttachments(attachments []*EmailAttachment) SecurityCheck {
 		}
 
 		// 检查文件大小
-		if len(attachment.Content) > int(*flagMaxAttachSize) {
+		if attachment.File().Len() > int(*flagMaxAttachSize) {
 			return SecurityCheck{
-				Allowed: false,
-				Reason:  fmt.Sprintf("Attachment too large: %s (%d bytes)", attachment.Filename, len(attachment.Content)),
-				Score:   30,
+				Allowed:   false,
+				Reason:    fmt.Sprintf("Attachment too large: %s (%d bytes)", attachment.Filename, attachment.File().Len()),
+				Score:     30,
+				Threshold: threshold,
 			}
 		}
 	}
 
-	return SecurityCheck{Allowed: true, Reason: "Attachments OK"}
+	return SecurityCheck{Allowed: true, Reason: "Attachments OK", Threshold: threshold}
 }
 
 // ValidateSPF 验证 SPF 记录
@@ -193,75 +243,81 @@ func ValidateSPF(spfResult string) SecurityCheck {
 		return SecurityCheck{Allowed: true, Reason: "SPF check disabled"}
 	}
 
+	threshold := "strict, fail rejects"
 	switch strings.ToLower(spfResult) {
 	case "pass":
-		return SecurityCheck{Allowed: true, Reason: "SPF verification passed"}
+		return SecurityCheck{Allowed: true, Reason: "SPF verification passed", Threshold: threshold}
 	case "fail":
-		return SecurityCheck{Allowed: false, Reason: "SPF verification failed", Score: 60}
+		return SecurityCheck{Allowed: false, Reason: "SPF verification failed", Score: 60, Threshold: threshold}
 	case "softfail":
-		return SecurityCheck{Allowed: true, Reason: "SPF soft fail, allowing", Score: 20}
+		return SecurityCheck{Allowed: true, Reason: "SPF soft fail, allowing", Score: 20, Threshold: threshold}
 	case "neutral", "none":
-		return SecurityCheck{Allowed: true, Reason: "No SPF record or neutral", Score: 10}
+		return SecurityCheck{Allowed: true, Reason: "No SPF record or neutral", Score: 10, Threshold: threshold}
 	default:
-		return SecurityCheck{Allowed: true, Reason: "SPF result unknown, allowing", Score: 5}
+		return SecurityCheck{Allowed: true, Reason: "SPF result unknown, allowing", Score: 5, Threshold: threshold}
 	}
 }
 
-// PerformSecurityChecks 执行所有安全检查
-func PerformSecurityChecks(clientIP, senderEmail, recipientEmail, subject, body, spfResult string, attachments []*EmailAttachment) (bool, string, int) {
+// PerformSecurityChecks 执行邮件级别的安全检查，同时返回执行过的各项检查；
+// 速率限制和收件人域名在 RCPT 阶段按收件人检查，见 smtpserver.go
+func PerformSecurityChecks(senderEmail, subject, body, spfResult string, attachments []*EmailAttachment) (bool, string, int, []*EmailSecurityCheck) {
 	var totalScore int
 	var reasons []string
+	checks := []*EmailSecurityCheck{}
 
-	// 1. 速率限制检查
-	if check := CheckRateLimit(clientIP); !check.Allowed {
-		return false, check.Reason, 100
+	// 1. 发送者域名验证
+	check := ValidateSenderDomain(senderEmail)
+	if !check.Allowed {
+		return false, check.Reason, 100, checks
 	}
+	checks = append(checks, check.Result(CheckNameSenderDomain))
 
-	// 2. 收件人域名验证
-	if check := ValidateRecipientDomain(recipientEmail); !check.Allowed {
-		return false, check.Reason, 100
+	// 2. SPF 验证
+	check = ValidateSPF(spfResult)
+	if !check.Allowed {
+		return false, check.Reason, check.Score, checks
 	}
-
-	// 3. 发送者域名验证
-	if check := ValidateSenderDomain(senderEmail); !check.Allowed {
-		return false, check.Reason, 100
-	}
-
-	// 4. SPF 验证
-	if check := ValidateSPF(spfResult); !check.Allowed {
-		return false, check.Reason, check.Score
-	} else if check.Score > 0 {
+	checks = append(checks, check.Result(CheckNameSPF))
+	if check.Score > 0 {
 		totalScore += check.Score
 		reasons = append(reasons, check.Reason)
 	}
 
-	// 5. 垃圾邮件关键词检查
-	if check := CheckSpamKeywords(subject, body); !check.Allowed {
-		return false, check.Reason, check.Score
-	} else if check.Score > 0 {
+	// 3. 垃圾邮件关键词检查
+	check = CheckSpamKeywords(subject, body)
+	if !check.Allowed {
+		return false, check.Reason, check.Score, checks
+	}
+	checks = append(checks, check.Result(CheckNameSpamKeywords))
+	if check.Score > 0 {
 		totalScore += check.Score
 		reasons = append(reasons, check.Reason)
 	}
 
-	// 6. 附件安全检查
-	if check := CheckAttachments(attachments); !check.Allowed {
-		return false, check.Reason, check.Score
-	} else if check.Score > 0 {
-		totalScore += check.Score
-		reasons = append(reasons, check.Reason)
+	// 4. 附件安全检查，attachments 为 nil 时由调用方解析附件后单独检查
+	if attachments != nil {
+		check = CheckAttachments(attachments)
+		if !check.Allowed {
+			return false, check.Reason, check.Score, checks
+		}
+		checks = append(checks, check.Result(CheckNameAttachments))
+		if check.Score > 0 {
+			totalScore += check.Score
+			reasons = append(reasons, check.Reason)
+		}
 	}
 
 	// 综合评分判断
-	if totalScore >= 70 {
+	if totalScore >= *flagSpamRejectScore {
 		reasonStr := strings.Join(reasons, "; ")
-		return false, fmt.Sprintf("High security risk score: %d (%s)", totalScore, reasonStr), totalScore
+		return false, fmt.Sprintf("High security risk score: %d (%s)", totalScore, reasonStr), totalScore, checks
 	}
 
 	if len(reasons) > 0 {
 		log.Printf("Email flagged with security score %d: %s", totalScore, strings.Join(reasons, "; "))
 	}
 
-	return true, "Security checks passed", totalScore
+	return true, "Security checks passed", totalScore, checks
 }
 
 // GetClientIP 获取客户端 IP 地址
@@ -485,5 +541,5 @@ func validateDNSRecord(record *DNSTXTRecord, requiredSecret, domain string) Secu
 	}
 
 	log.Printf("DNS TXT: Domain %s validation passed", domain)
-	return SecurityCheck{Allowed: true, Reason: fmt.Sprintf("Domain %s validated via DNS TXT", domain)}
+	return SecurityCheck{Allowed: true, Reason: fmt.Sprintf("Domain %s validated via DNS TXT", domain), Record: record}
 }
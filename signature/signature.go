@@ -0,0 +1,240 @@
+// Package signature 提供 smtp2http webhook 请求签名的生成与校验。
+//
+// 签名为 HMAC-SHA256(key, timestamp + "." + id + "." + body)，以 "sha256=<hex>" 形式放在
+// X-Smtp2http-Signature 头中，timestamp 为 Unix 秒，放在 X-Smtp2http-Timestamp 头中，
+// id 为每个请求随机生成的投递 ID，放在 X-Smtp2http-Delivery-Id 头中。
+// 接收方可直接使用 Verifier 校验请求并拒绝重放。
+package signature
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// HeaderSignature 签名头
+	HeaderSignature = "X-Smtp2http-Signature"
+	// HeaderTimestamp 时间戳头
+	HeaderTimestamp = "X-Smtp2http-Timestamp"
+	// HeaderDeliveryID 投递 ID 头，参与签名，重试时也会重新生成
+	HeaderDeliveryID = "X-Smtp2http-Delivery-Id"
+
+	// DefaultTolerance 默认允许的时间偏差
+	DefaultTolerance = 5 * time.Minute
+	// DefaultMaxBodySize Verifier 默认读取的最大请求体
+	DefaultMaxBodySize = 64 << 20
+
+	prefix = "sha256="
+)
+
+var (
+	ErrMissingHeader    = errors.New("signature: missing signature, timestamp or delivery ID header")
+	ErrInvalidTimestamp = errors.New("signature: invalid timestamp")
+	ErrExpired          = errors.New("signature: timestamp outside tolerance")
+	ErrMismatch         = errors.New("signature: signature mismatch")
+	ErrReplayed         = errors.New("signature: request already seen")
+	ErrTooLarge         = errors.New("signature: request body too large")
+)
+
+// Sign 计算 body 在指定时间戳和投递 ID 下的签名
+func Sign(key []byte, timestamp int64, id string, body []byte) string {
+	s := NewSigner(key, timestamp, id)
+	s.Write(body)
+	return s.Sum()
+}
+
+// NewDeliveryID 生成随机的投递 ID
+func NewDeliveryID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Signer 流式计算签名，用于不在内存中保留完整请求体的发送方
+type Signer struct {
+	mac hash.Hash
+}
+
+// NewSigner 创建签名器，之后将请求体依次写入
+func NewSigner(key []byte, timestamp int64, id string) *Signer {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write([]byte(id))
+	mac.Write([]byte("."))
+	return &Signer{mac: mac}
+}
+
+// Write 写入请求体的一部分
+func (s *Signer) Write(p []byte) (int, error) {
+	return s.mac.Write(p)
+}
+
+// Sum 返回 "sha256=<hex>" 形式的签名
+func (s *Signer) Sum() string {
+	return prefix + hex.EncodeToString(s.mac.Sum(nil))
+}
+
+// DomainKey 由主密钥为单个域名派生签名密钥：hex(HMAC-SHA256(key, 小写域名))。
+// 各域名的接收方只拿到自己的密钥，无法为其他域名伪造签名
+func DomainKey(key []byte, domain string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(strings.ToLower(strings.TrimSuffix(domain, "."))))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignRequest 为请求设置时间戳、投递 ID 和签名头
+func SignRequest(header http.Header, key []byte, body []byte, now time.Time) {
+	ts, id := now.Unix(), NewDeliveryID()
+	header.Set(HeaderTimestamp, strconv.FormatInt(ts, 10))
+	header.Set(HeaderDeliveryID, id)
+	header.Set(HeaderSignature, Sign(key, ts, id, body))
+}
+
+// Verify 校验签名和时间戳，不做重放检查；tolerance 为 0 时使用 DefaultTolerance
+func Verify(key []byte, timestamp, id, signature string, body []byte, tolerance time.Duration, now time.Time) error {
+	if timestamp == "" || id == "" || signature == "" {
+		return ErrMissingHeader
+	}
+
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrInvalidTimestamp
+	}
+
+	if tolerance <= 0 {
+		tolerance = DefaultTolerance
+	}
+
+	delta := now.Sub(time.Unix(ts, 0))
+	if delta < 0 {
+		delta = -delta
+	}
+	if delta > tolerance {
+		return ErrExpired
+	}
+
+	if !strings.HasPrefix(signature, prefix) {
+		return ErrMismatch
+	}
+
+	if !hmac.Equal([]byte(Sign(key, ts, id, body)), []byte(signature)) {
+		return ErrMismatch
+	}
+
+	return nil
+}
+
+// Verifier 接收方使用的校验器，带有重放保护
+type Verifier struct {
+	Key         []byte
+	Tolerance   time.Duration // 为 0 时使用 DefaultTolerance
+	MaxBodySize int64         // 超过时返回 ErrTooLarge，为 0 时使用 DefaultMaxBodySize
+
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+// NewVerifier 创建校验器，tolerance 为 0 时使用 DefaultTolerance
+func NewVerifier(key []byte, tolerance time.Duration) *Verifier {
+	if tolerance <= 0 {
+		tolerance = DefaultTolerance
+	}
+
+	return &Verifier{
+		Key:         key,
+		Tolerance:   tolerance,
+		MaxBodySize: DefaultMaxBodySize,
+		seen:        make(map[string]time.Time),
+	}
+}
+
+// VerifyRequest 读取并校验请求体，校验后请求体仍可再次读取
+func (v *Verifier) VerifyRequest(r *http.Request) ([]byte, error) {
+	limit := v.MaxBodySize
+	if limit <= 0 {
+		limit = DefaultMaxBodySize
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, limit))
+	r.Body.Close()
+	if err != nil {
+		if int64(len(body)) >= limit {
+			return nil, ErrTooLarge
+		}
+		return nil, err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	timestamp, id := r.Header.Get(HeaderTimestamp), r.Header.Get(HeaderDeliveryID)
+	signature := r.Header.Get(HeaderSignature)
+	if err := Verify(v.Key, timestamp, id, signature, body, v.tolerance(), time.Now()); err != nil {
+		return nil, err
+	}
+
+	// 按时间戳和投递 ID 去重，相同内容的两次投递不会互相冲突
+	if !v.remember(timestamp + "." + id) {
+		return nil, ErrReplayed
+	}
+
+	return body, nil
+}
+
+// Middleware 包装 handler，签名无效时返回 401，请求体过大时返回 413
+func (v *Verifier) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := v.VerifyRequest(r); err != nil {
+			status := http.StatusUnauthorized
+			if err == ErrTooLarge {
+				status = http.StatusRequestEntityTooLarge
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// remember 记录请求，已见过则返回 false；记录在超出时间窗口后清理
+func (v *Verifier) remember(key string) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.seen == nil {
+		v.seen = make(map[string]time.Time)
+	}
+
+	now := time.Now()
+	for k, expires := range v.seen {
+		if now.After(expires) {
+			delete(v.seen, k)
+		}
+	}
+
+	if _, exists := v.seen[key]; exists {
+		return false
+	}
+
+	// 时间戳允许前后各偏差 Tolerance，记录保留两倍窗口
+	v.seen[key] = now.Add(2 * v.tolerance())
+	return true
+}
+
+// tolerance 零值的 Verifier 也要检查时间戳并保留重放记录
+func (v *Verifier) tolerance() time.Duration {
+	if v.Tolerance <= 0 {
+		return DefaultTolerance
+	}
+	return v.Tolerance
+}
@@ -0,0 +1,195 @@
+package signature
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	key := []byte("signing-key")
+	now := time.Unix(1700000000, 0)
+	body := []byte(`{"subject":"hello"}`)
+	ts := strconv.FormatInt(now.Unix(), 10)
+	sig := Sign(key, now.Unix(), "id-1", body)
+
+	tests := []struct {
+		name      string
+		key       []byte
+		timestamp string
+		id        string
+		signature string
+		body      []byte
+		now       time.Time
+		want      error
+	}{
+		{"valid", key, ts, "id-1", sig, body, now, nil},
+		{"valid within tolerance", key, ts, "id-1", sig, body, now.Add(4 * time.Minute), nil},
+		{"tampered body", key, ts, "id-1", sig, []byte(`{"subject":"hellO"}`), now, ErrMismatch},
+		{"tampered delivery id", key, ts, "id-2", sig, body, now, ErrMismatch},
+		{"stripped delivery id", key, ts, "", sig, body, now, ErrMissingHeader},
+		{"wrong key", []byte("other-key"), ts, "id-1", sig, body, now, ErrMismatch},
+		{"expired timestamp", key, ts, "id-1", sig, body, now.Add(6 * time.Minute), ErrExpired},
+		{"future timestamp", key, ts, "id-1", sig, body, now.Add(-6 * time.Minute), ErrExpired},
+		{"invalid timestamp", key, "yesterday", "id-1", sig, body, now, ErrInvalidTimestamp},
+		{"missing signature", key, ts, "id-1", "", body, now, ErrMissingHeader},
+		{"missing prefix", key, ts, "id-1", strings.TrimPrefix(sig, prefix), body, now, ErrMismatch},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := Verify(tt.key, tt.timestamp, tt.id, tt.signature, tt.body, DefaultTolerance, tt.now); err != tt.want {
+				t.Errorf("Verify() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyZeroTolerance(t *testing.T) {
+	key := []byte("signing-key")
+	now := time.Unix(1700000000, 0)
+	body := []byte("body")
+	sig := Sign(key, now.Unix(), "id-1", body)
+
+	if err := Verify(key, strconv.FormatInt(now.Unix(), 10), "id-1", sig, body, 0, now.Add(time.Hour)); err != ErrExpired {
+		t.Errorf("Verify() with zero tolerance = %v, want %v", err, ErrExpired)
+	}
+}
+
+func TestSignerMatchesSign(t *testing.T) {
+	key := []byte("signing-key")
+	s := NewSigner(key, 42, "id")
+	s.Write([]byte("hello, "))
+	s.Write([]byte("world"))
+
+	if got, want := s.Sum(), Sign(key, 42, "id", []byte("hello, world")); got != want {
+		t.Errorf("streamed signature %s, want %s", got, want)
+	}
+}
+
+func TestDomainKey(t *testing.T) {
+	key := []byte("signing-key")
+
+	if DomainKey(key, "Example.COM.") != DomainKey(key, "example.com") {
+		t.Error("domain key should ignore case and the trailing dot")
+	}
+	if DomainKey(key, "a.example.com") == DomainKey(key, "b.example.com") {
+		t.Error("different domains should get different keys")
+	}
+	if DomainKey(key, "example.com") == DomainKey([]byte("other-key"), "example.com") {
+		t.Error("different master keys should give different domain keys")
+	}
+}
+
+func newSignedRequest(key, body []byte, now time.Time) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/inbound", bytes.NewReader(body))
+	SignRequest(r.Header, key, body, now)
+	return r
+}
+
+func TestVerifyRequest(t *testing.T) {
+	key := []byte("signing-key")
+	body := []byte(`{"subject":"hello"}`)
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		request func(v *Verifier) *http.Request
+		want    error
+	}{
+		{"valid", func(v *Verifier) *http.Request {
+			return newSignedRequest(key, body, now)
+		}, nil},
+		{"tampered body", func(v *Verifier) *http.Request {
+			r := newSignedRequest(key, body, now)
+			r.Body = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"subject":"bye"}`)).Body
+			return r
+		}, ErrMismatch},
+		{"expired timestamp", func(v *Verifier) *http.Request {
+			return newSignedRequest(key, body, now.Add(-time.Hour))
+		}, ErrExpired},
+		{"wrong key", func(v *Verifier) *http.Request {
+			return newSignedRequest([]byte("other-key"), body, now)
+		}, ErrMismatch},
+		{"replayed signature", func(v *Verifier) *http.Request {
+			first := newSignedRequest(key, body, now)
+			if _, err := v.VerifyRequest(first); err != nil {
+				t.Fatalf("first request: %v", err)
+			}
+			replay := httptest.NewRequest(http.MethodPost, "/inbound", bytes.NewReader(body))
+			replay.Header = first.Header.Clone()
+			return replay
+		}, ErrReplayed},
+		{"identical delivery in the same second", func(v *Verifier) *http.Request {
+			if _, err := v.VerifyRequest(newSignedRequest(key, body, now)); err != nil {
+				t.Fatalf("first request: %v", err)
+			}
+			return newSignedRequest(key, body, now)
+		}, nil},
+		{"missing delivery id", func(v *Verifier) *http.Request {
+			r := newSignedRequest(key, body, now)
+			r.Header.Del(HeaderDeliveryID)
+			return r
+		}, ErrMissingHeader},
+		{"body too large", func(v *Verifier) *http.Request {
+			v.MaxBodySize = 8
+			return newSignedRequest(key, body, now)
+		}, ErrTooLarge},
+	}
+
+	// Verifier 字面量的零值也必须检查时间戳和重放
+	verifiers := map[string]func() *Verifier{
+		"NewVerifier": func() *Verifier { return NewVerifier(key, 0) },
+		"zero value":  func() *Verifier { return &Verifier{Key: key} },
+	}
+
+	for kind, newVerifier := range verifiers {
+		for _, tt := range tests {
+			t.Run(kind+"/"+tt.name, func(t *testing.T) {
+				v := newVerifier()
+				got, err := v.VerifyRequest(tt.request(v))
+				if err != tt.want {
+					t.Fatalf("VerifyRequest() = %v, want %v", err, tt.want)
+				}
+				if err == nil && !bytes.Equal(got, body) {
+					t.Errorf("VerifyRequest() body = %q, want %q", got, body)
+				}
+			})
+		}
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	key := []byte("signing-key")
+	body := []byte("hello")
+	v := NewVerifier(key, 0)
+
+	var read []byte
+	handler := v.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		read = make([]byte, len(body))
+		r.Body.Read(read)
+	}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, newSignedRequest(key, body, time.Now()))
+	if rec.Code != http.StatusOK || !bytes.Equal(read, body) {
+		t.Errorf("valid request: status %d, body %q", rec.Code, read)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, newSignedRequest([]byte("other-key"), body, time.Now()))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("wrong key: status %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+
+	v.MaxBodySize = 2
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, newSignedRequest(key, body, time.Now()))
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("large body: status %d, want %d", rec.Code, http.StatusRequestEntityTooLarge)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// Sink 邮件的投递目的地，由目标 URL 的 scheme 选择：
+//
+//	http://、https://  POST 到 webhook（默认）
+//	file:///path       追加到 JSONL 文件，每封邮件一行
+//	maildir:///path    写入 Maildir 目录，每封邮件一个文件
+//	stdout:            每封邮件一行 JSON 写到标准输出
+//	unix:///path       通过 Unix 套接字长连接发送，每封邮件一行 JSON
+//	exec:///path       每封邮件运行一次本地命令，见 exec.go
+//	grpc://host:port   调用 deliverypb.Delivery/Deliver，grpcs:// 使用 TLS，见 grpc.go
+type Sink interface {
+	Deliver(target *WebhookTarget, msg *EmailMessage) error
+}
+
+// parseSinkURL 校验目标 URL，返回 scheme 和本地路径（HTTP 目标路径为空）
+func parseSinkURL(raw string) (string, string, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid target URL %q: %v", raw, err)
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		if u.Host == "" {
+			return "", "", fmt.Errorf("invalid webhook URL: %q", raw)
+		}
+		return u.Scheme, "", nil
+	case "grpc", "grpcs":
+		if u.Host == "" || u.Port() == "" {
+			return "", "", fmt.Errorf("invalid %s target %q, expected %s://host:port", u.Scheme, raw, u.Scheme)
+		}
+		return u.Scheme, "", nil
+	case "stdout":
+		return u.Scheme, "", nil
+	case "file", "maildir", "unix", "exec":
+		if u.Host != "" || u.Path == "" {
+			return "", "", fmt.Errorf("invalid %s target %q, expected %s:///absolute/path", u.Scheme, raw, u.Scheme)
+		}
+		if u.Scheme == "exec" {
+			if stdin := u.Query().Get("stdin"); stdin != "" && stdin != "json" && stdin != "raw" {
+				return "", "", fmt.Errorf("invalid exec stdin %q, expected json or raw", stdin)
+			}
+		}
+		return u.Scheme, u.Path, nil
+	default:
+		return "", "", fmt.Errorf("unsupported target scheme %q in %q", u.Scheme, raw)
+	}
+}
+
+// sinks 已打开的 sink，按 URL 复用，保证同一文件或套接字的写入是串行的
+var sinks = struct {
+	sync.Mutex
+	m map[string]Sink
+}{m: map[string]Sink{}}
+
+// sinkFor 返回目标对应的 sink，首次使用时打开
+func sinkFor(target *WebhookTarget) (Sink, error) {
+	scheme, path, err := parseSinkURL(target.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	if scheme == "http" || scheme == "https" {
+		if target.Batch && batcher != nil {
+			return batcher, nil
+		}
+		return httpSink{}, nil
+	}
+
+	sinks.Lock()
+	defer sinks.Unlock()
+
+	if s, exists := sinks.m[target.URL]; exists {
+		return s, nil
+	}
+
+	var s Sink
+	switch scheme {
+	case "file":
+		s, err = NewFileSink(path)
+	case "maildir":
+		s, err = NewMaildirSink(path)
+	case "stdout":
+		s = &lineSink{w: sinkStdout}
+	case "unix":
+		s = &streamSink{socket: path}
+	case "exec":
+		u, _ := url.Parse(target.URL)
+		s, err = NewExecSink(u)
+	case "grpc", "grpcs":
+		u, _ := url.Parse(target.URL)
+		s, err = NewGRPCSink(u)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sinks.m[target.URL] = s
+	return s, nil
+}
+
+// sinkStdout stdout: sink 使用的标准输出
+var sinkStdout io.Writer = os.Stdout
+
+// httpSink 当前的 webhook 行为
+type httpSink struct{}
+
+func (httpSink) Deliver(target *WebhookTarget, msg *EmailMessage) error {
+	return postWebhook(target, msg)
+}
+
+// sinkError 本地 sink 写入失败，视为临时失败
+func sinkError(err error) error {
+	return &DeliveryError{Code: "E6", Err: err}
+}
+
+// encodeLine 编码为单行 JSON，非 HTTP sink 总是使用完整的 JSON 格式
+func encodeLine(msg *EmailMessage) ([]byte, error) {
+	line, err := json.Marshal(msg)
+	if err != nil {
+		return nil, &DeliveryError{Code: "E1", Permanent: true, Err: fmt.Errorf("cannot encode message: %v", err)}
+	}
+	return append(line, '\n'), nil
+}
+
+// lineSink 将每封邮件作为一行 JSON 写入 w
+type lineSink struct {
+	mu   sync.Mutex
+	w    io.Writer
+	sync func() error
+}
+
+// NewFileSink 以追加模式打开 JSONL 文件
+func NewFileSink(path string) (Sink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open file sink: %v", err)
+	}
+	return &lineSink{w: f, sync: f.Sync}, nil
+}
+
+func (s *lineSink) Deliver(target *WebhookTarget, msg *EmailMessage) error {
+	line, err := encodeLine(msg)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// 一次写入整行，O_APPEND 保证多个进程写同一文件时行不会交错
+	if _, err := s.w.Write(line); err != nil {
+		return sinkError(fmt.Errorf("cannot write to %s: %v", target.URL, err))
+	}
+
+	// 回复 SMTP 250 之前确保已落盘
+	if s.sync != nil {
+		if err := s.sync(); err != nil {
+			return sinkError(fmt.Errorf("cannot sync %s: %v", target.URL, err))
+		}
+	}
+
+	return nil
+}
+
+// streamSink 通过 Unix 套接字长连接发送，断开后在下一次投递时重连
+type streamSink struct {
+	mu     sync.Mutex
+	socket string
+	conn   net.Conn
+}
+
+func (s *streamSink) Deliver(target *WebhookTarget, msg *EmailMessage) error {
+	line, err := encodeLine(msg)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// 已有连接可能已被对端关闭，失败时重连一次
+	for attempt := 0; attempt < 2; attempt++ {
+		if s.conn == nil {
+			conn, err := net.DialTimeout("unix", s.socket, 10*time.Second)
+			if err != nil {
+				return sinkError(fmt.Errorf("cannot connect to %s: %v", s.socket, err))
+			}
+			s.conn = conn
+			log.Printf("SINK: Connected to %s", s.socket)
+		}
+
+		s.conn.SetWriteDeadline(time.Now().Add(*flagWebhookTimeout))
+		if _, err = s.conn.Write(line); err == nil {
+			return nil
+		}
+
+		s.conn.Close()
+		s.conn = nil
+	}
+
+	return sinkError(fmt.Errorf("cannot write to %s: %v", s.socket, err))
+}
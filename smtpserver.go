@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/alash3al/go-smtpsrv"
+	"github.com/emersion/go-smtp"
+	"github.com/zaccone/spf"
+)
+
+// Backend go-smtp 后端。go-smtpsrv 的会话只保留最后一个 RCPT TO，这里记录完整的信封，
+// 并在 RCPT 阶段逐个校验收件人，被拒绝的收件人各自得到 SMTP 错误，不影响其他收件人
+type Backend struct {
+	handler func(*Session) error
+}
+
+// Login 未开启 SMTP AUTH
+func (b *Backend) Login(state *smtp.ConnectionState, username, password string) (smtp.Session, error) {
+	return nil, smtp.ErrAuthUnsupported
+}
+
+// AnonymousLogin 每个连接一个会话
+func (b *Backend) AnonymousLogin(state *smtp.ConnectionState) (smtp.Session, error) {
+	return &Session{state: state, handler: b.handler}, nil
+}
+
+// Recipient 通过校验的信封收件人及其投递计划
+type Recipient struct {
+	Address  string
+	Delivery *Delivery
+	Checks   []*EmailSecurityCheck // RCPT 阶段执行的安全检查
+}
+
+// Session 一个 SMTP 连接上当前的邮件事务
+type Session struct {
+	state   *smtp.ConnectionState
+	handler func(*Session) error
+
+	// 反向解析结果在同一连接的多封邮件之间复用
+	rdns       string
+	rdnsLooked bool
+
+	from       *mail.Address
+	rcpts      []*Recipient
+	body       io.Reader
+	header     []byte              // 原始的邮件头，Parse 时读取
+	raw        *rawCapture         // --raw-message 开启时记录原始邮件
+	rateLimit  *EmailSecurityCheck // DATA 阶段的速率限制结果
+	receivedAt time.Time
+}
+
+// Mail 开始新的事务
+func (s *Session) Mail(from string, opts smtp.MailOptions) (err error) {
+	s.Reset()
+	s.from, err = mail.ParseAddress(from)
+	return
+}
+
+// Rcpt 校验收件人，通过后记录其投递计划
+func (s *Session) Rcpt(to string) error {
+	addr, err := mail.ParseAddress(to)
+	if err != nil {
+		return &smtp.SMTPError{
+			Code:         501,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 3},
+			Message:      "Bad recipient address syntax",
+		}
+	}
+
+	// 同一事务中重复的收件人只投递一次
+	for _, r := range s.rcpts {
+		if strings.EqualFold(r.Address, addr.Address) {
+			return nil
+		}
+	}
+
+	delivery, checks, err := checkRecipient(s.ClientIP(), s.from.Address, addr.Address)
+	if err != nil {
+		return err
+	}
+
+	s.rcpts = append(s.rcpts, &Recipient{Address: addr.Address, Delivery: delivery, Checks: checks})
+	return nil
+}
+
+// Data 收到邮件内容后交给 handler。速率限制按事务计数，无论有多少收件人，一封邮件只计一次
+func (s *Session) Data(r io.Reader) error {
+	check := CheckRateLimit(s.ClientIP())
+	if !check.Allowed {
+		log.Printf("SMTP: Message deferred: %s (From: %s, IP: %s)", check.Reason, s.from.Address, s.ClientIP())
+		return &smtp.SMTPError{
+			Code:         450,
+			EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+			Message:      check.Reason,
+		}
+	}
+	s.rateLimit = check.Result(CheckNameRateLimit)
+
+	s.body, s.receivedAt = r, time.Now()
+	if *flagRawMessage != RawNone {
+		s.raw = newRawCapture(*flagRawMaxSize)
+		s.body = io.TeeReader(r, s.raw)
+	}
+	return s.handler(s)
+}
+
+// Reset 丢弃当前事务
+func (s *Session) Reset() {
+	s.from, s.rcpts, s.body, s.header, s.raw, s.rateLimit = nil, nil, nil, nil, nil, nil
+}
+
+// Logout 连接关闭
+func (s *Session) Logout() error {
+	return nil
+}
+
+// From 信封发件人
+func (s *Session) From() *mail.Address {
+	return s.from
+}
+
+// RateLimit 本次事务的速率限制检查结果
+func (s *Session) RateLimit() *EmailSecurityCheck {
+	return s.rateLimit
+}
+
+// Recipients 通过校验的信封收件人，按 RCPT TO 的顺序
+func (s *Session) Recipients() []*Recipient {
+	return s.rcpts
+}
+
+// RemoteAddr 客户端地址
+func (s *Session) RemoteAddr() net.Addr {
+	return s.state.RemoteAddr
+}
+
+// ClientIP 客户端 IP
+func (s *Session) ClientIP() string {
+	return GetClientIP(s.state.RemoteAddr.String())
+}
+
+// Parse 解析邮件内容
+func (s *Session) Parse() (*smtpsrv.Email, error) {
+	// 解析器只提供合并后的邮件头，这里先读出原始的头部分，保留顺序和重复的头
+	br := bufio.NewReader(s.body)
+	header, err := readHeaderBlock(br)
+	if err != nil {
+		return nil, err
+	}
+	s.header = header
+
+	email, err := smtpsrv.ParseEmail(io.MultiReader(bytes.NewReader(header), br))
+	if err != nil {
+		return nil, err
+	}
+
+	// 解析器不一定读到 DATA 的结尾，剩余部分也属于原始邮件
+	if s.raw != nil {
+		if _, err := io.Copy(ioutil.Discard, s.body); err != nil {
+			return nil, err
+		}
+	}
+
+	return email, nil
+}
+
+// Headers 按原始顺序排列的邮件头，需在 Parse 之后调用
+func (s *Session) Headers() []*EmailHeader {
+	return parseHeaders(s.header)
+}
+
+// Raw 原始邮件，需在 Parse 之后调用；未开启 --raw-message 时为 nil
+func (s *Session) Raw() *EmailRaw {
+	if s.raw == nil {
+		return nil
+	}
+	return s.raw.Message()
+}
+
+// Envelope 信封发件人和全部通过校验的收件人
+func (s *Session) Envelope() *EmailEnvelope {
+	rcpts := []string{}
+	for _, r := range s.rcpts {
+		rcpts = append(rcpts, r.Address)
+	}
+	return &EmailEnvelope{MailFrom: s.from.Address, RcptTo: rcpts}
+}
+
+// Info 会话信息：客户端、HELO 主机名、TLS 状态、监听地址和接收时间
+func (s *Session) Info() *EmailSession {
+	info := &EmailSession{
+		ClientIP:   s.ClientIP(),
+		RemoteAddr: s.state.RemoteAddr.String(),
+		ReverseDNS: s.ReverseDNS(),
+		Helo:       s.state.Hostname,
+		ListenAddr: s.state.LocalAddr.String(),
+		ReceivedAt: s.receivedAt.UTC().Format(time.RFC3339),
+	}
+
+	if tlsState := s.state.TLS; tlsState.HandshakeComplete {
+		info.TLS = &EmailTLS{
+			Version:     tlsVersionName(tlsState.Version),
+			CipherSuite: tls.CipherSuiteName(tlsState.CipherSuite),
+			ServerName:  tlsState.ServerName,
+		}
+	}
+
+	return info
+}
+
+// ReverseDNS 客户端 IP 的第一个 PTR 记录，未开启 --reverse-dns 或查询失败时为空
+func (s *Session) ReverseDNS() string {
+	if !*flagReverseDNS || s.rdnsLooked {
+		return s.rdns
+	}
+	s.rdnsLooked = true
+
+	ctx, cancel := context.WithTimeout(context.Background(), reverseDNSTimeout)
+	defer cancel()
+
+	names, err := net.DefaultResolver.LookupAddr(ctx, s.ClientIP())
+	if err != nil || len(names) == 0 {
+		log.Printf("SMTP: No reverse DNS for %s", s.ClientIP())
+		return ""
+	}
+	s.rdns = strings.TrimSuffix(names[0], ".")
+	return s.rdns
+}
+
+// reverseDNSTimeout 反向解析的超时，超时后不再等待
+const reverseDNSTimeout = 3 * time.Second
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	default:
+		return fmt.Sprintf("0x%04X", version)
+	}
+}
+
+// SPF 检查信封发件人域名的 SPF 记录
+func (s *Session) SPF() (spf.Result, string, error) {
+	_, host, err := smtpsrv.SplitAddress(s.from.Address)
+	if err != nil {
+		return spf.None, "", err
+	}
+
+	return spf.CheckHost(net.ParseIP(s.ClientIP()), host, s.from.Address)
+}
+
+// checkRecipient 在 RCPT 阶段对单个收件人做域名限制和 DNS TXT 校验，返回其投递计划和通过的检查
+func checkRecipient(clientIP, senderEmail, recipientEmail string) (*Delivery, []*EmailSecurityCheck, error) {
+	log.Printf("SMTP: RCPT TO: %s (From: %s, IP: %s)", recipientEmail, senderEmail, clientIP)
+
+	checks := []*EmailSecurityCheck{}
+	passed := func(name string, check SecurityCheck) {
+		result := check.Result(name)
+		result.Recipient = recipientEmail
+		checks = append(checks, result)
+	}
+
+	check := ValidateRecipientDomain(recipientEmail)
+	if !check.Allowed {
+		log.Printf("SMTP: Recipient rejected: %s (From: %s, To: %s, IP: %s)", check.Reason, senderEmail, recipientEmail, clientIP)
+		return nil, nil, recipientRejected("Email rejected: " + check.Reason)
+	}
+	passed(CheckNameRecipientDomain, check)
+
+	// 检查传统域名限制（向后兼容）
+	if len(*flagDomain) > 0 {
+		if !strings.EqualFold(rcptDomain(recipientEmail), *flagDomain) {
+			log.Printf("SMTP: Domain restriction failed - expected: %s, got: %s", *flagDomain, recipientEmail)
+			return nil, nil, recipientRejected("Unauthorized TO domain")
+		}
+		passed(CheckNameDomain, SecurityCheck{Allowed: true, Reason: "Domain matches --domain", Threshold: *flagDomain})
+	}
+
+	delivery, _ := resolveDelivery(recipientEmail, nil)
+
+	// DNS TXT 记录域名验证（在接收邮件内容之前进行）
+	if *flagRcptDomainSecret != "" {
+		log.Printf("SMTP: Performing DNS TXT validation for recipient domain")
+		dnsCheck := ValidateRecipientDomainDNS(recipientEmail, *flagRcptDomainSecret)
+		if !dnsCheck.Allowed {
+			log.Printf("SMTP: DNS TXT validation failed: %s (From: %s, To: %s, IP: %s)",
+				dnsCheck.Reason, senderEmail, recipientEmail, clientIP)
+			return nil, nil, recipientRejected("Domain not authorized: " + dnsCheck.Reason)
+		}
+		log.Printf("SMTP: DNS TXT validation passed: %s", dnsCheck.Reason)
+		passed(CheckNameDNSTXT, dnsCheck)
+
+		// 按收件人域名路由到 DNS TXT 记录中的 hook
+		domainDelivery, err := resolveDelivery(recipientEmail, dnsCheck.Record)
+		if err != nil {
+			log.Printf("SMTP: Rejecting domain webhook %q: %v (From: %s, To: %s, IP: %s)",
+				dnsCheck.Record.Hook, err, senderEmail, recipientEmail, clientIP)
+			return nil, nil, recipientRejected("Domain not authorized: webhook not permitted")
+		}
+		delivery = domainDelivery
+		if dnsCheck.Record.Hook != "" {
+			log.Printf("SMTP: Routing %s to domain webhook %s", recipientEmail, dnsCheck.Record.Hook)
+		}
+	}
+
+	return delivery, checks, nil
+}
+
+func recipientRejected(message string) *smtp.SMTPError {
+	return &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      sanitizeSMTPMessage(message),
+	}
+}
+
+// newSMTPServer 按配置创建 SMTP 服务，配置了 --tls-cert 时提供 STARTTLS
+func newSMTPServer(backend *Backend) (*smtp.Server, error) {
+	s := smtp.NewServer(backend)
+
+	s.Addr = *flagListenAddr
+	s.Domain = *flagServerName
+	s.ReadTimeout = time.Duration(*flagReadTimeout) * time.Second
+	s.WriteTimeout = time.Duration(*flagWriteTimeout) * time.Second
+	s.MaxMessageBytes = int(*flagMaxMessageSize)
+	s.MaxRecipients = *flagMaxRecipients
+	s.AllowInsecureAuth = true
+	s.AuthDisabled = true
+	s.EnableSMTPUTF8 = false
+
+	if *flagTLSCert != "" || *flagTLSKey != "" {
+		cert, err := tls.LoadX509KeyPair(*flagTLSCert, *flagTLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load --tls-cert/--tls-key: %v", err)
+		}
+		s.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	return s, nil
+}
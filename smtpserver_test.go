@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// useDNSRecords 在测试期间用固定的 DNS TXT 记录替换缓存，未列出的域名视为查询失败
+func useDNSRecords(t *testing.T, records map[string]*DNSTXTRecord, missing ...string) {
+	t.Helper()
+	old := dnsCache
+	t.Cleanup(func() { dnsCache = old })
+
+	dnsCache = NewDNSCache()
+	for domain, record := range records {
+		dnsCache.Set(domain, record, nil, time.Hour)
+	}
+	for _, domain := range missing {
+		dnsCache.Set(domain, nil, errors.New("no TXT records found"), time.Hour)
+	}
+}
+
+func TestCheckRecipient(t *testing.T) {
+	useTargets(t, []string{"https://global.test/hook"}, []string{"routed.test=https://route.test/hook"}, nil)
+	setFlag(t, flagAllowedHookHosts, "*.tenant.test")
+	useDNSRecords(t, map[string]*DNSTXTRecord{
+		"plain.test":   {Allow: true, Secret: "s3cret"},
+		"hooked.test":  {Allow: true, Secret: "s3cret", Hook: "https://a.tenant.test/in"},
+		"evil.test":    {Allow: true, Secret: "s3cret", Hook: "http://169.254.169.254/latest"},
+		"denied.test":  {Allow: false, Secret: "s3cret"},
+		"wrong.test":   {Allow: true, Secret: "other"},
+		"routed.test":  {Allow: true, Secret: "s3cret", Hook: "https://a.tenant.test/in"},
+		"example.test": {Allow: true, Secret: "s3cret"},
+	}, "missing.test")
+
+	tests := []struct {
+		name    string
+		allowed string // --allowed-domains
+		domain  string // --domain
+		secret  string // --rcpt-domain-secret
+		rcpt    string
+		target  string // 为空表示拒绝
+		reason  string
+		checks  []string
+	}{
+		{"no restrictions", "", "", "", "a@any.test", "https://global.test/hook", "", []string{CheckNameRecipientDomain}},
+		{"route without DNS", "", "", "", "a@routed.test", "https://route.test/hook", "", []string{CheckNameRecipientDomain}},
+		{"allowed domain", "example.test, plain.test", "", "", "a@Plain.test", "https://global.test/hook", "", []string{CheckNameRecipientDomain}},
+		{"domain not allowed", "example.test", "", "", "a@other.test", "", "Domain other.test not in allowed list", nil},
+		{"--domain matches", "", "example.test", "", "a@EXAMPLE.test", "https://global.test/hook", "", []string{CheckNameRecipientDomain, CheckNameDomain}},
+		{"--domain mismatch", "", "example.test", "", "a@other.test", "", "Unauthorized TO domain", nil},
+		{"DNS record without hook", "", "", "s3cret", "a@plain.test", "https://global.test/hook", "", []string{CheckNameRecipientDomain, CheckNameDNSTXT}},
+		{"DNS hook", "", "", "s3cret", "a@hooked.test", "https://a.tenant.test/in", "", []string{CheckNameRecipientDomain, CheckNameDNSTXT}},
+		{"route wins over DNS hook", "", "", "s3cret", "a@routed.test", "https://route.test/hook", "", []string{CheckNameRecipientDomain, CheckNameDNSTXT}},
+		{"DNS hook not permitted", "", "", "s3cret", "a@evil.test", "", "webhook not permitted", nil},
+		{"DNS allow=false", "", "", "s3cret", "a@denied.test", "", "not allowed by DNS TXT record", nil},
+		{"DNS secret mismatch", "", "", "s3cret", "a@wrong.test", "", "Secret mismatch", nil},
+		{"DNS record missing", "", "", "s3cret", "a@missing.test", "", "DNS validation failed", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, flagAllowedDomains, tt.allowed)
+			setFlag(t, flagDomain, tt.domain)
+			setFlag(t, flagRcptDomainSecret, tt.secret)
+
+			d, checks, err := checkRecipient("192.0.2.1", "s@sender.test", tt.rcpt)
+
+			if tt.target == "" {
+				smtpErr, ok := err.(*smtp.SMTPError)
+				if !ok || smtpErr.Code != 550 || smtpErr.EnhancedCode != (smtp.EnhancedCode{5, 7, 1}) {
+					t.Fatalf("checkRecipient() = %v, want a 550 5.7.1 rejection", err)
+				}
+				if !strings.Contains(smtpErr.Message, tt.reason) {
+					t.Errorf("rejection %q does not mention %q", smtpErr.Message, tt.reason)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("checkRecipient() = %v", err)
+			}
+			if got := deliveryURLs(d); got != tt.target {
+				t.Errorf("delivery = %s, want %s", got, tt.target)
+			}
+			names := []string{}
+			for _, c := range checks {
+				names = append(names, c.Name)
+				if c.Recipient != tt.rcpt {
+					t.Errorf("check %s recipient = %q, want %q", c.Name, c.Recipient, tt.rcpt)
+				}
+			}
+			if strings.Join(names, ",") != strings.Join(tt.checks, ",") {
+				t.Errorf("checks = %v, want %v", names, tt.checks)
+			}
+		})
+	}
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SpoolEntry 落盘的待投递邮件
+type SpoolEntry struct {
+	ID          string         `json:"id"`
+	Delivery    *Delivery      `json:"delivery"`
+	CreatedAt   time.Time      `json:"created_at"`
+	Attempts    int            `json:"attempts"`
+	NextAttempt time.Time      `json:"next_attempt"`
+	LastError   string         `json:"last_error,omitempty"`
+	History     []SpoolFailure `json:"history,omitempty"`
+	Message     *EmailMessage  `json:"message"`
+}
+
+// SpoolFailure 一次失败的投递尝试
+type SpoolFailure struct {
+	At    time.Time `json:"at"`
+	Error string    `json:"error"`
+}
+
+// Spool 本地磁盘队列，邮件先落盘再由后台 worker 投递
+type Spool struct {
+	dir      string
+	maxAge   time.Duration
+	retryMin time.Duration
+	retryMax time.Duration
+	deliver  func(*SpoolEntry) error
+
+	mu       sync.Mutex
+	pending  map[string]time.Time // id -> 下次投递时间
+	inflight map[string]bool
+
+	jobs chan string
+	wake chan struct{}
+}
+
+// NewSpool 创建磁盘队列，并恢复目录中上次未投递完的邮件
+func NewSpool(dir string, maxAge, retryMin, retryMax time.Duration, deliver func(*SpoolEntry) error) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("cannot create spool directory: %v", err)
+	}
+
+	s := &Spool{
+		dir:      dir,
+		maxAge:   maxAge,
+		retryMin: retryMin,
+		retryMax: retryMax,
+		deliver:  deliver,
+		pending:  make(map[string]time.Time),
+		inflight: make(map[string]bool),
+		jobs:     make(chan string),
+		wake:     make(chan struct{}, 1),
+	}
+
+	if err := s.recover(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// recover 扫描队列目录，重建待投递索引
+func (s *Spool) recover() error {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return fmt.Errorf("cannot read spool directory: %v", err)
+	}
+
+	for _, f := range files {
+		name := f.Name()
+
+		// 上次写入到一半的临时文件，对应的邮件当时并未被接受
+		if strings.HasSuffix(name, ".tmp") {
+			os.Remove(filepath.Join(s.dir, name))
+			continue
+		}
+
+		if !strings.HasSuffix(name, ".json") {
+			continue
+		}
+
+		entry, err := s.load(strings.TrimSuffix(name, ".json"))
+		if err != nil {
+			log.Printf("SPOOL: Skipping unreadable entry %s: %v", name, err)
+			continue
+		}
+		s.pending[entry.ID] = entry.NextAttempt
+	}
+
+	if len(s.pending) > 0 {
+		log.Printf("SPOOL: Recovered %d queued messages from %s", len(s.pending), s.dir)
+	}
+
+	return nil
+}
+
+// Start 启动调度器和 n 个投递 worker
+func (s *Spool) Start(workers int) {
+	if workers < 1 {
+		workers = 1
+	}
+
+	for i := 0; i < workers; i++ {
+		go s.worker()
+	}
+
+	go s.dispatch()
+}
+
+// Enqueue 将邮件写入队列，只有写盘成功才返回 nil
+func (s *Spool) Enqueue(delivery *Delivery, msg *EmailMessage) (string, error) {
+	id, err := newSpoolID()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	entry := &SpoolEntry{
+		ID:          id,
+		Delivery:    delivery,
+		CreatedAt:   now,
+		NextAttempt: now,
+		Message:     msg,
+	}
+
+	if err := s.save(entry); err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	s.pending[id] = now
+	s.mu.Unlock()
+
+	s.notify()
+
+	return id, nil
+}
+
+// notify 唤醒调度器
+func (s *Spool) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// dispatch 把到期的邮件分发给 worker
+func (s *Spool) dispatch() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		for _, id := range s.due() {
+			s.jobs <- id
+		}
+
+		select {
+		case <-ticker.C:
+		case <-s.wake:
+		}
+	}
+}
+
+// due 返回已到投递时间且未在处理中的邮件 ID
+func (s *Spool) due() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	ids := []string{}
+	for id, next := range s.pending {
+		if s.inflight[id] || next.After(now) {
+			continue
+		}
+		s.inflight[id] = true
+		ids = append(ids, id)
+	}
+
+	return ids
+}
+
+// worker 投递单封邮件并根据结果更新队列
+func (s *Spool) worker() {
+	for id := range s.jobs {
+		s.process(id)
+
+		s.mu.Lock()
+		delete(s.inflight, id)
+		s.mu.Unlock()
+	}
+}
+
+func (s *Spool) process(id string) {
+	entry, err := s.load(id)
+	if err != nil {
+		log.Printf("SPOOL: Cannot load entry %s, dropping: %v", id, err)
+		s.remove(id)
+		return
+	}
+
+	if time.Since(entry.CreatedAt) > s.maxAge {
+		log.Printf("SPOOL: Entry %s expired after %d attempts (age %s), last error: %s",
+			id, entry.Attempts, time.Since(entry.CreatedAt).Round(time.Second), entry.LastError)
+		s.bury(entry, DeadReasonExpired)
+		return
+	}
+
+	entry.Attempts++
+	log.Printf("SPOOL: Delivering entry %s (attempt %d) to %s", id, entry.Attempts, entry.Delivery.URLs())
+
+	err = s.deliver(entry)
+	if err == nil || entry.Delivery.Done() {
+		log.Printf("SPOOL: Entry %s delivered after %d attempts", id, entry.Attempts)
+		s.remove(id)
+		return
+	}
+
+	entry.LastError = err.Error()
+	entry.History = append(entry.History, SpoolFailure{At: time.Now(), Error: err.Error()})
+
+	if derr, ok := err.(*DeliveryError); ok && derr.Permanent {
+		log.Printf("SPOOL: Entry %s permanently rejected: %v", id, err)
+		s.bury(entry, DeadReasonRejected)
+		return
+	}
+
+	// 保存各目标的投递状态，重试时只投递失败的目标
+	entry.NextAttempt = time.Now().Add(s.backoff(entry.Attempts))
+	log.Printf("SPOOL: Entry %s failed: %v, next attempt at %s", id, err, entry.NextAttempt.Format(time.RFC3339))
+
+	if err := s.save(entry); err != nil {
+		log.Printf("SPOOL: Cannot update entry %s: %v", id, err)
+	}
+
+	s.mu.Lock()
+	s.pending[id] = entry.NextAttempt
+	s.mu.Unlock()
+}
+
+// backoff 指数退避：retryMin * 2^(attempts-1)，不超过 retryMax
+func (s *Spool) backoff(attempts int) time.Duration {
+	d := s.retryMin
+	for i := 1; i < attempts && d < s.retryMax; i++ {
+		d *= 2
+	}
+	if d > s.retryMax {
+		d = s.retryMax
+	}
+	return d
+}
+
+func (s *Spool) path(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+// save 原子写入：先写临时文件并 fsync，再重命名；文件中可能包含签名密钥，仅属主可读
+func (s *Spool) save(entry *SpoolEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("cannot encode spool entry: %v", err)
+	}
+
+	tmp := s.path(entry.ID) + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("cannot write spool entry: %v", err)
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("cannot write spool entry: %v", err)
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("cannot sync spool entry: %v", err)
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("cannot write spool entry: %v", err)
+	}
+
+	if err := os.Rename(tmp, s.path(entry.ID)); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("cannot commit spool entry: %v", err)
+	}
+
+	return nil
+}
+
+func (s *Spool) load(id string) (*SpoolEntry, error) {
+	data, err := ioutil.ReadFile(s.path(id))
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &SpoolEntry{}
+	if err := json.Unmarshal(data, entry); err != nil {
+		return nil, err
+	}
+
+	return entry, nil
+}
+
+// bury 将无法投递的邮件移入死信目录，未配置死信目录时直接丢弃
+func (s *Spool) bury(entry *SpoolEntry, reason string) {
+	if deadLetters != nil {
+		if err := deadLetters.Add(entry, reason); err != nil {
+			// 保留在队列中，稍后再尝试
+			log.Printf("SPOOL: Cannot move entry %s to dead letters: %v", entry.ID, err)
+			s.mu.Lock()
+			s.pending[entry.ID] = time.Now().Add(s.retryMin)
+			s.mu.Unlock()
+			return
+		}
+		log.Printf("SPOOL: Entry %s moved to dead letters (%s)", entry.ID, reason)
+	}
+
+	s.remove(entry.ID)
+}
+
+func (s *Spool) remove(id string) {
+	if err := os.Remove(s.path(id)); err != nil && !os.IsNotExist(err) {
+		log.Printf("SPOOL: Cannot remove entry %s: %v", id, err)
+	}
+
+	s.mu.Lock()
+	delete(s.pending, id)
+	s.mu.Unlock()
+}
+
+// newSpoolID 生成按时间排序的唯一 ID
+func newSpoolID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("cannot generate spool id: %v", err)
+	}
+	return fmt.Sprintf("%d-%s", time.Now().UnixNano(), hex.EncodeToString(b)), nil
+}
+
+// 全局磁盘队列，未配置 --spool-dir 时为 nil（同步投递）
+var spool *Spool
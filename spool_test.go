@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestSpool(t *testing.T, dir string, deliver func(*SpoolEntry) error) *Spool {
+	t.Helper()
+	s, err := NewSpool(dir, time.Hour, time.Second, time.Minute, deliver)
+	if err != nil {
+		t.Fatalf("NewSpool() = %v", err)
+	}
+	return s
+}
+
+func testDelivery() *Delivery {
+	return &Delivery{Policy: PolicyAll, Targets: []*WebhookTarget{{URL: "http://hook.test/a"}, {URL: "http://hook.test/b"}}}
+}
+
+func TestSpoolEnqueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := newTestSpool(t, dir, nil)
+	id, err := s.Enqueue(testDelivery(), &EmailMessage{Subject: "hello"})
+	if err != nil {
+		t.Fatalf("Enqueue() = %v", err)
+	}
+
+	info, err := os.Stat(s.path(id))
+	if err != nil {
+		t.Fatalf("entry not written: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("entry mode = %v, want 0600", info.Mode().Perm())
+	}
+
+	entry, err := s.load(id)
+	if err != nil {
+		t.Fatalf("load() = %v", err)
+	}
+	if entry.Message.Subject != "hello" || len(entry.Delivery.Targets) != 2 {
+		t.Errorf("loaded entry = %+v, want the enqueued message and delivery", entry)
+	}
+
+	if due := s.due(); len(due) != 1 || due[0] != id {
+		t.Errorf("due() = %v, want [%s]", due, id)
+	}
+}
+
+func TestSpoolReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	first := newTestSpool(t, dir, nil)
+	id, err := first.Enqueue(testDelivery(), &EmailMessage{Subject: "hello"})
+	if err != nil {
+		t.Fatalf("Enqueue() = %v", err)
+	}
+
+	partial := filepath.Join(dir, "partial.json.tmp")
+	if err := ioutil.WriteFile(partial, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "broken.json"), []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newTestSpool(t, dir, nil)
+	if len(s.pending) != 1 {
+		t.Fatalf("recovered %d entries, want 1", len(s.pending))
+	}
+	if _, ok := s.pending[id]; !ok {
+		t.Errorf("entry %s not recovered", id)
+	}
+	if _, err := os.Stat(partial); !os.IsNotExist(err) {
+		t.Errorf("partial write not removed: %v", err)
+	}
+}
+
+func TestSpoolAck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := newTestSpool(t, dir, func(entry *SpoolEntry) error {
+		return nil
+	})
+	id, err := s.Enqueue(testDelivery(), &EmailMessage{})
+	if err != nil {
+		t.Fatalf("Enqueue() = %v", err)
+	}
+
+	s.process(id)
+
+	if _, err := os.Stat(s.path(id)); !os.IsNotExist(err) {
+		t.Errorf("delivered entry still on disk: %v", err)
+	}
+	if len(s.pending) != 0 {
+		t.Errorf("pending = %v, want empty", s.pending)
+	}
+}
+
+func TestSpoolRetry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// 第一个目标成功、第二个失败，重试时只应再投递第二个
+	s := newTestSpool(t, dir, func(entry *SpoolEntry) error {
+		entry.Delivery.Targets[0].Delivered = true
+		return errors.New("connection refused")
+	})
+	id, err := s.Enqueue(testDelivery(), &EmailMessage{})
+	if err != nil {
+		t.Fatalf("Enqueue() = %v", err)
+	}
+
+	before := time.Now()
+	s.process(id)
+
+	entry, err := s.load(id)
+	if err != nil {
+		t.Fatalf("failed entry not kept: %v", err)
+	}
+	if entry.Attempts != 1 || entry.LastError != "connection refused" || len(entry.History) != 1 {
+		t.Errorf("entry = %+v, want one recorded failure", entry)
+	}
+	if !entry.Delivery.Targets[0].Delivered || entry.Delivery.Targets[1].Delivered {
+		t.Errorf("target state not saved: %+v %+v", entry.Delivery.Targets[0], entry.Delivery.Targets[1])
+	}
+	if next := s.pending[id]; next.Before(before.Add(time.Second)) {
+		t.Errorf("next attempt %v, want at least retry-min after %v", next, before)
+	}
+	if due := s.due(); len(due) != 0 {
+		t.Errorf("due() = %v, want none before the backoff", due)
+	}
+}
+
+func TestSpoolBackoff(t *testing.T) {
+	s := &Spool{retryMin: time.Second, retryMax: 10 * time.Second}
+
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{4, 8 * time.Second},
+		{5, 10 * time.Second},
+		{50, 10 * time.Second},
+	}
+
+	for _, tt := range tests {
+		if got := s.backoff(tt.attempts); got != tt.want {
+			t.Errorf("backoff(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+)
+
+// streamBufferSize 流式编码时每个请求使用的写缓冲
+const streamBufferSize = 32 * 1024
+
+// writeMessageJSON 将邮件以 JSON 写入 w，内容与 json.Marshal(msg) 相同，只是 data 字段位于文件对象末尾；
+// 原始邮件、附件和内嵌文件的内容边编码边写出，不在内存中生成 base64 字符串和完整的 JSON
+func writeMessageJSON(dst io.Writer, msg *EmailMessage) error {
+	// 先序列化不含文件的部分，去掉结尾的 } 后再接上文件列表
+	meta := *msg
+	meta.Raw, meta.Attachments, meta.EmbeddedFiles = nil, nil, nil
+	head, err := json.Marshal(&meta)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriterSize(dst, streamBufferSize)
+	w.Write(head[:len(head)-1])
+
+	if r := msg.Raw; r != nil {
+		w.WriteString(`,"raw":`)
+
+		type plain EmailRaw
+		c := plain(*r)
+		if err := writeFileJSON(w, &c, r.File(), r.URL); err != nil {
+			return err
+		}
+	}
+
+	if len(msg.Attachments) > 0 {
+		w.WriteString(`,"attachments":[`)
+		for i, a := range msg.Attachments {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+
+			type plain EmailAttachment
+			c := plain(*a)
+			if err := writeFileJSON(w, &c, a.File(), a.URL); err != nil {
+				return err
+			}
+		}
+		w.WriteByte(']')
+	}
+
+	if len(msg.EmbeddedFiles) > 0 {
+		w.WriteString(`,"embedded_files":[`)
+		for i, e := range msg.EmbeddedFiles {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+
+			type plain EmailEmbeddedFile
+			c := plain(*e)
+			if err := writeFileJSON(w, &c, e.File(), e.URL); err != nil {
+				return err
+			}
+		}
+		w.WriteByte(']')
+	}
+
+	w.WriteByte('}')
+	return w.Flush()
+}
+
+// writeFileJSON 写出一个文件对象或原始邮件，meta 为不带 MarshalJSON 的副本；
+// 内容只在内存中时在元数据之后追加流式编码的 data 字段
+func writeFileJSON(w *bufio.Writer, meta interface{}, file FileContent, url string) error {
+	fields, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	if url != "" || file.Empty() || file.Encoded() {
+		_, err := w.Write(fields)
+		return err
+	}
+
+	w.Write(fields[:len(fields)-1])
+	w.WriteString(`,"data":"`)
+
+	enc := base64.NewEncoder(base64.StdEncoding, w)
+	io.Copy(enc, file.Reader())
+	if err := enc.Close(); err != nil {
+		return err
+	}
+
+	_, err = w.WriteString(`"}`)
+	return err
+}
+
+// countingWriter 只统计写入的字节数
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
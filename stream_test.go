@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alash3al/smtp2http/signature"
+	"github.com/klauspost/compress/zstd"
+)
+
+// streamTestMessage 包含各种文件形式的邮件：内存中的内容、只有 base64 的内容、外部存储的地址和空文件
+func streamTestMessage() *EmailMessage {
+	big := bytes.Repeat([]byte("0123456789abcdef\x00\xff"), 8*1024) // 超过 streamBufferSize
+
+	msg := &EmailMessage{
+		SchemaVersion: PayloadSchemaVersion,
+		ID:            "<流式@example.test>",
+		Subject:       "报告 — Überprüfung   <script>&",
+		Recipients:    []string{"a@example.test"},
+		Envelope:      &EmailEnvelope{MailFrom: "s@example.test", RcptTo: []string{"a@example.test"}},
+		Raw:           &EmailRaw{Size: 17, SHA256: "abc", Content: []byte("Subject: raw\r\n\r\nhi")},
+		Attachments: []*EmailAttachment{
+			{Filename: "報告.pdf", ContentType: "application/pdf", Content: big},
+			{Filename: "restored.txt", ContentType: "text/plain", Data: base64.StdEncoding.EncodeToString([]byte("from the spool"))},
+			{Filename: "large.zip", ContentType: "application/zip", URL: "https://blobs.test/x?sig=a&b", Size: 1 << 20, SHA256: "def"},
+			{Filename: "empty.txt", ContentType: "text/plain"},
+		},
+		EmbeddedFiles: []*EmailEmbeddedFile{
+			{CID: "logo@cid", ContentType: "image/png", Content: []byte("\x89PNG\r\n")},
+			{CID: "ext@cid", ContentType: "image/gif", URL: "https://blobs.test/gif"},
+		},
+	}
+	msg.Body.Text = "こんにちは\n\t\"quoted\" \\ 😀"
+	msg.Body.HTML = "<p>héllo &amp; </p>"
+	msg.Addresses.From = &EmailAddress{Name: "Jürgen", Address: "s@example.test"}
+	return msg
+}
+
+func TestWriteMessageJSONMatchesMarshal(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  func() *EmailMessage
+	}{
+		{"files in every form", streamTestMessage},
+		{"no files", func() *EmailMessage {
+			msg := streamTestMessage()
+			msg.Raw, msg.Attachments, msg.EmbeddedFiles = nil, nil, nil
+			return msg
+		}},
+		{"omitted raw", func() *EmailMessage {
+			msg := streamTestMessage()
+			msg.Raw = &EmailRaw{Size: 1 << 30, SHA256: "abc", Omitted: true}
+			return msg
+		}},
+		{"restored raw", func() *EmailMessage {
+			msg := streamTestMessage()
+			msg.Raw = &EmailRaw{Size: 2, SHA256: "abc", Data: base64.StdEncoding.EncodeToString([]byte("hi"))}
+			return msg
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := tt.msg()
+
+			var streamed bytes.Buffer
+			if err := writeMessageJSON(&streamed, msg); err != nil {
+				t.Fatalf("writeMessageJSON() = %v", err)
+			}
+			marshaled, err := json.Marshal(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// data 字段的位置不同，按解析后的值比较
+			var got, want interface{}
+			if err := json.Unmarshal(streamed.Bytes(), &got); err != nil {
+				t.Fatalf("streamed JSON is invalid: %v\n%s", err, streamed.Bytes()[:min(200, streamed.Len())])
+			}
+			json.Unmarshal(marshaled, &want)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("streamed JSON differs from json.Marshal\n got %.300s\nwant %.300s", streamed.Bytes(), marshaled)
+			}
+			if streamed.Len() != len(marshaled) {
+				t.Errorf("streamed %d bytes, json.Marshal %d", streamed.Len(), len(marshaled))
+			}
+
+			// 重复输出的字节必须相同，发送前的空跑依赖这一点
+			var again bytes.Buffer
+			writeMessageJSON(&again, msg)
+			if !bytes.Equal(again.Bytes(), streamed.Bytes()) {
+				t.Error("second writeMessageJSON() produced different bytes")
+			}
+		})
+	}
+}
+
+func TestSendWebhookLengthAndSignature(t *testing.T) {
+	key := "stream-signing-key"
+
+	for _, encoding := range []string{"", "gzip", "zstd"} {
+		t.Run("encoding="+encoding, func(t *testing.T) {
+			var body []byte
+			var header http.Header
+			var length int64
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ = ioutil.ReadAll(r.Body)
+				header, length = r.Header, r.ContentLength
+				w.Write([]byte(`{"action":"accept"}`))
+			}))
+			defer srv.Close()
+
+			target := &WebhookTarget{URL: srv.URL, Format: FormatJSON, SigningKey: key}
+			msg := streamTestMessage()
+			payload, err := encodePayload(target, msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, _, err := sendWebhook(target, payload, encoding); err != nil {
+				t.Fatalf("sendWebhook() = %v", err)
+			}
+
+			if length != int64(len(body)) {
+				t.Errorf("Content-Length %d, received %d bytes", length, len(body))
+			}
+			if got := header.Get("Content-Encoding"); got != encoding {
+				t.Errorf("Content-Encoding = %q, want %q", got, encoding)
+			}
+			if err := signature.Verify([]byte(key), header.Get(signature.HeaderTimestamp), header.Get(signature.HeaderDeliveryID),
+				header.Get(signature.HeaderSignature), body, time.Minute, time.Now()); err != nil {
+				t.Errorf("signature does not cover the received body: %v", err)
+			}
+
+			decoded, err := decompress(encoding, body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var want bytes.Buffer
+			writeMessageJSON(&want, msg)
+			if !bytes.Equal(decoded, want.Bytes()) {
+				t.Errorf("received body of %d bytes, want the %d byte message", len(decoded), want.Len())
+			}
+		})
+	}
+}
+
+// decompress 按 Content-Encoding 解压收到的请求体
+func decompress(encoding string, body []byte) ([]byte, error) {
+	switch encoding {
+	case CompressionGzip:
+		r, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(r)
+	case CompressionZstd:
+		r, err := zstd.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	default:
+		return body, nil
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// payloadTemplates 已解析的模板，按文件路径缓存
+var payloadTemplates = struct {
+	sync.Mutex
+	m map[string]*template.Template
+}{m: map[string]*template.Template{}}
+
+// templateFuncs 模板中可用的辅助函数
+var templateFuncs = template.FuncMap{
+	// json 将任意值编码为 JSON，字符串会带上引号并正确转义
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	// jsonEscape 只转义字符串内容，不加引号，用于拼接在已有的 JSON 字符串中
+	"jsonEscape": func(s string) (string, error) {
+		b, err := json.Marshal(s)
+		if err != nil {
+			return "", err
+		}
+		return string(b[1 : len(b)-1]), nil
+	},
+	"base64": func(v interface{}) (string, error) {
+		switch d := v.(type) {
+		case string:
+			return base64.StdEncoding.EncodeToString([]byte(d)), nil
+		case []byte:
+			return base64.StdEncoding.EncodeToString(d), nil
+		default:
+			return "", fmt.Errorf("base64: unsupported type %T", v)
+		}
+	},
+	"address":   formatAddress,
+	"addresses": formatAddresses,
+	"truncate": func(n int, s string) string {
+		r := []rune(s)
+		if len(r) <= n {
+			return s
+		}
+		return string(r[:n]) + "…"
+	},
+	"join":  strings.Join,
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	"trim":  strings.TrimSpace,
+	"default": func(def, v interface{}) interface{} {
+		if v == nil || v == "" {
+			return def
+		}
+		return v
+	},
+}
+
+// formatAddress 格式化为 "Name <address>"，没有名字时只返回地址
+func formatAddress(a *EmailAddress) string {
+	if a == nil {
+		return ""
+	}
+	if a.Name == "" {
+		return a.Address
+	}
+	return fmt.Sprintf("%s <%s>", a.Name, a.Address)
+}
+
+// formatAddresses 格式化地址列表，以逗号分隔
+func formatAddresses(list []*EmailAddress) string {
+	out := []string{}
+	for _, a := range list {
+		out = append(out, formatAddress(a))
+	}
+	return strings.Join(out, ", ")
+}
+
+// loadPayloadTemplate 解析模板文件，结果会被缓存
+func loadPayloadTemplate(path string) (*template.Template, error) {
+	payloadTemplates.Lock()
+	defer payloadTemplates.Unlock()
+
+	if t, exists := payloadTemplates.m[path]; exists {
+		return t, nil
+	}
+
+	t, err := template.New(filepath.Base(path)).Funcs(templateFuncs).Option("missingkey=error").ParseFiles(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse payload template: %v", err)
+	}
+
+	payloadTemplates.m[path] = t
+	return t, nil
+}
+
+// templateMessage 模板使用的邮件副本：附件、内嵌文件和原始邮件的 Content 和 Data 都已填好，
+// 无论邮件是刚收到的还是从磁盘队列恢复的，模板中的 .Content 和 .Data 都有值
+func templateMessage(msg *EmailMessage) (*EmailMessage, error) {
+	m := *msg
+
+	if r := msg.Raw; r != nil {
+		c := *r
+		if err := fillFile(r.File(), &c.Content, &c.Data); err != nil {
+			return nil, err
+		}
+		m.Raw = &c
+	}
+
+	m.Attachments = make([]*EmailAttachment, len(msg.Attachments))
+	for i, a := range msg.Attachments {
+		c := *a
+		if err := fillFile(a.File(), &c.Content, &c.Data); err != nil {
+			return nil, err
+		}
+		m.Attachments[i] = &c
+	}
+
+	m.EmbeddedFiles = make([]*EmailEmbeddedFile, len(msg.EmbeddedFiles))
+	for i, e := range msg.EmbeddedFiles {
+		c := *e
+		if err := fillFile(e.File(), &c.Content, &c.Data); err != nil {
+			return nil, err
+		}
+		m.EmbeddedFiles[i] = &c
+	}
+
+	return &m, nil
+}
+
+func fillFile(file FileContent, content *[]byte, data *string) error {
+	if file.Empty() {
+		return nil
+	}
+
+	b, err := file.Bytes()
+	if err != nil {
+		return err
+	}
+	*content, *data = b, file.Base64()
+	return nil
+}
+
+// renderTemplate 渲染请求体和请求头：
+// 模板中定义了 "body" 时用它渲染请求体，否则使用整个文件；
+// 定义了 "headers" 时其输出按 "Name: value" 每行一个解析为请求头
+func renderTemplate(path string, msg *EmailMessage) (*Payload, error) {
+	t, err := loadPayloadTemplate(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if msg, err = templateMessage(msg); err != nil {
+		return nil, fmt.Errorf("cannot render payload template: %v", err)
+	}
+
+	body := &bytes.Buffer{}
+	if t.Lookup("body") != nil {
+		err = t.ExecuteTemplate(body, "body", msg)
+	} else {
+		err = t.Execute(body, msg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot render payload template: %v", err)
+	}
+
+	// 模板输出整体缓存在内存中，模板中的 {{.File.Base64}} 本身就需要完整的字符串
+	payload := newPayload("application/json", staticBody(body.Bytes()))
+	payload.Headers = map[string]string{}
+
+	if t.Lookup("headers") == nil {
+		return payload, nil
+	}
+
+	headers := &bytes.Buffer{}
+	if err := t.ExecuteTemplate(headers, "headers", msg); err != nil {
+		return nil, fmt.Errorf("cannot render payload template headers: %v", err)
+	}
+
+	scanner := bufio.NewScanner(headers)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("invalid header line in payload template: %q", line)
+		}
+
+		name, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		if strings.EqualFold(name, "Content-Type") {
+			payload.ContentType = value
+			continue
+		}
+		payload.Headers[name] = value
+	}
+
+	return payload, nil
+}
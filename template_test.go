@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTemplate 将模板写入临时文件并返回路径，每个测试使用不同的路径以避开模板缓存
+func writeTemplate(t *testing.T, text string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "tmpl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "payload.tmpl")
+	if err := ioutil.WriteFile(path, []byte(text), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func renderBody(t *testing.T, p *Payload) string {
+	t.Helper()
+	var body bytes.Buffer
+	if err := p.WriteBody(&body); err != nil {
+		t.Fatal(err)
+	}
+	return body.String()
+}
+
+func TestRenderTemplate(t *testing.T) {
+	path := writeTemplate(t, `{{define "headers"}}
+content-type: application/vnd.inbound+json
+X-Mail-From: {{address .Addresses.From}}
+
+X-Files: {{len .Attachments}}
+{{end}}
+{{define "body"}}{"title":{{json .Subject}},"text":"{{jsonEscape (truncate 5 .Body.Text)}}","cc":{{json (addresses .Addresses.Cc)}},"tag":{{json (default "none" .ID)}},
+{{- range .Attachments}}
+{{.Filename}}={{.File.Base64}}|{{.Data}}|{{printf "%s" .Content}}
+{{- end}}
+{{- range .EmbeddedFiles}}
+{{.CID}}={{.Data}}
+{{- end}}
+raw={{.Raw.File.Base64}}|{{upper (printf "%s" .Raw.Content)}}}{{end}}`)
+
+	msg := &EmailMessage{
+		Subject: `Invoice "March"`,
+		Raw:     &EmailRaw{Data: base64.StdEncoding.EncodeToString([]byte("subject: raw"))},
+		Attachments: []*EmailAttachment{
+			{Filename: "a.txt", Content: []byte("in memory")},
+			{Filename: "b.txt", Data: base64.StdEncoding.EncodeToString([]byte("from spool"))},
+		},
+		EmbeddedFiles: []*EmailEmbeddedFile{{CID: "logo", Content: []byte("png")}},
+	}
+	msg.Body.Text = "héllo world"
+	msg.Addresses.From = &EmailAddress{Name: "Alice", Address: "alice@example.test"}
+	msg.Addresses.Cc = []*EmailAddress{{Address: "b@example.test"}, {Name: "C", Address: "c@example.test"}}
+
+	p, err := renderTemplate(path, msg)
+	if err != nil {
+		t.Fatalf("renderTemplate() = %v", err)
+	}
+
+	if p.ContentType != "application/vnd.inbound+json" {
+		t.Errorf("ContentType = %q, want the template's Content-Type", p.ContentType)
+	}
+	if len(p.Headers) != 2 || p.Headers["X-Mail-From"] != "Alice <alice@example.test>" || p.Headers["X-Files"] != "2" {
+		t.Errorf("Headers = %v", p.Headers)
+	}
+
+	b64 := base64.StdEncoding.EncodeToString
+	want := `{"title":"Invoice \"March\"","text":"héllo…","cc":"b@example.test, C \u003cc@example.test\u003e","tag":"none",` +
+		"\na.txt=" + b64([]byte("in memory")) + "|" + b64([]byte("in memory")) + "|in memory" +
+		"\nb.txt=" + b64([]byte("from spool")) + "|" + b64([]byte("from spool")) + "|from spool" +
+		"\nlogo=" + b64([]byte("png")) +
+		"\nraw=" + b64([]byte("subject: raw")) + "|SUBJECT: RAW}"
+	if got := renderBody(t, p); got != want {
+		t.Errorf("body =\n%s\nwant\n%s", got, want)
+	}
+
+	// 渲染使用副本，不修改原邮件
+	if msg.Attachments[0].Data != "" || msg.Attachments[1].Content != nil || msg.Raw.Content != nil {
+		t.Error("renderTemplate() filled in the original message")
+	}
+}
+
+func TestRenderTemplateWholeFile(t *testing.T) {
+	path := writeTemplate(t, `subject={{.Subject}}`)
+
+	p, err := renderTemplate(path, &EmailMessage{Subject: "plain"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := renderBody(t, p); got != "subject=plain" {
+		t.Errorf("body = %q", got)
+	}
+	if p.ContentType != "application/json" || len(p.Headers) != 0 {
+		t.Errorf("ContentType %q, headers %v, want the defaults", p.ContentType, p.Headers)
+	}
+}
+
+func TestRenderTemplateErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"unknown field", `{{.NoSuchField}}`, "cannot render payload template"},
+		{"helper error", `{{base64 .Attachments}}`, "unsupported type"},
+		{"header without colon", `{{define "headers"}}X-Broken{{end}}{{define "body"}}{}{{end}}`, "invalid header line"},
+		{"header without name", `{{define "headers"}}: value{{end}}{{define "body"}}{}{{end}}`, "invalid header line"},
+		{"syntax error", `{{if}}`, "cannot parse payload template"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := renderTemplate(writeTemplate(t, tt.text), &EmailMessage{})
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("renderTemplate() = %v, want an error mentioning %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestTemplateWebhookRequest(t *testing.T) {
+	path := writeTemplate(t, `{{define "headers"}}Content-Type: text/plain; charset=utf-8
+X-Tenant: {{lower .Subject}}
+X-Source: {{lower .Subject}}{{end}}{{define "body"}}{{.Subject}}{{end}}`)
+
+	var got http.Header
+	var body []byte
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header
+		body, _ = ioutil.ReadAll(r.Body)
+		fmt.Fprint(w, `{"action":"accept"}`)
+	}))
+	defer hook.Close()
+
+	target := &WebhookTarget{URL: hook.URL, Format: FormatTemplate, Template: path, Headers: map[string]string{"X-Tenant": "override"}}
+	if err := deliverTarget(target, &EmailMessage{Subject: "ACME"}); err != nil {
+		t.Fatalf("deliverTarget() = %v", err)
+	}
+
+	if got.Get("Content-Type") != "text/plain; charset=utf-8" || string(body) != "ACME" {
+		t.Errorf("request Content-Type %q, body %q", got.Get("Content-Type"), body)
+	}
+	// 目标 header= 选项优先于模板中的同名头
+	if got.Get("X-Tenant") != "override" || got.Get("X-Source") != "acme" {
+		t.Errorf("X-Tenant = %q, X-Source = %q, want the target header and the template header", got.Get("X-Tenant"), got.Get("X-Source"))
+	}
+}
@@ -1,32 +1,121 @@
 package main
 
-import "flag"
+import (
+	"flag"
+	"time"
+)
 
 var (
-	flagServerName     = flag.String("name", "smtp2http", "the server name")
-	flagListenAddr     = flag.String("listen", ":smtp", "the smtp address to listen on")
-	flagWebhook        = flag.String("webhook", "http://localhost:8080/my/webhook", "the webhook to send the data to")
-	flagMaxMessageSize = flag.Int64("msglimit", 1024*1024*2, "maximum incoming message size")
-	flagReadTimeout    = flag.Int("timeout.read", 5, "the read timeout in seconds")
-	flagWriteTimeout   = flag.Int("timeout.write", 5, "the write timeout in seconds")
-	flagAuthUSER       = flag.String("user", "", "user for smtp client")
-	flagAuthPASS       = flag.String("pass", "", "pass for smtp client")
-	flagDomain         = flag.String("domain", "", "domain for recieving mails")
-	flagInboundKey     = flag.String("inbound-key", "", "API key for cloud-mail inbound authentication (X-Inbound-Key header)")
+	flagServerName      = flag.String("name", "smtp2http", "the server name")
+	flagListenAddr      = flag.String("listen", ":smtp", "the smtp address to listen on")
+	flagWebhooks        = newWebhookList("http://localhost:8080/my/webhook")
+	flagRoutes          = &routeList{}
+	flagHookCredentials = &hookCredentialList{}
+	flagWebhookPolicy   = flag.String("webhook-policy", PolicyAll, "how results of multiple webhooks decide the SMTP reply: all, any or primary (first webhook decides, others are best-effort)")
+	flagMaxMessageSize  = flag.Int64("msglimit", 1024*1024*2, "maximum incoming message size")
+	flagReadTimeout     = flag.Int("timeout.read", 5, "the read timeout in seconds")
+	flagWriteTimeout    = flag.Int("timeout.write", 5, "the write timeout in seconds")
+	flagAuthUSER        = flag.String("user", "", "user for smtp client")
+	flagAuthPASS        = flag.String("pass", "", "pass for smtp client")
+	flagDomain          = flag.String("domain", "", "domain for recieving mails")
+	flagTLSCert         = flag.String("tls-cert", "", "PEM certificate offered to SMTP clients with STARTTLS (empty = no STARTTLS)")
+	flagTLSKey          = flag.String("tls-key", "", "PEM private key for --tls-cert")
+	flagReverseDNS      = flag.Bool("reverse-dns", true, "look up the PTR record of the client IP for the session metadata")
+	flagMaxRecipients   = flag.Int("max-recipients", 100, "maximum RCPT TO recipients per message (0 = unlimited)")
+	flagRecipientMode   = flag.String("recipient-mode", RecipientsCombined, "how messages with several recipients are delivered: combined (one request per delivery plan listing all its recipients) or split (one request per recipient)")
+	flagPayloadFormat   = flag.String("payload-format", FormatJSON, "webhook request body format: json, multipart (multipart/form-data with attachments as file parts), cloudevents (CloudEvents 1.0 structured mode), cloudevents-binary (CloudEvents 1.0 binary mode, ce-* headers) or template (rendered from --payload-template)")
+	flagPayloadTemplate = flag.String("payload-template", "", "Go text/template file rendering the webhook body and headers; implies --payload-format=template")
+	flagInboundKey      = flag.String("inbound-key", "", "API key for cloud-mail inbound authentication (X-Inbound-Key header)")
+	flagSigningKey      = flag.String("signing-key", "", "HMAC-SHA256 key used to sign webhook requests (X-Smtp2http-Signature header, empty = unsigned)")
+
+	flagCloudEventsSource = flag.String("cloudevents-source", "", "CloudEvents source attribute for --payload-format=cloudevents|cloudevents-binary (empty = urn:smtp2http:<--name>)")
+
+	flagSignWithDomainSecret = flag.Bool("sign-with-domain-secret", false, "sign webhook requests for a DNS-validated recipient domain with a key derived from --signing-key and the domain (see signature.DomainKey) instead of --signing-key itself")
 
 	// Security configuration
 	flagAllowedDomains   = flag.String("allowed-domains", "", "comma-separated list of allowed recipient domains (empty = allow all)")
 	flagStrictSPF        = flag.Bool("strict-spf", false, "reject emails that fail SPF verification")
-	flagMaxEmailsPerMin  = flag.Int("rate-limit", 60, "maximum emails per minute per sender IP")
+	flagMaxEmailsPerMin  = flag.Int("rate-limit", 60, "maximum emails per minute per sender IP, each message counts once however many recipients it has")
 	flagSpamKeywords     = flag.String("spam-keywords", "", "comma-separated list of spam keywords to block")
 	flagForbiddenTypes   = flag.String("forbidden-types", "exe,bat,cmd,com,pif,scr,vbs,js,jar,msi", "comma-separated list of forbidden attachment file extensions")
 	flagMaxAttachSize    = flag.Int64("max-attach-size", 10*1024*1024, "maximum attachment size in bytes (default 10MB)")
 	flagBlacklistDomains = flag.String("blacklist-domains", "", "comma-separated list of blacklisted sender domains")
+	flagSpamRejectScore  = flag.Int("spam-reject-score", 70, "reject messages whose security score reaches this value")
+	flagSpamFlagScore    = flag.Int("spam-flag-score", 20, "mark messages whose security score reaches this value as spam (security.flagged and X-Spam-Flag: YES)")
 
 	// DNS TXT record domain validation
 	flagRcptDomainSecret = flag.String("rcpt-domain-secret", "", "secret for DNS TXT record domain validation (enables DNS-based domain verification)")
+	flagAllowedHookHosts = flag.String("allowed-hook-hosts", "", "comma-separated list of hosts permitted in DNS TXT hook= URLs, supports *.example.com; empty = no hook= URL is allowed")
+
+	// Webhook HTTP client
+	flagWebhookTimeout      = flag.Duration("webhook-timeout", 30*time.Second, "timeout for a single webhook request, including reading the response")
+	flagWebhookCAFile       = flag.String("webhook-ca-file", "", "PEM file with CA certificates trusted for webhook TLS (empty = system roots)")
+	flagWebhookCertFile     = flag.String("webhook-cert-file", "", "PEM client certificate for mutual TLS with the webhook")
+	flagWebhookKeyFile      = flag.String("webhook-key-file", "", "PEM private key for --webhook-cert-file")
+	flagWebhookProxy        = flag.String("webhook-proxy", "", "proxy URL for webhook requests (empty = HTTP_PROXY/HTTPS_PROXY environment)")
+	flagWebhookMaxIdleConns = flag.Int("webhook-max-idle-conns", 100, "maximum idle keep-alive connections kept per webhook host")
+	flagWebhookHTTP2        = flag.Bool("webhook-http2", true, "negotiate HTTP/2 with TLS webhooks")
+	flagBreakerThreshold    = flag.Int("breaker-threshold", 5, "consecutive webhook failures that open the circuit breaker (0 = disabled)")
+	flagBreakerCooldown     = flag.Duration("breaker-cooldown", 30*time.Second, "how long an open circuit breaker rejects deliveries before probing the webhook")
+	flagCompression         = flag.String("webhook-compression", CompressionNone, "compress webhook request bodies: none, gzip or zstd (falls back to uncompressed when the webhook answers 415)")
+	flagCompressionMinSize  = flag.Int64("webhook-compression-min-size", 1024, "only compress request bodies of at least this many bytes")
+	flagWebhookUnixSocket   = flag.String("webhook-unix-socket", "", "deliver requests for the --webhook targets over this Unix domain socket (the URL host is only used for the Host header; --route and DNS TXT hooks are not affected)")
+
+	// OAuth2 client credentials for webhook requests
+	flagOAuthTokenURL     = flag.String("oauth-token-url", "", "OAuth2 token endpoint; when set, webhook requests carry an Authorization: Bearer token from the client credentials grant")
+	flagOAuthClientID     = flag.String("oauth-client-id", "", "OAuth2 client ID")
+	flagOAuthClientSecret = flag.String("oauth-client-secret", "", "OAuth2 client secret")
+	flagOAuthScopes       = flag.String("oauth-scopes", "", "comma- or space-separated OAuth2 scopes to request")
+	flagOAuthClientAuth   = flag.String("oauth-client-auth", "basic", "how client credentials are sent to the token endpoint: basic (HTTP Basic) or post (form body)")
+
+	// Batch delivery for webhooks with batch=on
+	flagBatchMaxItems = flag.Int("batch-max-items", 100, "maximum messages per batch request for batch=on webhooks")
+	flagBatchMaxBytes = flag.Int64("batch-max-bytes", 5*1024*1024, "send a batch once its encoded messages reach this many bytes")
+	flagBatchMaxWait  = flag.Duration("batch-max-wait", 500*time.Millisecond, "send a batch this long after its first message even if it is not full")
+
+	// Duplicate suppression
+	flagDedupeWindow     = flag.Duration("dedupe-window", 10*time.Minute, "acknowledge but do not redeliver a message whose idempotency key was accepted within this window (0 = disabled)")
+	flagDedupeMaxEntries = flag.Int("dedupe-max-entries", 100000, "maximum idempotency keys remembered for --dedupe-window, oldest are evicted first")
+
+	// Exec sink
+	flagExecTimeout     = flag.Duration("exec-timeout", 30*time.Second, "maximum run time of an exec:// sink command per message, including waiting for a free slot")
+	flagExecConcurrency = flag.Int("exec-concurrency", 4, "maximum concurrently running commands per exec:// sink")
+
+	// Attachment offloading
+	flagBlobStore   = flag.String("blob-store", "", "store attachment and embedded file bytes externally and send URLs instead: local or s3 (empty = inline)")
+	flagBlobMinSize = flag.Int64("blob-min-size", 0, "only offload files of at least this many bytes")
+	flagBlobURLTTL  = flag.Duration("blob-url-ttl", 7*24*time.Hour, "validity of signed blob URLs (S3 allows at most 7 days)")
+	flagBlobDir     = flag.String("blob-dir", "", "directory for the local blob store")
+	flagBlobListen  = flag.String("blob-listen", ":8025", "HTTP address serving the local blob store")
+	flagBlobBaseURL = flag.String("blob-base-url", "", "public base URL of the local blob store, e.g. https://mx.example.com:8025")
+	flagBlobSecret  = flag.String("blob-secret", "", "key used to sign local blob URLs")
+	flagS3Endpoint  = flag.String("s3-endpoint", "https://s3.amazonaws.com", "S3-compatible endpoint, e.g. http://127.0.0.1:9000 for MinIO")
+	flagS3Region    = flag.String("s3-region", "us-east-1", "S3 region used for request signing")
+	flagS3Bucket    = flag.String("s3-bucket", "", "S3 bucket for offloaded files")
+	flagS3AccessKey = flag.String("s3-access-key", "", "S3 access key")
+	flagS3SecretKey = flag.String("s3-secret-key", "", "S3 secret key")
+	flagS3PathStyle = flag.Bool("s3-path-style", true, "use path-style bucket addressing (endpoint/bucket/key), required by most S3-compatible servers")
+
+	// Header filtering for the headers field
+	flagHeaderAllow = flag.String("header-allow", "", "comma-separated headers included in the payload headers list, supports X-* prefixes (empty = all)")
+	flagHeaderDeny  = flag.String("header-deny", "", "comma-separated headers never included in the payload headers list, supports X-* prefixes; takes precedence over --header-allow")
+
+	// Raw message
+	flagRawMessage = flag.String("raw-message", RawNone, "include the message exactly as received over DATA: none, inline (base64 in JSON, a message/rfc822 part in multipart) or reference (stored in --blob-store, only its URL is sent)")
+	flagRawMaxSize = flag.Int64("raw-max-size", 10*1024*1024, "raw messages larger than this are not kept, only their size and sha256 are sent")
+
+	// Spool (durable queue with background delivery)
+	flagSpoolDir      = flag.String("spool-dir", "", "directory to persist accepted emails before webhook delivery (empty = deliver synchronously)")
+	flagSpoolWorkers  = flag.Int("spool-workers", 4, "number of concurrent spool delivery workers")
+	flagSpoolMaxAge   = flag.Duration("spool-max-age", 72*time.Hour, "drop spooled emails that could not be delivered within this age")
+	flagSpoolRetryMin = flag.Duration("spool-retry-min", 30*time.Second, "initial delay before retrying a failed spool delivery")
+	flagSpoolRetryMax = flag.Duration("spool-retry-max", time.Hour, "maximum delay between spool delivery retries")
+	flagDeadLetterDir = flag.String("dead-letter-dir", "", "directory keeping emails that were permanently rejected or expired in the spool, or rejected for some recipients of a synchronous delivery, for `replay` (empty = drop them)")
 )
 
 func init() {
+	flag.Var(flagWebhooks, "webhook", "the webhook to send the data to, repeatable; format: url[; inbound-key=...][; signing-key=...][; format=json|multipart|cloudevents|cloudevents-binary][; template=file][; compression=none|gzip|zstd][; oauth=on|off][; batch=on|off][; header=Name: value]; url may also be file:///path.jsonl, maildir:///path, stdout:, unix:///path.sock or exec:///path/to/command[?arg=...&stdin=json|raw]")
+	flag.Var(flagHookCredentials, "hook-credentials", "inbound and signing keys for a DNS TXT hook= host, repeatable; format: host[; inbound-key=...][; signing-key=...], host may be *.example.com. DNS hooks never receive --inbound-key or --signing-key")
+	flag.Var(flagRoutes, "route", "deliver mail for a recipient domain to its own target instead of --webhook, repeatable; format: domain=target, domain may be *.example.com, target as in --webhook")
 	// flag.Parse() will be called in main()
 }
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/alash3al/smtp2http/signature"
+	"github.com/emersion/go-smtp"
+)
+
+// WebhookTarget 一次投递的目标
+type WebhookTarget struct {
+	URL         string            `json:"url"`
+	InboundKey  string            `json:"inbound_key,omitempty"` // X-Inbound-Key 头，为空时不发送
+	SigningKey  string            `json:"signing_key,omitempty"` // 为空时不签名
+	Format      string            `json:"format,omitempty"`      // 请求体格式，见 payload.go
+	Template    string            `json:"template,omitempty"`    // template 格式使用的模板文件
+	Compression string            `json:"compression,omitempty"` // 请求体压缩方式，见 compress.go
+	Headers     map[string]string `json:"headers,omitempty"`
+	OAuth       bool              `json:"oauth,omitempty"`       // 附带 --oauth-token-url 获取的令牌，DNS TXT 记录中的 hook 不会附带
+	Batch       bool              `json:"batch,omitempty"`       // 与其他邮件合并为 JSON 数组投递，见 batch.go
+	UnixSocket  string            `json:"unix_socket,omitempty"` // 经 Unix 套接字发送，只有 --webhook 目标使用 --webhook-unix-socket
+	Delivered   bool              `json:"delivered,omitempty"`   // 已投递成功，重试时跳过
+}
+
+// DeliveryError webhook 投递失败的详细信息
+type DeliveryError struct {
+	Code      string          // 对外暴露的错误编号（E1/E2/E5/E6），webhook 给出结论时为空
+	Permanent bool            // 永久性失败，重试没有意义
+	Verdict   *WebhookVerdict // webhook 返回的结论
+	Err       error
+}
+
+func (e *DeliveryError) Error() string {
+	return e.Err.Error()
+}
+
+// SMTPError 返回给 SMTP 客户端的响应：优先使用 webhook 的结论，否则返回不泄露内部细节的临时失败
+func (e *DeliveryError) SMTPError() *smtp.SMTPError {
+	if e.Verdict != nil {
+		return e.Verdict.SMTPError()
+	}
+
+	code := 451
+	enhanced := smtp.EnhancedCode{4, 3, 0}
+	if e.Permanent {
+		code = 554
+		enhanced = smtp.EnhancedCode{5, 3, 0}
+	}
+
+	return &smtp.SMTPError{
+		Code:         code,
+		EnhancedCode: enhanced,
+		Message:      e.Code + ": Cannot accept your message due to internal error, please report that to our engineers",
+	}
+}
+
+// errCircuitOpen 熔断期间不发送请求
+var errCircuitOpen = errors.New("circuit breaker open, webhook considered down")
+
+// deliverTarget 经过熔断器投递到目标对应的 sink，连接失败和未给出结论的非 2xx 响应计为不健康
+func deliverTarget(target *WebhookTarget, msg *EmailMessage) error {
+	sink, err := sinkFor(target)
+	if err != nil {
+		return &DeliveryError{Code: "E6", Err: err}
+	}
+
+	if breaker == nil {
+		return sink.Deliver(target, msg)
+	}
+
+	if !breaker.Allow(target.URL) {
+		return &DeliveryError{Code: "E5", Err: errCircuitOpen}
+	}
+
+	err = sink.Deliver(target, msg)
+	if derr, ok := err.(*DeliveryError); ok && derr.Code != "" && !derr.Permanent {
+		breaker.Failure(target.URL)
+	} else {
+		breaker.Success(target.URL)
+	}
+
+	return err
+}
+
+// maxResponseBody 读取 webhook 响应的上限，超出部分丢弃
+const maxResponseBody = 1024 * 1024
+
+// webhookResponse webhook 的响应
+type webhookResponse struct {
+	StatusCode int
+	Status     string
+	Body       []byte
+}
+
+// postWebhook 将邮件 POST 到 webhook
+func postWebhook(target *WebhookTarget, msg *EmailMessage) error {
+	payload, err := encodePayload(target, msg)
+	if err != nil {
+		return &DeliveryError{Code: "E1", Permanent: true, Err: fmt.Errorf("cannot encode message: %v", err)}
+	}
+
+	resp, err := exchangeWebhook(target, payload)
+	if err != nil {
+		return err
+	}
+
+	verdict := parseVerdict(resp.StatusCode, resp.Body)
+	log.Printf("WEBHOOK: Verdict: %s", verdict.describe())
+	return verdictError(verdict, hasExplicitVerdict(resp.Body),
+		fmt.Sprintf("%s, Body: %s", resp.Status, string(resp.Body)))
+}
+
+// exchangeWebhook 发送请求体并返回最终的响应：webhook 不支持压缩时改为不压缩重试，
+// OAuth2 令牌被拒绝时刷新后重试
+func exchangeWebhook(target *WebhookTarget, payload *Payload) (*webhookResponse, error) {
+	size, err := payload.Size()
+	if err != nil {
+		return nil, &DeliveryError{Code: "E1", Permanent: true, Err: fmt.Errorf("cannot encode message: %v", err)}
+	}
+
+	encoding := requestEncoding(target, size)
+	resp, token, err := sendWebhook(target, payload, encoding)
+
+	// 415 说明 webhook 不支持压缩，改为不压缩重试，之后也不再压缩
+	if err == nil && resp.StatusCode == http.StatusUnsupportedMediaType && encoding != "" {
+		log.Printf("WEBHOOK: %s does not accept %s request bodies, retrying uncompressed", target.URL, encoding)
+		identityOnly.Store(target.URL, true)
+		encoding = ""
+		resp, token, err = sendWebhook(target, payload, encoding)
+	}
+
+	// 401 时刷新 OAuth2 令牌后重试一次
+	if err == nil && resp.StatusCode == http.StatusUnauthorized && token != "" {
+		log.Printf("WEBHOOK: %s returned 401, refreshing OAuth2 token and retrying", target.URL)
+		tokenSource.Invalidate(token)
+		resp, _, err = sendWebhook(target, payload, encoding)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("WEBHOOK: Received response - Status: %d, Size: %d bytes",
+		resp.StatusCode, len(resp.Body))
+
+	return resp, nil
+}
+
+// verdictError 将结论转换为投递结果，explicit 表示 webhook 明确给出了 action，detail 用于日志
+func verdictError(verdict *WebhookVerdict, explicit bool, detail string) error {
+	switch verdict.Action {
+	case VerdictAccept:
+		return nil
+	case VerdictReject:
+		return &DeliveryError{Permanent: true, Verdict: verdict,
+			Err: fmt.Errorf("rejected by webhook - %s", detail)}
+	default:
+		derr := &DeliveryError{Verdict: verdict,
+			Err: fmt.Errorf("temporary failure from webhook - %s", detail)}
+		// 非 2xx 且未给出结论时不向发送方透露响应内容
+		if !explicit {
+			derr.Code = "E2"
+			derr.Verdict = nil
+		}
+		return derr
+	}
+}
+
+// sendWebhook 按 encoding 压缩后发送一次请求，同时返回使用的 OAuth2 令牌。
+// 请求体在发送时流式生成；需要压缩或签名时先空跑一遍得出实际发送的长度和签名，
+// 因为编码和压缩的输出是确定的，两次生成的字节相同
+func sendWebhook(target *WebhookTarget, payload *Payload, encoding string) (*webhookResponse, string, error) {
+	now, deliveryID := time.Now(), signature.NewDeliveryID()
+
+	length, err := payload.Size()
+	var signer *signature.Signer
+	if err == nil && (encoding != "" || target.SigningKey != "") {
+		counter := &countingWriter{}
+		var w io.Writer = counter
+		if target.SigningKey != "" {
+			signer = signature.NewSigner([]byte(target.SigningKey), now.Unix(), deliveryID)
+			w = io.MultiWriter(counter, signer)
+		}
+		err = writeWire(w, payload, encoding)
+		length = counter.n
+	}
+	if err != nil {
+		return nil, "", &DeliveryError{Code: "E1", Permanent: true, Err: fmt.Errorf("cannot encode message: %v", err)}
+	}
+
+	req, err := http.NewRequest(http.MethodPost, target.URL, wireBody(payload, encoding))
+	if err != nil {
+		return nil, "", &DeliveryError{Code: "E1", Permanent: true, Err: fmt.Errorf("invalid webhook URL: %v", err)}
+	}
+	req.ContentLength = length
+	req.GetBody = func() (io.ReadCloser, error) {
+		return wireBody(payload, encoding), nil
+	}
+
+	req.Header.Set("Content-Type", payload.ContentType)
+	if encoding != "" {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+
+	if payload.IdempotencyKey != "" {
+		req.Header.Set(HeaderIdempotencyKey, payload.IdempotencyKey)
+	}
+
+	// 接收方不解析请求体也能按评分分拣，模板中的同名头优先
+	if payload.Security != nil {
+		req.Header.Set(HeaderSpamScore, strconv.Itoa(payload.Security.Score))
+		req.Header.Set(HeaderSpamFlag, spamFlag(payload.Security.Flagged))
+	}
+
+	for name, value := range payload.Headers {
+		req.Header.Set(name, value)
+	}
+
+	for name, value := range target.Headers {
+		req.Header.Set(name, value)
+	}
+
+	// Add API key header if provided (for cloud-mail inbound authentication)
+	if target.InboundKey != "" {
+		req.Header.Set("X-Inbound-Key", target.InboundKey)
+		log.Printf("WEBHOOK: Adding API key header: %s...", target.InboundKey[:min(8, len(target.InboundKey))])
+	}
+
+	token := ""
+	if target.OAuth && tokenSource != nil {
+		if token, err = tokenSource.Token(); err != nil {
+			return nil, "", &DeliveryError{Code: "E9", Err: fmt.Errorf("cannot obtain OAuth2 token: %v", err)}
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	// 签名在每次发送时计算，重试时时间戳随之更新；签名覆盖实际发送的（压缩后的）请求体
+	if signer != nil {
+		req.Header.Set(signature.HeaderTimestamp, strconv.FormatInt(now.Unix(), 10))
+		req.Header.Set(signature.HeaderDeliveryID, deliveryID)
+		req.Header.Set(signature.HeaderSignature, signer.Sum())
+	}
+
+	log.Printf("WEBHOOK: Sending POST request to %s (%d bytes)", target.URL, length)
+	client, err := clientFor(target)
+	if err != nil {
+		return nil, "", &DeliveryError{Code: "E1", Err: err}
+	}
+	resp, err := client.GetClient().Do(req)
+	if err != nil {
+		return nil, "", &DeliveryError{Code: "E1", Err: fmt.Errorf("request failed: %v", err)}
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseBody))
+	if err != nil {
+		return nil, "", &DeliveryError{Code: "E1", Err: fmt.Errorf("cannot read response: %v", err)}
+	}
+
+	return &webhookResponse{StatusCode: resp.StatusCode, Status: resp.Status, Body: body}, token, nil
+}
+
+// writeWire 将压缩后的请求体写入 w
+func writeWire(w io.Writer, payload *Payload, encoding string) error {
+	cw, err := compressWriter(encoding, w)
+	if err != nil {
+		return err
+	}
+	if err := payload.WriteBody(cw); err != nil {
+		cw.Close()
+		return err
+	}
+	return cw.Close()
+}
+
+// wireBody 由后台 goroutine 边编码边写入管道，HTTP 客户端读取多少就生成多少；
+// 请求结束时客户端关闭管道，goroutine 随之退出
+func wireBody(payload *Payload, encoding string) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeWire(pw, payload, encoding))
+	}()
+	return pr
+}